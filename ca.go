@@ -0,0 +1,383 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy/internal/pkcs12"
+)
+
+// KeyAlgorithm is the kind of key of a CA created by GenerateCA, or of the
+// certificates it signs.
+type KeyAlgorithm int
+
+const (
+	// KeyDefault is RSA 2048 bits for a CA, and the kind of key of the CA
+	// for the certificates it signs
+	KeyDefault KeyAlgorithm = iota
+	KeyRSA2048
+	KeyRSA3072
+	KeyRSA4096
+	KeyECDSAP256
+	KeyECDSAP384
+	KeyEd25519
+)
+
+// generateKey returns a new key of kind alg, read from r.
+func generateKey(alg KeyAlgorithm, r io.Reader) (crypto.Signer, error) {
+	switch alg {
+	case KeyDefault, KeyRSA2048:
+		return rsa.GenerateKey(r, 2048)
+	case KeyRSA3072:
+		return rsa.GenerateKey(r, 3072)
+	case KeyRSA4096:
+		return rsa.GenerateKey(r, 4096)
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), r)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), r)
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(r)
+		return key, err
+	}
+	return nil, fmt.Errorf("goproxy: unknown key algorithm %d", alg)
+}
+
+// CAOptions describes the CA created by GenerateCA.
+type CAOptions struct {
+	// Subject of the CA, "goproxy MITM CA" if empty
+	Subject pkix.Name
+	// Validity of the CA, 10 years if zero
+	Validity time.Duration
+	// Key is the kind of key of the CA, RSA 2048 bits by default
+	Key KeyAlgorithm
+}
+
+// GenerateCA creates a new self-signed CA to sign the certificates of MITM'd
+// hosts. Unlike GoproxyCa, whose private key is public, it is only trusted by
+// the clients it is installed on:
+//
+//	ca, err := goproxy.LoadOrGenerateCA("ca.pem", "ca.key", goproxy.CAOptions{Key: goproxy.KeyECDSAP256})
+//	...
+//	proxy, err := goproxy.New(goproxy.WithCA(*ca))
+//	...
+//	proxy.NonproxyHandler = goproxy.NewCAHandler(ca)
+func GenerateCA(opts CAOptions) (*tls.Certificate, error) {
+	key, err := generateKey(opts.Key, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	subject := opts.Subject
+	if subject.CommonName == "" && len(subject.Organization) == 0 {
+		subject.CommonName = "goproxy MITM CA"
+	}
+	validity := opts.Validity
+	if validity == 0 {
+		validity = 10 * 365 * 24 * time.Hour
+	}
+	// clients with a clock slightly late must accept the CA right away
+	now := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	ca := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	if ca.Leaf, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// EncodeCA returns the PEM encoding of the certificate chain of ca, and of
+// its private key in PKCS#8.
+func EncodeCA(ca *tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	var buf bytes.Buffer
+	for _, der := range ca.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), nil
+}
+
+// SaveCA writes the certificate of ca to certFile and its private key to
+// keyFile, readable only by the current user, in PEM.
+func SaveCA(ca *tls.Certificate, certFile, keyFile string) error {
+	certPEM, keyPEM, err := EncodeCA(ca)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
+
+// ParseCA returns the CA whose certificate is certData and whose private key
+// is keyData. Both may be PEM or DER, and the key PKCS#1, PKCS#8 or SEC 1.
+func ParseCA(certData, keyData []byte) (*tls.Certificate, error) {
+	var ca tls.Certificate
+	if bytes.Contains(certData, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			if block, certData = pem.Decode(certData); block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				ca.Certificate = append(ca.Certificate, block.Bytes)
+			}
+		}
+	} else if len(certData) > 0 {
+		ca.Certificate = [][]byte{certData}
+	}
+
+	if bytes.Contains(keyData, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			if block, keyData = pem.Decode(keyData); block == nil {
+				return nil, errors.New("goproxy: no private key in PEM data")
+			}
+			if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+				keyData = block.Bytes
+				break
+			}
+		}
+	}
+	var err error
+	if ca.PrivateKey, err = parsePrivateKey(keyData); err != nil {
+		return nil, err
+	}
+	if err := checkCA(&ca); err != nil {
+		return nil, fmt.Errorf("goproxy: %v", err)
+	}
+	return &ca, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("goproxy: unsupported private key")
+}
+
+// LoadCA reads the CA from certFile and keyFile, see ParseCA.
+func LoadCA(certFile, keyFile string) (*tls.Certificate, error) {
+	certData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCA(certData, keyData)
+}
+
+// ParsePKCS12CA returns the CA held by the PKCS#12 (.p12, .pfx) data, as
+// exported by OpenSSL, Windows or the keychain of macOS.
+func ParsePKCS12CA(data []byte, password string) (*tls.Certificate, error) {
+	ca, err := parsePKCS12(data, password)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCA(ca); err != nil {
+		return nil, fmt.Errorf("goproxy: %v", err)
+	}
+	return ca, nil
+}
+
+// parsePKCS12 returns the key pair held by the PKCS#12 data.
+func parsePKCS12(data []byte, password string) (*tls.Certificate, error) {
+	key, certs, err := pkcs12.Decode(data, password)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("goproxy: no private key in PKCS#12 data")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("goproxy: unsupported private key %T", key)
+	}
+	// the certificate of the key comes first, then the rest of the chain
+	pair := tls.Certificate{PrivateKey: key}
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(signer.Public()) {
+			pair.Certificate = append([][]byte{cert.Raw}, pair.Certificate...)
+			pair.Leaf = cert
+		} else {
+			pair.Certificate = append(pair.Certificate, cert.Raw)
+		}
+	}
+	if pair.Leaf == nil {
+		return nil, errors.New("goproxy: no certificate for the private key in PKCS#12 data")
+	}
+	return &pair, nil
+}
+
+// LoadPKCS12CA reads the CA from a PKCS#12 file, see ParsePKCS12CA.
+func LoadPKCS12CA(file, password string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePKCS12CA(data, password)
+}
+
+// LoadOrGenerateCA reads the CA from certFile and keyFile. If neither exists,
+// it generates a CA as described by opts and saves it there, so that the
+// proxy keeps its CA across restarts.
+func LoadOrGenerateCA(certFile, keyFile string, opts CAOptions) (*tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		return LoadCA(certFile, keyFile)
+	}
+	ca, err := GenerateCA(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveCA(ca, certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// CAFormat is an encoding of the certificate of a CA, as clients install it.
+type CAFormat int
+
+const (
+	// CAFormatPEM is the encoding of Firefox, Linux and macOS
+	CAFormatPEM CAFormat = iota
+	// CAFormatDER is the encoding of Windows, Android and iOS, which open
+	// .crt and .cer files with it
+	CAFormatDER
+)
+
+// ExportCA returns the certificate of ca, without its private key, in format.
+func ExportCA(ca *tls.Certificate, format CAFormat) ([]byte, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("goproxy: no certificate")
+	}
+	root := ca.Certificate[len(ca.Certificate)-1]
+	switch format {
+	case CAFormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root}), nil
+	case CAFormatDER:
+		return root, nil
+	}
+	return nil, fmt.Errorf("goproxy: unknown CA format %d", format)
+}
+
+var caPageTemplate = template.Must(template.New("ca").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<p>This proxy decrypts the HTTPS traffic going through it. Install its CA, and trust it to identify websites, for your browser to accept the certificates it signs.</p>
+<p>SHA-256 fingerprint: <code>{{.Fingerprint}}</code></p>
+<h2>Windows</h2>
+<p>Download <a href="ca.cer">ca.cer</a>, open it, click <i>Install Certificate</i> and place it in the <i>Trusted Root Certification Authorities</i> store.</p>
+<h2>macOS</h2>
+<p>Download <a href="ca.pem">ca.pem</a>, open it in Keychain Access, and set <i>When using this certificate</i> to <i>Always Trust</i>.</p>
+<h2>iOS</h2>
+<p>Open <a href="ca.crt">ca.crt</a> in Safari and install the profile in <i>Settings &gt; General &gt; VPN &amp; Device Management</i>, then enable it in <i>Settings &gt; General &gt; About &gt; Certificate Trust Settings</i>.</p>
+<h2>Android</h2>
+<p>Download <a href="ca.crt">ca.crt</a> and install it in <i>Settings &gt; Security &gt; Encryption &amp; credentials &gt; Install a certificate &gt; CA certificate</i>.</p>
+<h2>Linux</h2>
+<p>Download <a href="ca.pem">ca.pem</a>, then on Debian and Ubuntu copy it to <code>/usr/local/share/ca-certificates/goproxy.crt</code> and run <code>update-ca-certificates</code>, on Fedora copy it to <code>/etc/pki/ca-trust/source/anchors/</code> and run <code>update-ca-trust</code>.</p>
+<h2>Firefox</h2>
+<p>Firefox has its own list of CAs: in <i>Settings &gt; Privacy &amp; Security &gt; Certificates &gt; View Certificates &gt; Authorities</i>, import <a href="ca.pem">ca.pem</a> and trust it to identify websites.</p>
+</body>
+</html>
+`))
+
+// NewCAHandler returns a handler serving the certificate of ca, to be
+// downloaded by the clients of the proxy, along with an install page:
+//
+//	proxy.NonproxyHandler = goproxy.NewCAHandler(ca)
+//
+// It serves the page at /, the PEM certificate at /ca.pem and the DER one at
+// /ca.crt and /ca.cer. Only the certificate is served, never the private key.
+func NewCAHandler(ca *tls.Certificate) http.Handler {
+	pemData, pemErr := ExportCA(ca, CAFormatPEM)
+	derData, _ := ExportCA(ca, CAFormatDER)
+	var name, fingerprint string
+	if root, err := x509.ParseCertificate(derData); err == nil {
+		name = root.Subject.CommonName
+		sum := sha256.Sum256(root.Raw)
+		hexes := make([]string, len(sum))
+		for i, b := range sum {
+			hexes[i] = fmt.Sprintf("%02X", b)
+		}
+		fingerprint = strings.Join(hexes, ":")
+	}
+	if name == "" {
+		name = "goproxy CA"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pemErr != nil {
+			http.Error(w, pemErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/", "":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			caPageTemplate.Execute(w, struct{ Name, Fingerprint string }{name, fingerprint})
+		case "/ca.pem":
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			w.Header().Set("Content-Disposition", `attachment; filename="ca.pem"`)
+			w.Write(pemData)
+		case "/ca.crt", "/ca.cer":
+			w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+			w.Write(derData)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateCA(t *testing.T) {
+	for _, alg := range []KeyAlgorithm{KeyRSA2048, KeyECDSAP256, KeyECDSAP384} {
+		ca, err := GenerateCA(CAOptions{
+			Subject:  pkix.Name{CommonName: "test CA", Organization: []string{"goproxy"}},
+			Validity: 24 * time.Hour,
+			Key:      alg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCA(ca); err != nil {
+			t.Errorf("key %d: %v", alg, err)
+		}
+		if ca.Leaf.Subject.CommonName != "test CA" || ca.Leaf.NotAfter.Sub(ca.Leaf.NotBefore) != 24*time.Hour {
+			t.Errorf("key %d: unexpected subject %v or validity", alg, ca.Leaf.Subject)
+		}
+
+		// the certificates it signs are valid
+		cert, err := signHost(*ca, []string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Leaf)
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots, CurrentTime: time.Now()}); err != nil {
+			t.Errorf("key %d: %v", alg, err)
+		}
+	}
+}
+
+func TestLoadOrGenerateCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+
+	first, err := LoadOrGenerateCA(certFile, keyFile, CAOptions{Key: KeyECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the key to be private, got %v", err)
+	}
+	second, err := LoadOrGenerateCA(certFile, keyFile, CAOptions{Key: KeyECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Error("expected the saved CA to be loaded")
+	}
+
+	// a missing key is an error, not a new CA
+	os.Remove(keyFile)
+	if _, err := LoadOrGenerateCA(certFile, keyFile, CAOptions{}); err == nil {
+		t.Error("expected an error without the key")
+	}
+}
+
+func TestParseCA(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{Key: KeyRSA2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := EncodeCA(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(ca.PrivateKey.(*rsa.PrivateKey))})
+	for name, data := range map[string][2][]byte{
+		"pem":   {certPEM, keyPEM},
+		"der":   {ca.Certificate[0], keyBlock.Bytes},
+		"pkcs1": {certPEM, pkcs1},
+	} {
+		parsed, err := ParseCA(data[0], data[1])
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(parsed.Certificate[0], ca.Certificate[0]) || parsed.Leaf == nil {
+			t.Errorf("%s: expected the generated CA", name)
+		}
+	}
+
+	host, _ := signHost(*ca, []string{"example.com"})
+	hostCert, hostKey, _ := EncodeCA(host)
+	if _, err := ParseCA(hostCert, hostKey); err == nil {
+		t.Error("expected a host certificate to be rejected")
+	}
+	if _, err := ParseCA(certPEM, hostKey); err == nil {
+		t.Error("expected a key not matching the certificate to be rejected")
+	}
+}
+
+func TestLoadPKCS12CA(t *testing.T) {
+	ca, err := LoadPKCS12CA("internal/pkcs12/testdata/modern.p12", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Leaf.Subject.CommonName != "pkcs12 test CA" {
+		t.Errorf("unexpected CA %v", ca.Leaf.Subject)
+	}
+	if _, err := LoadPKCS12CA("internal/pkcs12/testdata/modern.p12", "wrong"); err == nil {
+		t.Error("expected an error with a wrong password")
+	}
+}
+
+func TestCAHandler(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{Subject: pkix.Name{CommonName: "download CA"}, Key: KeyECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxyHttpServer()
+	proxy.NonproxyHandler = NewCAHandler(ca)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, b
+	}
+	_, page := get("/")
+	if !strings.Contains(string(page), "download CA") || !strings.Contains(string(page), `href="ca.cer"`) {
+		t.Errorf("unexpected install page %q", page)
+	}
+	resp, b := get("/ca.pem")
+	if block, _ := pem.Decode(b); block == nil || !bytes.Equal(block.Bytes, ca.Certificate[0]) {
+		t.Errorf("expected the PEM certificate, got %q", b)
+	}
+	resp, b = get("/ca.crt")
+	if resp.Header.Get("Content-Type") != "application/x-x509-ca-cert" || !bytes.Equal(b, ca.Certificate[0]) {
+		t.Errorf("expected the DER certificate, got %s", resp.Header.Get("Content-Type"))
+	}
+	if resp, _ = get("/ca.key"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %s", resp.Status)
+	}
+}
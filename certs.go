@@ -6,12 +6,9 @@ import (
 )
 
 func init() {
-	if goproxyCaErr != nil {
-		panic("Error parsing builtin CA " + goproxyCaErr.Error())
-	}
-	var err error
-	if GoproxyCa.Leaf, err = x509.ParseCertificate(GoproxyCa.Certificate[0]); err != nil {
-		panic("Error parsing builtin CA " + err.Error())
+	// New reports the errors of the builtin CA
+	if goproxyCaErr == nil {
+		GoproxyCa.Leaf, goproxyCaErr = x509.ParseCertificate(GoproxyCa.Certificate[0])
 	}
 }
 
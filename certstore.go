@@ -0,0 +1,289 @@
+package goproxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LRUCertStorage keeps the certificates of the most recently used hosts in
+// memory. Certificates are generated again shortly before their NotAfter date,
+// and concurrent fetches of the certificate of a host generate it once.
+type LRUCertStorage struct {
+	// MaxEntries is the number of certificates kept, no limit if zero
+	MaxEntries int
+
+	mu      sync.Mutex
+	ll      *list.List // of *lruCertEntry, most recently used first
+	entries map[string]*list.Element
+	flight  certFlight
+	now     func() time.Time
+}
+
+type lruCertEntry struct {
+	hostname string
+	cert     *tls.Certificate
+	renewAt  time.Time
+}
+
+// NewLRUCertStorage returns a store keeping at most maxEntries certificates.
+func NewLRUCertStorage(maxEntries int) *LRUCertStorage {
+	return &LRUCertStorage{MaxEntries: maxEntries}
+}
+
+func (s *LRUCertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if cert := s.get(hostname); cert != nil {
+		return cert, nil
+	}
+	return s.flight.do(hostname, func() (*tls.Certificate, error) {
+		if cert := s.get(hostname); cert != nil {
+			return cert, nil
+		}
+		cert, err := gen()
+		if err != nil {
+			return nil, err
+		}
+		s.add(hostname, cert)
+		return cert, nil
+	})
+}
+
+// Len returns the number of certificates in the store.
+func (s *LRUCertStorage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *LRUCertStorage) get(hostname string) *tls.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[hostname]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*lruCertEntry)
+	if !s.timeNow().Before(e.renewAt) {
+		s.ll.Remove(el)
+		delete(s.entries, hostname)
+		return nil
+	}
+	s.ll.MoveToFront(el)
+	return e.cert
+}
+
+func (s *LRUCertStorage) add(hostname string, cert *tls.Certificate) {
+	renewAt, err := certRenewAt(cert)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.ll = list.New()
+		s.entries = make(map[string]*list.Element)
+	}
+	if el, ok := s.entries[hostname]; ok {
+		s.ll.Remove(el)
+	}
+	s.entries[hostname] = s.ll.PushFront(&lruCertEntry{hostname, cert, renewAt})
+	for s.MaxEntries > 0 && s.ll.Len() > s.MaxEntries {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruCertEntry).hostname)
+	}
+}
+
+func (s *LRUCertStorage) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// DiskCertStorage keeps the certificates in a directory, one PEM file per
+// host holding the certificate chain and the private key, so that they
+// survive restarts. The files are locked while in use, several processes can
+// share the directory.
+//
+// The certificates are not checked against the CA of the proxy, use a
+// directory per CA.
+type DiskCertStorage struct {
+	Dir string
+
+	flight certFlight
+	now    func() time.Time
+}
+
+// NewDiskCertStorage returns a store keeping the certificates in dir, which
+// is created if needed.
+func NewDiskCertStorage(dir string) (*DiskCertStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskCertStorage{Dir: dir}, nil
+}
+
+// Fetch returns the certificate of hostname from its file, or generates it
+// with gen and writes it.
+func (s *DiskCertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	return s.flight.do(hostname, func() (*tls.Certificate, error) {
+		f, err := os.OpenFile(filepath.Join(s.Dir, certFileName(hostname)), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := lockFile(f); err != nil {
+			return nil, err
+		}
+		defer unlockFile(f)
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		// the file is empty when created, and may have been left
+		// half-written by a crash
+		if cert, err := tls.X509KeyPair(data, data); err == nil {
+			if renewAt, err := certRenewAt(&cert); err == nil && s.timeNow().Before(renewAt) {
+				return &cert, nil
+			}
+		}
+
+		cert, err := gen()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = encodeCert(cert); err != nil {
+			return nil, err
+		}
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := f.WriteAt(data, 0); err != nil {
+			return nil, err
+		}
+		return cert, nil
+	})
+}
+
+func (s *DiskCertStorage) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// certFileName returns the name of the file of the certificate of hostname,
+// without the characters file systems may not accept, such as the colons of
+// IPv6 addresses and the stars of wildcards.
+func certFileName(hostname string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, hostname) + ".pem"
+}
+
+func encodeCert(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: key}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// TieredCertStorage looks certificates up in each of its stores in turn,
+// the fastest first, and adds the ones it finds in a slower store to the
+// faster ones:
+//
+//	disk, err := goproxy.NewDiskCertStorage("/var/cache/goproxy")
+//	...
+//	proxy.CertStore = goproxy.TieredCertStorage{goproxy.NewLRUCertStorage(1000), disk}
+type TieredCertStorage []CertStorage
+
+func (t TieredCertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if len(t) == 0 {
+		return gen()
+	}
+	return t[0].Fetch(hostname, func() (*tls.Certificate, error) {
+		return t[1:].Fetch(hostname, gen)
+	})
+}
+
+// certRenewalMargin is the longest a certificate is generated again before
+// its end, a tenth of its validity if shorter
+const certRenewalMargin = time.Hour
+
+// certRenewAt returns when cert is generated again: before the end of its
+// validity, so that clients with clocks running a bit fast still accept it.
+func certRenewAt(cert *tls.Certificate) (time.Time, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return time.Time{}, err
+		}
+	}
+	margin := leaf.NotAfter.Sub(leaf.NotBefore) / 10
+	if margin > certRenewalMargin {
+		margin = certRenewalMargin
+	}
+	return leaf.NotAfter.Add(-margin), nil
+}
+
+// certFlight runs a single generation of the certificate of a host at a
+// time, the concurrent callers getting its result.
+type certFlight struct {
+	mu    sync.Mutex
+	calls map[string]*certCall
+}
+
+type certCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func (f *certFlight) do(hostname string, fn func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	f.mu.Lock()
+	if c, ok := f.calls[hostname]; ok {
+		f.mu.Unlock()
+		<-c.done
+		return c.cert, c.err
+	}
+	if f.calls == nil {
+		f.calls = make(map[string]*certCall)
+	}
+	c := &certCall{done: make(chan struct{})}
+	f.calls[hostname] = c
+	f.mu.Unlock()
+
+	c.cert, c.err = fn()
+	f.mu.Lock()
+	delete(f.calls, hostname)
+	f.mu.Unlock()
+	close(c.done)
+	return c.cert, c.err
+}
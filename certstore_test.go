@@ -0,0 +1,176 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingGen returns a certificate generator counting its calls
+func countingGen(hostname string, calls *int32) func() (*tls.Certificate, error) {
+	return func() (*tls.Certificate, error) {
+		atomic.AddInt32(calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return signHost(EcdsaCa, []string{hostname})
+	}
+}
+
+func TestLRUCertStorage(t *testing.T) {
+	s := NewLRUCertStorage(2)
+	var calls int32
+	for _, host := range []string{"a.com", "b.com", "a.com", "c.com", "a.com"} {
+		if _, err := s.Fetch(host, countingGen(host, &calls)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 3 || s.Len() != 2 {
+		t.Errorf("expected a.com to stay and b.com to be evicted, got %d generations and %d entries", calls, s.Len())
+	}
+	s.Fetch("b.com", countingGen("b.com", &calls))
+	if calls != 4 {
+		t.Errorf("expected b.com to be generated again, got %d generations", calls)
+	}
+
+	// signHost certificates expire on 2049-12-31, they are kept until the
+	// hour before
+	s.now = func() time.Time { return time.Date(2049, 12, 30, 22, 59, 0, 0, time.UTC) }
+	s.Fetch("a.com", countingGen("a.com", &calls))
+	if calls != 4 {
+		t.Errorf("expected the certificate to be kept until its renewal, got %d generations", calls)
+	}
+	s.now = func() time.Time { return time.Date(2049, 12, 30, 23, 0, 0, 0, time.UTC) }
+	s.Fetch("a.com", countingGen("a.com", &calls))
+	if calls != 5 {
+		t.Errorf("expected the certificate about to expire to be generated again, got %d generations", calls)
+	}
+}
+
+func TestCertStorageSingleGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk1, _ := NewDiskCertStorage(dir)
+	disk2, _ := NewDiskCertStorage(dir)
+
+	for name, stores := range map[string][]CertStorage{
+		"lru":  {NewLRUCertStorage(10)},
+		"disk": {disk1, disk2},
+	} {
+		var calls int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(s CertStorage) {
+				defer wg.Done()
+				if _, err := s.Fetch("example.com", countingGen("example.com", &calls)); err != nil {
+					t.Error(err)
+				}
+			}(stores[i%len(stores)])
+		}
+		wg.Wait()
+		if calls != 1 {
+			t.Errorf("%s: expected a single generation, got %d", name, calls)
+		}
+	}
+}
+
+func TestDiskCertStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewDiskCertStorage(filepath.Join(dir, "certs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	first, err := s.Fetch("::1", countingGen("::1", &calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "certs", "__1.pem")); err != nil {
+		t.Error("expected the certificate to be written:", err)
+	}
+
+	// a new store, as after a restart
+	s, _ = NewDiskCertStorage(filepath.Join(dir, "certs"))
+	second, err := s.Fetch("::1", countingGen("::1", &calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || string(second.Certificate[0]) != string(first.Certificate[0]) {
+		t.Errorf("expected the certificate to be read back, got %d generations", calls)
+	}
+	if len(second.Certificate) != 2 {
+		t.Errorf("expected the chain to be kept, got %d certificates", len(second.Certificate))
+	}
+
+	s.now = func() time.Time { return time.Date(2049, 12, 30, 23, 30, 0, 0, time.UTC) }
+	s.Fetch("::1", countingGen("::1", &calls))
+	if calls != 2 {
+		t.Errorf("expected the certificate about to expire to be generated again, got %d generations", calls)
+	}
+
+	// a corrupted file is replaced
+	ioutil.WriteFile(filepath.Join(dir, "certs", "bad.com.pem"), []byte("-----BEGIN CERT"), 0600)
+	s.now = nil
+	if _, err := s.Fetch("bad.com", countingGen("bad.com", &calls)); err != nil || calls != 3 {
+		t.Errorf("expected the corrupted certificate to be generated again, got %v after %d generations", err, calls)
+	}
+}
+
+func TestCertRenewAt(t *testing.T) {
+	for _, v := range []struct {
+		validity, margin time.Duration
+	}{
+		{365 * 24 * time.Hour, time.Hour},
+		{5 * time.Hour, 30 * time.Minute},
+	} {
+		cert, err := signHostProfile(EcdsaCa, []string{"example.com"}, &CertProfile{Validity: v.validity}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		renewAt, err := certRenewAt(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		if d := leaf.NotAfter.Sub(renewAt); d != v.margin {
+			t.Errorf("validity %v: expected a renewal %v before the end, got %v", v.validity, v.margin, d)
+		}
+	}
+}
+
+func TestTieredCertStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, _ := NewDiskCertStorage(dir)
+	var calls int32
+	disk.Fetch("example.com", countingGen("example.com", &calls))
+
+	lru := NewLRUCertStorage(10)
+	tiered := TieredCertStorage{lru, disk}
+	if _, err := tiered.Fetch("example.com", countingGen("example.com", &calls)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || lru.Len() != 1 {
+		t.Errorf("expected the certificate on disk to be cached in memory, got %d generations", calls)
+	}
+	failing := func() (*tls.Certificate, error) { return nil, errors.New("no CA") }
+	if _, err := tiered.Fetch("other.com", failing); err == nil || lru.Len() != 1 {
+		t.Errorf("expected the error of the generation, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientCertSelector picks the client certificate the proxy presents to the
+// remote host of the HTTPS request of ctx, for hosts requiring mutual TLS.
+// It returns nil for no certificate.
+type ClientCertSelector interface {
+	SelectClientCert(host string, ctx *ProxyCtx) (*tls.Certificate, error)
+}
+
+// clientCertCheckInterval is how often the files of ClientCerts are checked
+// for changes
+var clientCertCheckInterval = time.Second
+
+// ClientCerts is a ClientCertSelector reading the certificates from files,
+// by destination host or by the user the proxy authenticated, the user
+// winning. The files are read again when they change, so certificates can be
+// renewed without restarting the proxy:
+//
+//	certs := goproxy.NewClientCerts()
+//	certs.AddHost(".internal.example", "internal.crt", "internal.key")
+//	certs.AddUserPKCS12("alice", "alice.p12", os.Getenv("ALICE_P12_PASSWORD"))
+//	proxy.ClientCerts = certs
+//
+// Since Tr also connects to the HTTPS parent proxies, the certificate is
+// only sent to the servers accepting its issuer.
+type ClientCerts struct {
+	mu    sync.Mutex
+	hosts *DomainSet
+	files map[string]*clientCertFile // by DomainSet entry, or by "user:" and user
+}
+
+type clientCertFile struct {
+	certFile, keyFile string
+	password          string
+	pkcs12            bool
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewClientCerts returns an empty ClientCerts.
+func NewClientCerts() *ClientCerts {
+	return &ClientCerts{hosts: NewDomainSet(), files: make(map[string]*clientCertFile)}
+}
+
+// AddHost presents the PEM certificate of certFile and key of keyFile to the
+// hosts matching entry, an entry of DomainSet such as "api.example.com" or
+// ".example.com".
+func (c *ClientCerts) AddHost(entry, certFile, keyFile string) error {
+	return c.addHost(entry, &clientCertFile{certFile: certFile, keyFile: keyFile})
+}
+
+// AddHostPKCS12 is AddHost with a PKCS#12 file holding the certificate and
+// its key.
+func (c *ClientCerts) AddHostPKCS12(entry, file, password string) error {
+	return c.addHost(entry, &clientCertFile{certFile: file, password: password, pkcs12: true})
+}
+
+// AddUser presents the PEM certificate of certFile and key of keyFile on the
+// behalf of user, see ProxyCtx.User.
+func (c *ClientCerts) AddUser(user, certFile, keyFile string) error {
+	return c.add("user:"+user, &clientCertFile{certFile: certFile, keyFile: keyFile})
+}
+
+// AddUserPKCS12 is AddUser with a PKCS#12 file holding the certificate and
+// its key.
+func (c *ClientCerts) AddUserPKCS12(user, file, password string) error {
+	return c.add("user:"+user, &clientCertFile{certFile: file, password: password, pkcs12: true})
+}
+
+func (c *ClientCerts) addHost(entry string, f *clientCertFile) error {
+	// report broken files right away
+	if _, err := f.get(); err != nil {
+		return err
+	}
+	if err := c.hosts.Add(entry); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[entry] = f
+	return nil
+}
+
+func (c *ClientCerts) add(key string, f *clientCertFile) error {
+	if _, err := f.get(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[key] = f
+	return nil
+}
+
+// SelectClientCert implements ClientCertSelector.
+func (c *ClientCerts) SelectClientCert(host string, ctx *ProxyCtx) (*tls.Certificate, error) {
+	c.mu.Lock()
+	var f *clientCertFile
+	if ctx.User != "" {
+		f = c.files["user:"+ctx.User]
+	}
+	if f == nil {
+		if entry, ok := c.hosts.Match(host); ok {
+			f = c.files[entry]
+		}
+	}
+	c.mu.Unlock()
+	if f == nil {
+		return nil, nil
+	}
+	return f.get()
+}
+
+// get returns the certificate of the files, reading them again if they
+// changed. The certificate read last is kept while the new files are broken,
+// as when they are being written.
+func (f *clientCertFile) get() (*tls.Certificate, error) {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cert != nil && now.Sub(f.lastCheck) < clientCertCheckInterval {
+		return f.cert, nil
+	}
+	f.lastCheck = now
+
+	modTime, err := f.latestModTime()
+	if err != nil || (f.cert != nil && modTime.Equal(f.modTime)) {
+		if f.cert != nil {
+			return f.cert, nil
+		}
+		return nil, err
+	}
+	cert, err := f.load()
+	if err != nil {
+		if f.cert != nil {
+			return f.cert, nil
+		}
+		return nil, err
+	}
+	f.cert, f.modTime = cert, modTime
+	return cert, nil
+}
+
+func (f *clientCertFile) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{f.certFile, f.keyFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (f *clientCertFile) load() (*tls.Certificate, error) {
+	if f.pkcs12 {
+		data, err := ioutil.ReadFile(f.certFile)
+		if err != nil {
+			return nil, err
+		}
+		return parsePKCS12(data, f.password)
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// clientCertFunc returns a tls.Config.GetClientCertificate presenting cert
+// to the servers accepting it.
+func clientCertFunc(cert *tls.Certificate) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if cri.SupportsCertificate(cert) != nil {
+			return &tls.Certificate{}, nil
+		}
+		return cert, nil
+	}
+}
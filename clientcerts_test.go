@@ -0,0 +1,123 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientCerts(t *testing.T) {
+	defer func(interval time.Duration) { clientCertCheckInterval = interval }(clientCertCheckInterval)
+	clientCertCheckInterval = 0
+
+	clientCA, err := GenerateCA(CAOptions{Subject: pkix.Name{CommonName: "client CA"}, Validity: 24 * time.Hour, Key: KeyECDSAP256})
+	orFatal("GenerateCA", err, t)
+	dir, err := ioutil.TempDir("", "goproxy-clientcerts")
+	orFatal("TempDir", err, t)
+	defer os.RemoveAll(dir)
+	writeCert := func(name string) {
+		cert, err := signHostProfile(*clientCA, []string{name}, &CertProfile{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, nil, nil)
+		orFatal("signHostProfile", err, t)
+		certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+		if name == "renewed" {
+			certFile, keyFile = filepath.Join(dir, "host.crt"), filepath.Join(dir, "host.key")
+		}
+		orFatal("SaveCA", SaveCA(cert, certFile, keyFile), t)
+		// the file system may not see the rewrite within its time resolution
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, future, future)
+	}
+	writeCert("host")
+	writeCert("alice")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.Leaf)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.Write([]byte("none"))
+			return
+		}
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	backend.StartTLS()
+	defer backend.Close()
+
+	certs := NewClientCerts()
+	orFatal("AddHost", certs.AddHost("127.0.0.1", filepath.Join(dir, "host.crt"), filepath.Join(dir, "host.key")), t)
+	orFatal("AddUser", certs.AddUser("alice", filepath.Join(dir, "alice.crt"), filepath.Join(dir, "alice.key")), t)
+	if err := certs.AddHost("missing.com", filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("expected an error for missing files")
+	}
+
+	proxy, err := New(WithEnvProxy(false), WithClientCerts(certs))
+	orFatal("New", err, t)
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.User = ctx.Req.Header.Get("X-User")
+		return MitmConnect, host
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.User == "" {
+			ctx.User = req.Header.Get("X-User")
+		}
+		return req, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+
+	get := func(user string, mitm bool) string {
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		req.Header.Set("X-User", user)
+		var resp *http.Response
+		if mitm {
+			tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				ProxyConnectHeader: http.Header{"X-User": {user}}}
+			defer tr.CloseIdleConnections()
+			resp, err = tr.RoundTrip(req)
+			orFatal("RoundTrip", err, t)
+		} else {
+			// an https URL sent to the proxy as is, forwarded by Tr
+			conn, err := net.Dial("tcp", s.Listener.Addr().String())
+			orFatal("Dial", err, t)
+			defer conn.Close()
+			orFatal("WriteProxy", req.WriteProxy(conn), t)
+			resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+			orFatal("ReadResponse", err, t)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		orFatal("ReadAll", err, t)
+		return string(b)
+	}
+	for _, mitm := range []bool{true, false} {
+		if cn := get("", mitm); cn != "host" {
+			t.Errorf("mitm %v: expected the certificate of the host, got %q", mitm, cn)
+		}
+		if cn := get("alice", mitm); cn != "alice" {
+			t.Errorf("mitm %v: expected the certificate of the user, got %q", mitm, cn)
+		}
+	}
+
+	writeCert("renewed")
+	if cn := get("", true); cn != "renewed" {
+		t.Errorf("expected the renewed certificate, got %q", cn)
+	}
+	// the copy of Tr presenting the certificate of the host was replaced
+	proxy.transports.mu.Lock()
+	defer proxy.transports.mu.Unlock()
+	if n := len(proxy.transports.entries); n != 2 {
+		t.Errorf("expected a copy of Tr for the host and one for the user, got %d", n)
+	}
+}
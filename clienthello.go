@@ -0,0 +1,370 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ClientHello is the TLS ClientHello a client of a MITM'd connection sent,
+// telling what the client supports. Values in the order the client sent
+// them, GREASE ones (RFC 8701) included.
+type ClientHello struct {
+	// Version is the legacy version field, TLS 1.2 for TLS 1.3 clients
+	Version uint16
+	// SupportedVersions are the versions of the supported_versions
+	// extension, sent by TLS 1.3 clients
+	SupportedVersions []uint16
+	CipherSuites      []uint16
+	// Extensions are the types of the extensions
+	Extensions       []uint16
+	SupportedCurves  []tls.CurveID
+	SupportedPoints  []uint8
+	SignatureSchemes []tls.SignatureScheme
+	ALPNProtocols    []string
+	// ServerName is the SNI, empty if the client sent none
+	ServerName string
+	// Raw is the ClientHello handshake message
+	Raw []byte
+}
+
+// MaxVersion returns the highest TLS version the client supports.
+func (h *ClientHello) MaxVersion() uint16 {
+	max := h.Version
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, its version, cipher
+// suites, extensions, curves and point formats, as the MD5 of the string
+// JA3String returns.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA3String returns the string JA3 hashes.
+func (h *ClientHello) JA3String() string {
+	curves := make([]uint16, len(h.SupportedCurves))
+	for i, c := range h.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(h.SupportedPoints))
+	for i, p := range h.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	fields := []string{strconv.Itoa(int(h.Version))}
+	for _, values := range [][]uint16{h.CipherSuites, h.Extensions, curves, points} {
+		var s []string
+		for _, v := range values {
+			if !isGREASE(v) {
+				s = append(s, strconv.Itoa(int(v)))
+			}
+		}
+		fields = append(fields, strings.Join(s, "-"))
+	}
+	return strings.Join(fields, ",")
+}
+
+var ja4Versions = map[uint16]string{
+	0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3",
+	0xfeff: "d1", 0xfefd: "d2", 0xfefc: "d3",
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, such as
+// "t13d1516h2_8daaf6152771_e5627efa2ab1". Unlike JA3, it does not depend on
+// the order of the cipher suites and extensions, which some clients shuffle.
+func (h *ClientHello) JA4() string {
+	version, ok := ja4Versions[h.MaxVersion()]
+	if !ok {
+		version = "00"
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPNProtocols) > 0 && h.ALPNProtocols[0] != "" {
+		p := h.ALPNProtocols[0]
+		if !isAlnum(p[0]) || !isAlnum(p[len(p)-1]) {
+			p = hex.EncodeToString([]byte(p))
+		}
+		alpn = p[:1] + p[len(p)-1:]
+	}
+
+	ciphers := ja4Values(h.CipherSuites, nil)
+	extensions := ja4Values(h.Extensions, func(v uint16) bool {
+		// counted, but not hashed
+		return v == 0x0000 || v == 0x0010
+	})
+	// the signature algorithms are hashed in their order
+	var algorithms []string
+	for _, s := range h.SignatureSchemes {
+		if !isGREASE(uint16(s)) {
+			algorithms = append(algorithms, fmt.Sprintf("%04x", uint16(s)))
+		}
+	}
+
+	var numExtensions int
+	for _, v := range h.Extensions {
+		if !isGREASE(v) {
+			numExtensions++
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, min99(len(ciphers)), min99(numExtensions), alpn)
+	sort.Strings(ciphers)
+	sort.Strings(extensions)
+	c := strings.Join(extensions, ",")
+	if len(algorithms) > 0 {
+		c += "_" + strings.Join(algorithms, ",")
+	}
+	return a + "_" + ja4Hash(ciphers, strings.Join(ciphers, ",")) + "_" + ja4Hash(extensions, c)
+}
+
+// ja4Values returns the values in hexadecimal, without GREASE and skipped ones
+func ja4Values(values []uint16, skip func(uint16) bool) []string {
+	var s []string
+	for _, v := range values {
+		if !isGREASE(v) && (skip == nil || !skip(v)) {
+			s = append(s, fmt.Sprintf("%04x", v))
+		}
+	}
+	return s
+}
+
+func ja4Hash(values []string, s string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// isGREASE tells whether v is one of the values clients send to keep servers
+// tolerant of unknown ones, see RFC 8701
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+var errBadClientHello = errors.New("malformed TLS ClientHello")
+
+// parseClientHello parses the ClientHello starting the TLS records of data.
+func parseClientHello(data []byte) (*ClientHello, error) {
+	// the message may be split in several records
+	var msg []byte
+	for len(data) >= 5 && data[0] == 22 {
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			break
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+int(msg[1])<<16|int(msg[2])<<8|int(msg[3]) {
+			break
+		}
+	}
+	if len(msg) < 4 || msg[0] != 1 {
+		return nil, errBadClientHello
+	}
+	n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+n {
+		return nil, errBadClientHello
+	}
+	h := &ClientHello{Raw: msg[:4+n]}
+
+	r := helloReader(msg[4 : 4+n])
+	var sessionID, ciphers, compression, extensions helloReader
+	if !r.uint16(&h.Version) || !r.skip(32) || !r.prefixed(1, &sessionID) || !r.prefixed(2, &ciphers) ||
+		!r.prefixed(1, &compression) {
+		return nil, errBadClientHello
+	}
+	for len(ciphers) > 0 {
+		var c uint16
+		if !ciphers.uint16(&c) {
+			return nil, errBadClientHello
+		}
+		h.CipherSuites = append(h.CipherSuites, c)
+	}
+	if len(r) == 0 {
+		// no extensions
+		return h, nil
+	}
+	if !r.prefixed(2, &extensions) {
+		return nil, errBadClientHello
+	}
+	for len(extensions) > 0 {
+		var typ uint16
+		var ext helloReader
+		if !extensions.uint16(&typ) || !extensions.prefixed(2, &ext) {
+			return nil, errBadClientHello
+		}
+		h.Extensions = append(h.Extensions, typ)
+		if err := h.parseExtension(typ, ext); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *ClientHello) parseExtension(typ uint16, ext helloReader) error {
+	var list helloReader
+	switch typ {
+	case 0: // server_name
+		if !ext.prefixed(2, &list) {
+			return errBadClientHello
+		}
+		for len(list) > 0 {
+			var nameType helloReader
+			var name helloReader
+			if !list.bytes(1, &nameType) || !list.prefixed(2, &name) {
+				return errBadClientHello
+			}
+			if nameType[0] == 0 {
+				h.ServerName = string(name)
+			}
+		}
+	case 10: // supported_groups
+		if !ext.prefixed(2, &list) {
+			return errBadClientHello
+		}
+		for len(list) > 0 {
+			var v uint16
+			if !list.uint16(&v) {
+				return errBadClientHello
+			}
+			h.SupportedCurves = append(h.SupportedCurves, tls.CurveID(v))
+		}
+	case 11: // ec_point_formats
+		if !ext.prefixed(1, &list) {
+			return errBadClientHello
+		}
+		h.SupportedPoints = append([]uint8(nil), list...)
+	case 13: // signature_algorithms
+		if !ext.prefixed(2, &list) {
+			return errBadClientHello
+		}
+		for len(list) > 0 {
+			var v uint16
+			if !list.uint16(&v) {
+				return errBadClientHello
+			}
+			h.SignatureSchemes = append(h.SignatureSchemes, tls.SignatureScheme(v))
+		}
+	case 16: // application_layer_protocol_negotiation
+		if !ext.prefixed(2, &list) {
+			return errBadClientHello
+		}
+		for len(list) > 0 {
+			var proto helloReader
+			if !list.prefixed(1, &proto) {
+				return errBadClientHello
+			}
+			h.ALPNProtocols = append(h.ALPNProtocols, string(proto))
+		}
+	case 43: // supported_versions
+		if !ext.prefixed(1, &list) {
+			return errBadClientHello
+		}
+		for len(list) > 0 {
+			var v uint16
+			if !list.uint16(&v) {
+				return errBadClientHello
+			}
+			h.SupportedVersions = append(h.SupportedVersions, v)
+		}
+	}
+	return nil
+}
+
+// helloReader reads the fields of a ClientHello, advancing over them
+type helloReader []byte
+
+func (r *helloReader) bytes(n int, out *helloReader) bool {
+	if len(*r) < n {
+		return false
+	}
+	*out, *r = (*r)[:n], (*r)[n:]
+	return true
+}
+
+func (r *helloReader) skip(n int) bool {
+	var discard helloReader
+	return r.bytes(n, &discard)
+}
+
+func (r *helloReader) uint16(out *uint16) bool {
+	var b helloReader
+	if !r.bytes(2, &b) {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(b)
+	return true
+}
+
+// prefixed reads a field prefixed by its length, on size bytes
+func (r *helloReader) prefixed(size int, out *helloReader) bool {
+	var b helloReader
+	if !r.bytes(size, &b) {
+		return false
+	}
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return r.bytes(n, out)
+}
+
+// helloConn records what the client sends until the ClientHello is read
+type helloConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+	// stop is set once the handshake is over
+	stop bool
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	// a ClientHello fits in a few records, stop at 64KiB if it's not one
+	if !c.stop && c.buf.Len() < 1<<16 {
+		c.buf.Write(b[:n])
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// clientHello returns the ClientHello read, and stops recording
+func (c *helloConn) clientHello() (*ClientHello, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop = true
+	h, err := parseClientHello(c.buf.Bytes())
+	c.buf = bytes.Buffer{}
+	return h, err
+}
@@ -0,0 +1,85 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientHelloFingerprints(t *testing.T) {
+	h := &ClientHello{
+		Version:           0x0303,
+		SupportedVersions: []uint16{0x1a1a, 0x0304, 0x0303},
+		CipherSuites:      []uint16{0x0a0a, 0x1301, 0x1302, 0xc02b},
+		Extensions:        []uint16{0x2a2a, 0x0000, 0x0010, 0x000a, 0x000b, 0x000d, 0x002b},
+		SupportedCurves:   []tls.CurveID{0x001d, 0x0017},
+		SupportedPoints:   []uint8{0},
+		SignatureSchemes:  []tls.SignatureScheme{0x0403, 0x0804},
+		ALPNProtocols:     []string{"h2", "http/1.1"},
+		ServerName:        "example.com",
+	}
+	if s := h.JA3String(); s != "771,4865-4866-49195,0-16-10-11-13-43,29-23,0" {
+		t.Errorf("unexpected JA3 string %s", s)
+	}
+	if ja3 := h.JA3(); ja3 != "3736761f91e3f9597a641ce4c92f256c" {
+		t.Errorf("unexpected JA3 %s", ja3)
+	}
+	if ja4 := h.JA4(); ja4 != "t13d0306h2_5559582ccdc4_fb71836bce29" {
+		t.Errorf("unexpected JA4 %s", ja4)
+	}
+}
+
+func TestTLSInfo(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	var hello *ClientHello
+	var upstream *tls.ConnectionState
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		hello, upstream = ctx.ClientHello, ctx.UpstreamTLS
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.com",
+		NextProtos:         []string{"http/1.1"},
+	}}
+	defer tr.CloseIdleConnections()
+	resp, err := tr.RoundTrip(newCondRequest("GET", backend.URL, ""))
+	orFatal("RoundTrip", err, t)
+	resp.Body.Close()
+
+	if hello == nil {
+		t.Fatal("no ClientHello")
+	}
+	if hello.ServerName != "example.com" || len(hello.ALPNProtocols) != 1 || hello.ALPNProtocols[0] != "http/1.1" ||
+		hello.MaxVersion() != tls.VersionTLS13 {
+		t.Errorf("unexpected ClientHello %+v", hello)
+	}
+	if ja4 := hello.JA4(); !strings.HasPrefix(ja4, "t13d") || ja4[8:10] != "h1" {
+		t.Errorf("unexpected JA4 %s", ja4)
+	}
+	again, err := parseClientHello(append([]byte{22, 3, 1, byte(len(hello.Raw) >> 8), byte(len(hello.Raw))}, hello.Raw...))
+	orFatal("parseClientHello", err, t)
+	if again.JA3() != hello.JA3() {
+		t.Errorf("JA3 changed when parsing the message again")
+	}
+
+	if upstream == nil {
+		t.Fatal("no upstream TLS state")
+	}
+	if upstream.Version < tls.VersionTLS12 || len(upstream.PeerCertificates) == 0 ||
+		!upstream.PeerCertificates[0].Equal(backend.Certificate()) {
+		t.Errorf("unexpected upstream TLS state %+v", upstream)
+	}
+}
@@ -0,0 +1,545 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParseReqCondition compiles a condition expression to a ReqCondition, for example
+//
+//	host ~ "*.corp" && method in ["POST", "PUT"] && !src in 10.0.0.0/8
+//
+// Expressions combine predicates with && (binds tighter), || and !, and
+// parentheses. A predicate compares a field of the request with a value:
+//
+//	host              destination host, without the port
+//	method            request method
+//	path              URL path
+//	url               full URL
+//	scheme            URL scheme
+//	port              destination port, defaulting to the port of the scheme
+//	src               IP address of the client
+//	dst               IP addresses the destination host resolves to
+//	header["Name"]    value of a request header
+//
+// with the operators
+//
+//	==, !=            equality
+//	~                 glob match, where * matches any run of characters and ? a single one
+//	=~                regular expression match
+//	in [v1, v2, ...]  equal to one of the values
+//	in 10.0.0.0/8     for src and dst, address in the subnet (a list of subnets works too)
+//
+// Values are double quoted Go strings, numbers, or IP addresses and subnets
+// which may be left unquoted. Host globs are case insensitive.
+// Syntax errors are reported as a *ConditionSyntaxError.
+func ParseReqCondition(expr string) (ReqCondition, error) {
+	n, err := parseCondition(expr, false)
+	if err != nil {
+		return nil, err
+	}
+	return n.req(), nil
+}
+
+// ParseRespCondition compiles a condition expression to a RespCondition. On top
+// of the request fields of ParseReqCondition, it understands
+//
+//	status            response status code
+//	content_type      media type of the response, without parameters
+//	resp_header["Name"] value of a response header
+//
+// Response fields never match when there is no response.
+func ParseRespCondition(expr string) (RespCondition, error) {
+	n, err := parseCondition(expr, true)
+	if err != nil {
+		return nil, err
+	}
+	return n.resp(), nil
+}
+
+// MustParseReqCondition is like ParseReqCondition but panics if the expression
+// cannot be parsed. It simplifies safe initialization of global conditions.
+func MustParseReqCondition(expr string) ReqCondition {
+	c, err := ParseReqCondition(expr)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// MustParseRespCondition is like ParseRespCondition but panics if the
+// expression cannot be parsed.
+func MustParseRespCondition(expr string) RespCondition {
+	c, err := ParseRespCondition(expr)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// ConditionSyntaxError is returned for malformed condition expressions. Pos is
+// the byte offset in Expr where the problem is.
+type ConditionSyntaxError struct {
+	Expr string
+	Pos  int
+	Msg  string
+}
+
+func (e *ConditionSyntaxError) Error() string {
+	return fmt.Sprintf("condition: %s at position %d\n\t%s\n\t%s^", e.Msg, e.Pos+1, e.Expr, strings.Repeat(" ", e.Pos))
+}
+
+type condTokenKind int
+
+const (
+	condEOF condTokenKind = iota
+	condWord
+	condString
+	condOp
+)
+
+type condToken struct {
+	kind condTokenKind
+	text string // for strings, the unquoted value
+	pos  int
+}
+
+func (t condToken) describe() string {
+	switch t.kind {
+	case condEOF:
+		return "end of expression"
+	case condString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+var condOps = []string{"&&", "||", "==", "!=", "=~", "!", "~", "(", ")", "[", "]", ","}
+
+func lexCondition(expr string) ([]condToken, error) {
+	var toks []condToken
+	i := 0
+next:
+	for i < len(expr) {
+		c := expr[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			i++
+			continue
+		}
+		if c == '"' {
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, &ConditionSyntaxError{expr, i, "unterminated string"}
+			}
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return nil, &ConditionSyntaxError{expr, i, "invalid string"}
+			}
+			toks = append(toks, condToken{condString, s, i})
+			i = j + 1
+			continue
+		}
+		for _, op := range condOps {
+			if strings.HasPrefix(expr[i:], op) {
+				toks = append(toks, condToken{condOp, op, i})
+				i += len(op)
+				continue next
+			}
+		}
+		j := i
+		for j < len(expr) && !strings.ContainsRune(" \t\r\n\"&|=!~()[],", rune(expr[j])) {
+			j++
+		}
+		if j == i {
+			return nil, &ConditionSyntaxError{expr, i, fmt.Sprintf("unexpected character %q", c)}
+		}
+		toks = append(toks, condToken{condWord, expr[i:j], i})
+		i = j
+	}
+	return append(toks, condToken{condEOF, "", len(expr)}), nil
+}
+
+// condNode is a compiled subexpression, usable both as a request and a
+// response condition.
+type condNode struct {
+	req  func() ReqCondition
+	resp func() RespCondition
+}
+
+func predicateNode(c ReqConditionFunc) *condNode {
+	return &condNode{
+		req:  func() ReqCondition { return c },
+		resp: func() RespCondition { return c },
+	}
+}
+
+func respPredicateNode(c RespConditionFunc) *condNode {
+	return &condNode{resp: func() RespCondition { return c }}
+}
+
+type condParser struct {
+	expr     string
+	toks     []condToken
+	pos      int
+	respMode bool
+}
+
+func parseCondition(expr string, respMode bool) (*condNode, error) {
+	toks, err := lexCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{expr: expr, toks: toks, respMode: respMode}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != condEOF {
+		return nil, p.errorf(t, "unexpected %s", t.describe())
+	}
+	return n, nil
+}
+
+func (p *condParser) peek() condToken { return p.toks[p.pos] }
+
+func (p *condParser) next() condToken {
+	t := p.toks[p.pos]
+	if t.kind != condEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *condParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == condOp && t.text == op
+}
+
+func (p *condParser) errorf(t condToken, format string, args ...interface{}) error {
+	return &ConditionSyntaxError{p.expr, t.pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *condParser) expectOp(op string) error {
+	if t := p.next(); t.kind != condOp || t.text != op {
+		return p.errorf(t, "expected '%s', found %s", op, t.describe())
+	}
+	return nil
+}
+
+func (p *condParser) parseOr() (*condNode, error) {
+	var nodes []*condNode
+	for {
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+		if !p.isOp("||") {
+			break
+		}
+		p.next()
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return &condNode{
+		req: func() ReqCondition {
+			conds := make([]ReqCondition, len(nodes))
+			for i, n := range nodes {
+				conds[i] = n.req()
+			}
+			return Or(conds...)
+		},
+		resp: func() RespCondition {
+			conds := make([]RespCondition, len(nodes))
+			for i, n := range nodes {
+				conds[i] = n.resp()
+			}
+			return RespOr(conds...)
+		},
+	}, nil
+}
+
+func (p *condParser) parseAnd() (*condNode, error) {
+	var nodes []*condNode
+	for {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+		if !p.isOp("&&") {
+			break
+		}
+		p.next()
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return &condNode{
+		req: func() ReqCondition {
+			conds := make([]ReqCondition, len(nodes))
+			for i, n := range nodes {
+				conds[i] = n.req()
+			}
+			return And(conds...)
+		},
+		resp: func() RespCondition {
+			conds := make([]RespCondition, len(nodes))
+			for i, n := range nodes {
+				conds[i] = n.resp()
+			}
+			return RespAnd(conds...)
+		},
+	}, nil
+}
+
+func (p *condParser) parseUnary() (*condNode, error) {
+	if p.isOp("!") {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &condNode{
+			req:  func() ReqCondition { return Not(n.req()) },
+			resp: func() RespCondition { return RespNot(n.resp()) },
+		}, nil
+	}
+	if p.isOp("(") {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return p.parsePredicate()
+}
+
+// condValue is a literal on the right hand side of a predicate
+type condValue struct {
+	tok condToken
+}
+
+func (p *condParser) parseValue() (condValue, error) {
+	t := p.next()
+	if t.kind != condString && t.kind != condWord {
+		return condValue{}, p.errorf(t, "expected a value, found %s", t.describe())
+	}
+	return condValue{t}, nil
+}
+
+func (p *condParser) parseValues() ([]condValue, error) {
+	if !p.isOp("[") {
+		v, err := p.parseValue()
+		return []condValue{v}, err
+	}
+	p.next()
+	var vals []condValue
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+		if p.isOp("]") {
+			p.next()
+			return vals, nil
+		}
+		if err := p.expectOp(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// condField extracts the value a predicate tests, req for request fields and
+// resp for response fields. Addresses are compared by addressPredicate instead.
+type condField struct {
+	name string
+	req  func(req *http.Request) string
+	resp func(resp *http.Response) string
+}
+
+func (p *condParser) parseField() (*condField, error) {
+	t := p.next()
+	if t.kind != condWord {
+		return nil, p.errorf(t, "expected a field name, found %s", t.describe())
+	}
+	f := &condField{name: t.text}
+	switch t.text {
+	case "host":
+		f.req = requestHostname
+	case "method":
+		f.req = func(req *http.Request) string { return req.Method }
+	case "path":
+		f.req = func(req *http.Request) string { return req.URL.Path }
+	case "url":
+		f.req = func(req *http.Request) string { return req.URL.String() }
+	case "scheme":
+		f.req = func(req *http.Request) string { return req.URL.Scheme }
+	case "port":
+		f.req = func(req *http.Request) string { return strconv.Itoa(requestPort(req)) }
+	case "src", "dst":
+		// compared as addresses, see addressPredicate
+	case "header", "resp_header":
+		if t.text == "resp_header" && !p.respMode {
+			return nil, p.errorf(t, "%s is only available in response conditions", t.text)
+		}
+		if err := p.expectOp("["); err != nil {
+			return nil, err
+		}
+		name := p.next()
+		if name.kind != condString {
+			return nil, p.errorf(name, "expected a quoted header name, found %s", name.describe())
+		}
+		if err := p.expectOp("]"); err != nil {
+			return nil, err
+		}
+		if t.text == "header" {
+			f.req = func(req *http.Request) string { return req.Header.Get(name.text) }
+		} else {
+			f.resp = func(resp *http.Response) string { return resp.Header.Get(name.text) }
+		}
+		f.name = t.text + "[" + strconv.Quote(name.text) + "]"
+	case "status", "content_type":
+		if !p.respMode {
+			return nil, p.errorf(t, "%s is only available in response conditions", t.text)
+		}
+		if t.text == "status" {
+			f.resp = func(resp *http.Response) string { return strconv.Itoa(resp.StatusCode) }
+		} else {
+			f.resp = func(resp *http.Response) string {
+				ct := resp.Header.Get("Content-Type")
+				if i := strings.IndexByte(ct, ';'); i >= 0 {
+					ct = ct[:i]
+				}
+				return strings.ToLower(strings.TrimSpace(ct))
+			}
+		}
+	default:
+		return nil, p.errorf(t, "unknown field %q", t.text)
+	}
+	return f, nil
+}
+
+func (p *condParser) parsePredicate() (*condNode, error) {
+	f, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+	opTok := p.next()
+	var op string
+	switch {
+	case opTok.kind == condOp && (opTok.text == "==" || opTok.text == "!=" || opTok.text == "~" || opTok.text == "=~"):
+		op = opTok.text
+	case opTok.kind == condWord && opTok.text == "in":
+		op = "in"
+	default:
+		return nil, p.errorf(opTok, "expected an operator after %s, found %s", f.name, opTok.describe())
+	}
+	var vals []condValue
+	if op == "in" {
+		vals, err = p.parseValues()
+	} else {
+		var v condValue
+		v, err = p.parseValue()
+		vals = []condValue{v}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.name == "src" || f.name == "dst" {
+		return p.addressPredicate(f, opTok, vals)
+	}
+
+	var match func(s string) bool
+	switch op {
+	case "==", "!=", "in":
+		set := make(map[string]bool)
+		for _, v := range vals {
+			set[v.tok.text] = true
+		}
+		match = func(s string) bool { return set[s] }
+		if op == "!=" {
+			match = func(s string) bool { return !set[s] }
+		}
+	case "~":
+		re, err := regexp.Compile(globToRegexp(vals[0].tok.text, f.name == "host"))
+		if err != nil {
+			return nil, p.errorf(vals[0].tok, "invalid glob: %v", err)
+		}
+		match = re.MatchString
+	case "=~":
+		re, err := regexp.Compile(vals[0].tok.text)
+		if err != nil {
+			return nil, p.errorf(vals[0].tok, "invalid regular expression: %v", err)
+		}
+		match = re.MatchString
+	}
+	if f.resp == nil {
+		return predicateNode(func(req *http.Request, ctx *ProxyCtx) bool {
+			return match(f.req(req))
+		}), nil
+	}
+	return respPredicateNode(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && match(f.resp(resp))
+	}), nil
+}
+
+// addressPredicate compiles predicates on src and dst, which compare
+// addresses rather than strings
+func (p *condParser) addressPredicate(f *condField, opTok condToken, vals []condValue) (*condNode, error) {
+	if opTok.text == "~" || opTok.text == "=~" {
+		return nil, p.errorf(opTok, "operator '%s' is not supported for %s", opTok.text, f.name)
+	}
+	cidrs := make([]string, len(vals))
+	for i, v := range vals {
+		if _, err := parseIPNet(v.tok.text); err != nil {
+			return nil, p.errorf(v.tok, "invalid IP address or subnet %q", v.tok.text)
+		}
+		cidrs[i] = v.tok.text
+	}
+	var c ReqConditionFunc
+	if f.name == "src" {
+		c = SrcIpIn(cidrs...)
+	} else {
+		c = DstIpIn(cidrs...)
+	}
+	if opTok.text == "!=" {
+		c = Not(c)
+	}
+	return predicateNode(c), nil
+}
+
+func globToRegexp(glob string, foldCase bool) string {
+	var b strings.Builder
+	if foldCase {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,94 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newCondRequest(method, rawurl, remoteAddr string) *http.Request {
+	req, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		panic(err)
+	}
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Team", "infra")
+	return req
+}
+
+func TestParseReqCondition(t *testing.T) {
+	post := newCondRequest("POST", "http://build.corp:8080/deploy", "192.168.1.5:1234")
+	get := newCondRequest("GET", "http://www.example.com/", "10.1.2.3:1234")
+	v6 := newCondRequest("PUT", "http://[::1]/x", "[2001:db8::1]:1234")
+	tests := []struct {
+		expr string
+		req  *http.Request
+		want bool
+	}{
+		{`host ~ "*.corp" && method in ["POST","PUT"] && !src in 10.0.0.0/8`, post, true},
+		{`host ~ "*.corp" && method in ["POST","PUT"] && !src in 10.0.0.0/8`, get, false},
+		{`host ~ "*.CORP"`, post, true},
+		{`host == "www.example.com" || host == "other"`, get, true},
+		{`!(host == "www.example.com" || host == "other")`, get, false},
+		{`src in [10.0.0.0/8, 192.168.0.0/16]`, get, true},
+		{`src == 10.1.2.3`, get, true},
+		{`src in 2001:db8::/32`, v6, true},
+		{`src in 2001:db8::/32`, get, false},
+		{`host == "::1" && method != "GET"`, v6, true},
+		{`path =~ "^/dep" && header["X-Team"] == "infra"`, post, true},
+		{`scheme == "http" && url ~ "*:8080/*"`, post, true},
+		{`host == "a" || host == "b" && method == "GET"`, get, false},
+	}
+	for _, tc := range tests {
+		c, err := ParseReqCondition(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := c.HandleReq(tc.req, nil); got != tc.want {
+			t.Errorf("%s on %s %s: expected %v", tc.expr, tc.req.Method, tc.req.URL, tc.want)
+		}
+	}
+}
+
+func TestParseRespCondition(t *testing.T) {
+	req := newCondRequest("GET", "http://www.example.com/", "10.1.2.3:1234")
+	ctx := &ProxyCtx{Req: req}
+	resp := &http.Response{StatusCode: 502, Header: http.Header{"Content-Type": []string{"text/html; charset=utf-8"}}}
+	c := MustParseRespCondition(`status in [500, 502, 503] && content_type == "text/html" && host ~ "*.example.com"`)
+	if !c.HandleResp(resp, ctx) {
+		t.Error("response condition should match")
+	}
+	if c.HandleResp(nil, ctx) {
+		t.Error("response condition should not match without a response")
+	}
+}
+
+func TestConditionSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{`host = "x"`, 5, "unexpected character"},
+		{`host == "x" &&`, 14, "expected a field name"},
+		{`hots == "x"`, 0, "unknown field"},
+		{`host == "x" && (method == "GET"`, 31, "expected ')'"},
+		{`src in 10.0.0.0/33`, 7, "invalid IP address or subnet"},
+		{`method in ["GET" "POST"]`, 17, "expected ','"},
+		{`host == "x`, 8, "unterminated string"},
+		{`status == 200`, 0, "only available in response conditions"},
+		{`host ~~ "x"`, 6, "expected a value"},
+	}
+	for _, tc := range tests {
+		_, err := ParseReqCondition(tc.expr)
+		serr, ok := err.(*ConditionSyntaxError)
+		if !ok {
+			t.Errorf("%s: expected a syntax error, got %v", tc.expr, err)
+			continue
+		}
+		if serr.Pos != tc.pos || !strings.Contains(serr.Msg, tc.msg) {
+			t.Errorf("%s: expected %q at %d, got %q at %d", tc.expr, tc.msg, tc.pos, serr.Msg, serr.Pos)
+		}
+	}
+}
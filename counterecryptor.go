@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -17,6 +18,12 @@ type CounterEncryptorRand struct {
 	ix      int
 }
 
+// NewCounterEncryptorRandFromKey returns a deterministic random number
+// generator keyed by the bytes of the private key key, and seeded by seed.
+//
+// Deprecated: a generator keyed by the private key of a CA leaks bits of the
+// key through what it generates, and requires the key in memory. Use
+// NewCounterEncryptorRand with a secret of its own.
 func NewCounterEncryptorRandFromKey(key interface{}, seed []byte) (r CounterEncryptorRand, err error) {
 	var keyBytes []byte
 	switch key := key.(type) {
@@ -26,8 +33,10 @@ func NewCounterEncryptorRandFromKey(key interface{}, seed []byte) (r CounterEncr
 		if keyBytes, err = x509.MarshalECPrivateKey(key); err != nil {
 			return
 		}
+	case ed25519.PrivateKey:
+		keyBytes = key.Seed()
 	default:
-		err = errors.New("only RSA and ECDSA keys supported")
+		err = errors.New("only RSA, ECDSA and Ed25519 keys supported")
 		return
 	}
 	h := sha256.New()
@@ -43,6 +52,24 @@ func NewCounterEncryptorRandFromKey(key interface{}, seed []byte) (r CounterEncr
 	return
 }
 
+// NewCounterEncryptorRand returns a deterministic random number generator
+// keyed by secret and seeded by seed: generators with the same secret and
+// seed generate the same bytes.
+func NewCounterEncryptorRand(secret, seed []byte) (r CounterEncryptorRand, err error) {
+	key := sha256.Sum256(secret)
+	if r.cipher, err = aes.NewCipher(key[:aes.BlockSize]); err != nil {
+		return
+	}
+	r.counter = make([]byte, r.cipher.BlockSize())
+	if seed != nil {
+		sum := sha256.Sum256(seed)
+		copy(r.counter, sum[:r.cipher.BlockSize()])
+	}
+	r.rand = make([]byte, r.cipher.BlockSize())
+	r.ix = len(r.rand)
+	return
+}
+
 func (c *CounterEncryptorRand) Seed(b []byte) {
 	if len(b) != len(c.counter) {
 		panic("SetCounter: wrong counter size")
@@ -98,3 +98,23 @@ func TestCounterEncStreamHistogram(t *testing.T) {
 		t.Errorf("stddev of ref histogram different than regular PRNG: %v %v", refstddev, stddev)
 	}
 }
+
+func TestCounterEncSecret(t *testing.T) {
+	seed := []byte("the quick brown fox run over the lazy dog")
+	c1, err := goproxy.NewCounterEncryptorRand([]byte("secret"), seed)
+	fatalOnErr(err, "NewCounterEncryptorRand", t)
+	c2, err := goproxy.NewCounterEncryptorRand([]byte("secret"), seed)
+	fatalOnErr(err, "NewCounterEncryptorRand", t)
+	c3, err := goproxy.NewCounterEncryptorRand([]byte("other secret"), seed)
+	fatalOnErr(err, "NewCounterEncryptorRand", t)
+	out1, out2, out3 := make([]byte, 1000), make([]byte, 1000), make([]byte, 1000)
+	io.ReadFull(&c1, out1)
+	io.ReadFull(&c2, out2)
+	io.ReadFull(&c3, out3)
+	if !bytes.Equal(out1, out2) {
+		t.Error("expected the same secret and seed to give the same stream")
+	}
+	if bytes.Equal(out1, out3) {
+		t.Error("expected a different secret to give a different stream")
+	}
+}
@@ -2,6 +2,8 @@ package goproxy
 
 import (
 	"crypto/tls"
+	"io"
+	"net"
 	"net/http"
 	"regexp"
 )
@@ -23,6 +25,40 @@ type ProxyCtx struct {
 	Session   int64
 	certStore CertStorage
 	Proxy     *ProxyHttpServer
+	// Resolver, if not nil, resolves the remote host of this request instead
+	// of the proxy's Resolver. It must be comparable, such as a pointer: the
+	// requests with the same Resolver share their connections.
+	Resolver Resolver
+	// ResolvedIPs are the addresses the remote host resolved to, set when the
+	// proxy dials a new connection for the request
+	ResolvedIPs []net.IP
+	// SourceIP and SourceInterface, if set, override those of the proxy's
+	// Dialer for the connections of this request
+	SourceIP        net.IP
+	SourceInterface string
+	// Timings of the steps of the request, see Timings
+	Timings Timings
+	// User is the name of the client, when the proxy authenticated it, as
+	// ext/auth does. ClientCerts selects certificates by it.
+	User string
+	// UpstreamTLS is the state of the TLS connection to the remote host the
+	// response came through: its version, cipher suite, ALPN protocol,
+	// certificate chain, OCSP staple and server name. It is nil until the
+	// response is received, and for plain HTTP.
+	UpstreamTLS *tls.ConnectionState
+	// ClientHello is the TLS ClientHello the client of a MITM'd connection
+	// sent, with its JA3 and JA4 fingerprints
+	ClientHello *ClientHello
+	// WrapUpgraded, if set by the handlers of an upgrade request, wraps the
+	// stream the remote server sends once the connection is upgraded, as
+	// ext/chaos does to break the frames of websockets
+	WrapUpgraded func(r io.Reader) io.Reader
+	// clientCert is the certificate presented to the remote host, see
+	// ProxyHttpServer.ClientCerts
+	clientCert *tls.Certificate
+	// keyLogged is set when the secrets of the connection to the remote
+	// host are written to the KeyLog of the proxy
+	keyLogged bool
 }
 
 type RoundTripper interface {
@@ -40,10 +76,25 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 }
 
 func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := ctx.roundTrip(req)
+	if resp != nil {
+		ctx.UpstreamTLS = resp.TLS
+	}
+	return resp, err
+}
+
+func (ctx *ProxyCtx) roundTrip(req *http.Request) (*http.Response, error) {
+	c, trace := ctx.withRequestTrace(req.Context())
+	defer trace.save(ctx)
+	req = req.WithContext(c)
 	if ctx.RoundTripper != nil {
 		return ctx.RoundTripper.RoundTrip(req, ctx)
 	}
-	return ctx.Proxy.Tr.RoundTrip(req)
+	tr, err := ctx.Proxy.transport(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.RoundTrip(req)
 }
 
 func (ctx *ProxyCtx) printf(msg string, argv ...interface{}) {
@@ -0,0 +1,476 @@
+package goproxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IPMode selects the address families a Dialer connects with.
+type IPMode int
+
+const (
+	// PreferIPv6 tries IPv6 and IPv4 addresses alternately, IPv6 first, as
+	// RFC 8305 recommends
+	PreferIPv6 IPMode = iota
+	// PreferIPv4 tries IPv4 and IPv6 addresses alternately, IPv4 first
+	PreferIPv4
+	// IPv4Only never connects over IPv6
+	IPv4Only
+	// IPv6Only never connects over IPv4
+	IPv6Only
+)
+
+// ContextDialer makes network connections. *net.Dialer and *Dialer
+// implement it.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dialer makes the connections of the proxy to remote hosts. When a host has
+// several addresses it races them as described by RFC 8305 (Happy Eyeballs):
+// a new attempt starts every FallbackDelay, or as soon as the previous one
+// failed, and the first connection established wins.
+//
+// The local address of the connections can be chosen for all of them with
+// SourceIP and SourceInterface, or per request by setting the fields of the
+// same name of ProxyCtx in a handler:
+//
+//	proxy.Dialer = &goproxy.Dialer{Mode: goproxy.PreferIPv4, FallbackDelay: 100 * time.Millisecond}
+//	proxy.OnRequest(goproxy.ReqHeaderMatches("X-Customer", regexp.MustCompile("^acme$"))).DoFunc(
+//		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//			ctx.SourceIP = net.ParseIP("203.0.113.7")
+//			return r, nil
+//		})
+type Dialer struct {
+	Mode IPMode
+	// FallbackDelay is how long an attempt runs alone before the next one
+	// starts, the "Connection Attempt Delay" of RFC 8305. 250ms if zero.
+	FallbackDelay time.Duration
+	// Timeout bounds each connection attempt, no limit if zero.
+	Timeout time.Duration
+	// KeepAlive is the TCP keep-alive period, see net.Dialer.
+	KeepAlive time.Duration
+	// SourceIP, if set, is the local address of the connections. Only the
+	// addresses of the remote host of the same family are tried.
+	SourceIP net.IP
+	// SourceInterface, if set, is the name of the network interface whose
+	// addresses are used as local addresses.
+	SourceInterface string
+
+	// dial replaces net.Dialer in tests
+	dial func(ctx context.Context, network, addr string, source net.IP) (net.Conn, error)
+}
+
+var defaultDialer = &Dialer{}
+
+// DialContext resolves the host of addr and races its addresses. The resolver
+// and source address of the ProxyCtx stored in c by the proxy are used, if
+// there is one, and the addresses are recorded in its ResolvedIPs, once the
+// request uses the connection.
+func (d *Dialer) DialContext(c context.Context, network, addr string) (net.Conn, error) {
+	ctx := proxyCtxFrom(c)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// resolvers other than net.Resolver don't report to the trace
+	trace := httptrace.ContextClientTrace(c)
+	if trace == nil || net.ParseIP(host) != nil {
+		trace = &httptrace.ClientTrace{}
+	}
+	if trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, err := ctx.lookupIP(c, host)
+	if trace.DNSDone != nil {
+		trace.DNSDone(httptrace.DNSDoneInfo{Err: err})
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the transport dials in goroutines of its own, the addresses are
+	// saved by the request if it uses the connection
+	rt := requestTraceFrom(c)
+	if rt == nil && ctx != nil {
+		ctx.ResolvedIPs = ips
+	}
+
+	sourceIP, sourceInterface := d.SourceIP, d.SourceInterface
+	if ctx != nil && (ctx.SourceIP != nil || ctx.SourceInterface != "") {
+		sourceIP, sourceInterface = ctx.SourceIP, ctx.SourceInterface
+	}
+	var source4, source6 net.IP
+	switch {
+	case sourceIP != nil:
+		if sourceIP.To4() != nil {
+			source4 = sourceIP
+		} else {
+			source6 = sourceIP
+		}
+	case sourceInterface != "":
+		if source4, source6, err = interfaceIPs(sourceInterface); err != nil {
+			return nil, err
+		}
+	}
+	hasSource := sourceIP != nil || sourceInterface != ""
+
+	var attempts []dialAttempt
+	for _, ip := range d.sortIPs(ips) {
+		source := source6
+		if ip.To4() != nil {
+			source = source4
+		}
+		if hasSource && source == nil {
+			// cannot reach this address from the chosen source
+			continue
+		}
+		attempts = append(attempts, dialAttempt{net.JoinHostPort(ip.String(), port), source})
+	}
+	if len(attempts) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address", Addr: host}
+	}
+	conn, err := d.race(c, network, attempts)
+	if err == nil && rt != nil {
+		rt.dial(conn, ips)
+	}
+	return conn, err
+}
+
+type dialAttempt struct {
+	addr   string
+	source net.IP
+}
+
+// sortIPs orders ips according to the mode of d, dropping those of the
+// families it doesn't use
+func (d *Dialer) sortIPs(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch d.Mode {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv4:
+		return interleaveIPs(v4, v6)
+	}
+	return interleaveIPs(v6, v4)
+}
+
+func interleaveIPs(first, second []net.IP) []net.IP {
+	ips := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ips = append(ips, first[i])
+		}
+		if i < len(second) {
+			ips = append(ips, second[i])
+		}
+	}
+	return ips
+}
+
+// interfaceIPs returns the first IPv4 and IPv6 addresses of the named
+// interface, preferring global addresses
+func interfaceIPs(name string) (v4, v6 net.IP, err error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil || (v6.IsLinkLocalUnicast() && !ip.IsLinkLocalUnicast()) {
+			v6 = ip
+		}
+	}
+	if v4 == nil && v6 == nil {
+		return nil, nil, errors.New("goproxy: interface " + name + " has no address")
+	}
+	if v6 != nil && v6.IsLinkLocalUnicast() {
+		// link local addresses cannot reach remote hosts
+		v6 = nil
+	}
+	return v4, v6, nil
+}
+
+func (d *Dialer) dialOne(c context.Context, network, addr string, source net.IP) (net.Conn, error) {
+	if d.dial != nil {
+		return d.dial(c, network, addr, source)
+	}
+	nd := net.Dialer{Timeout: d.Timeout, KeepAlive: d.KeepAlive}
+	if source != nil {
+		if strings.HasPrefix(network, "udp") {
+			nd.LocalAddr = &net.UDPAddr{IP: source}
+		} else {
+			nd.LocalAddr = &net.TCPAddr{IP: source}
+		}
+	}
+	return nd.DialContext(c, network, addr)
+}
+
+// race runs the attempts as described by RFC 8305, returning the first
+// connection established or the first error if they all fail
+func (d *Dialer) race(c context.Context, network string, attempts []dialAttempt) (net.Conn, error) {
+	if len(attempts) == 1 {
+		return d.dialOne(c, network, attempts[0].addr, attempts[0].source)
+	}
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = 250 * time.Millisecond
+	}
+	c, cancel := context.WithCancel(c)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(attempts))
+	next, running := 0, 0
+	start := func() {
+		a := attempts[next]
+		next++
+		running++
+		go func() {
+			conn, err := d.dialOne(c, network, a.addr, a.source)
+			results <- result{conn, err}
+		}()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	restartTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+
+	var firstErr error
+	start()
+	for {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// close the connections of the attempts still running if
+				// they succeed anyway
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(running)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(attempts) {
+				start()
+				restartTimer()
+			} else if running == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if next < len(attempts) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+}
+
+// DialContext connects to addr with the Dialer of the proxy, resolving its
+// host with the Resolver of the request. See Dialer.DialContext.
+//
+// NewProxyHttpServer sets it as the DialContext of Tr. When replacing Tr or
+// setting Transport, dial with it too so that plain HTTP requests use the
+// resolver and the dialer of the proxy. The Dial of Tr, if set, is used
+// instead, as for CONNECT requests: http.Transport would ignore it.
+func (proxy *ProxyHttpServer) DialContext(c context.Context, network, addr string) (net.Conn, error) {
+	if proxy.Tr != nil && proxy.Tr.Dial != nil {
+		return proxy.Tr.Dial(network, addr)
+	}
+	if proxyCtxFrom(c) == nil {
+		c = withProxyCtx(c, &ProxyCtx{Proxy: proxy})
+	}
+	d := proxy.Dialer
+	if d == nil {
+		d = defaultDialer
+	}
+	return d.DialContext(c, network, addr)
+}
+
+// maxTransports is the number of copies of the transport kept for the
+// requests with their own source address, resolver, client certificate or key
+// log
+var maxTransports = 64
+
+type transportKey struct {
+	source string
+	// resolver is the Resolver of the request, if it overrides the one of
+	// the proxy
+	resolver Resolver
+	// certFor is the user and host the client certificate was selected
+	// for, rather than the certificate: a file reloaded gives another one
+	certFor string
+	keyLog  bool
+}
+
+type transportEntry struct {
+	key  transportKey
+	cert *tls.Certificate
+	tr   *http.Transport
+}
+
+// transportCache keeps the copies of a transport used last, closing the idle
+// connections of the ones it drops
+type transportCache struct {
+	mu      sync.Mutex
+	base    *http.Transport
+	ll      *list.List // of *transportEntry, most recently used first
+	entries map[transportKey]*list.Element
+}
+
+// get returns the copy of base for key, made by clone if there is none or if
+// it presents another client certificate than cert. The copies of another
+// base, one Tr replaced since, are dropped.
+func (c *transportCache) get(base *http.Transport, key transportKey, cert *tls.Certificate, clone func() *http.Transport) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.base != base || c.entries == nil {
+		if c.ll != nil {
+			for el := c.ll.Front(); el != nil; el = el.Next() {
+				el.Value.(*transportEntry).tr.CloseIdleConnections()
+			}
+		}
+		c.base = base
+		c.ll = list.New()
+		c.entries = make(map[transportKey]*list.Element)
+	}
+	if el, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(el)
+		e := el.Value.(*transportEntry)
+		if e.cert != cert {
+			e.tr.CloseIdleConnections()
+			e.cert, e.tr = cert, clone()
+		}
+		return e.tr
+	}
+	tr := clone()
+	c.entries[key] = c.ll.PushFront(&transportEntry{key, cert, tr})
+	for c.ll.Len() > maxTransports {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		e := oldest.Value.(*transportEntry)
+		delete(c.entries, e.key)
+		// the connections in use are closed when done with, since the
+		// copy is never used again
+		e.tr.CloseIdleConnections()
+	}
+	return tr
+}
+
+// transport returns the transport for the request of ctx: Transport if set,
+// Tr otherwise. Requests with their own source address, resolver, client
+// certificate or key log get a copy of it, so that they never reuse
+// connections made from another address, to the addresses another resolver
+// returned, with another certificate or whose secrets were not logged, the
+// maxTransports copies used last being kept. Since only an
+// *http.Transport can be copied, they fail with other Transports rather than
+// silently going without.
+func (proxy *ProxyHttpServer) transport(ctx *ProxyCtx) (http.RoundTripper, error) {
+	if ctx.Req != nil && ctx.Req.URL.Scheme == "https" {
+		if proxy.ClientCerts != nil {
+			cert, err := proxy.ClientCerts.SelectClientCert(ctx.Req.URL.Hostname(), ctx)
+			if err != nil {
+				return nil, err
+			}
+			ctx.clientCert = cert
+		}
+		ctx.keyLogged = proxy.KeyLog.logs(ctx.Req, ctx)
+	}
+	base := proxy.Tr
+	if proxy.Transport != nil {
+		tr, ok := proxy.Transport.(*http.Transport)
+		if !ok {
+			var needs string
+			switch {
+			case ctx.SourceIP != nil || ctx.SourceInterface != "":
+				needs = "a source address"
+			case ctx.clientCert != nil:
+				needs = "a client certificate"
+			case ctx.keyLogged:
+				needs = "its TLS secrets logged"
+			default:
+				return proxy.Transport, nil
+			}
+			return nil, fmt.Errorf("goproxy: the request needs %s, which a %T Transport cannot be set up for", needs, proxy.Transport)
+		}
+		base = tr
+	}
+	var resolver Resolver
+	if ctx.Resolver != nil {
+		// the resolvers are told apart by their values
+		if !reflect.TypeOf(ctx.Resolver).Comparable() {
+			return nil, fmt.Errorf("goproxy: the Resolver of the request must be comparable, such as a pointer, got a %T", ctx.Resolver)
+		}
+		if ctx.Resolver != proxy.Resolver {
+			resolver = ctx.Resolver
+		}
+	}
+	if ctx.SourceIP == nil && ctx.SourceInterface == "" && resolver == nil && ctx.clientCert == nil && !ctx.keyLogged {
+		return base, nil
+	}
+	key := transportKey{source: ctx.SourceIP.String() + "%" + ctx.SourceInterface, resolver: resolver, keyLog: ctx.keyLogged}
+	if ctx.clientCert != nil {
+		key.certFor = ctx.User + "@" + ctx.Req.URL.Hostname()
+	}
+	cert := ctx.clientCert
+	tr := proxy.transports.get(base, key, cert, func() *http.Transport {
+		tr := base.Clone()
+		if cert != nil {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.GetClientCertificate = clientCertFunc(cert)
+		}
+		if key.keyLog {
+			tr.TLSClientConfig = proxy.KeyLog.withKeyLog(tr.TLSClientConfig)
+		}
+		return tr
+	})
+	return tr, nil
+}
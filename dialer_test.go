@@ -0,0 +1,284 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDialerSortIPs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), net.ParseIP("fd00::3")}
+	for mode, expected := range map[IPMode]string{
+		PreferIPv6: "fd00::1 10.0.0.1 fd00::2 10.0.0.2 fd00::3",
+		PreferIPv4: "10.0.0.1 fd00::1 10.0.0.2 fd00::2 fd00::3",
+		IPv4Only:   "10.0.0.1 10.0.0.2",
+		IPv6Only:   "fd00::1 fd00::2 fd00::3",
+	} {
+		var got []string
+		for _, ip := range (&Dialer{Mode: mode}).sortIPs(ips) {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, " ") != expected {
+			t.Errorf("mode %d: got %v, expected %s", mode, got, expected)
+		}
+	}
+}
+
+// fakeDialer records the attempts and answers according to the address
+type fakeDialer struct {
+	mu       sync.Mutex
+	attempts []string
+	start    time.Time
+}
+
+func (f *fakeDialer) dial(ctx context.Context, network, addr string, source net.IP) (net.Conn, error) {
+	f.mu.Lock()
+	f.attempts = append(f.attempts, addr+"@"+time.Since(f.start).Round(50*time.Millisecond).String())
+	f.mu.Unlock()
+	host, _, _ := net.SplitHostPort(addr)
+	switch host {
+	case "10.0.0.1", "fd00::1":
+		// blackholed
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case "10.0.0.2", "fd00::2":
+		return nil, errors.New("connection refused")
+	}
+	c1, c2 := net.Pipe()
+	go c2.Close()
+	return c1, nil
+}
+
+func (f *fakeDialer) dialWith(t *testing.T, d *Dialer, ips ...string) (net.Conn, string, error) {
+	f.start = time.Now()
+	f.attempts = nil
+	d.dial = f.dial
+	var hosts []net.IP
+	for _, ip := range ips {
+		hosts = append(hosts, net.ParseIP(ip))
+	}
+	resolver := &StaticResolver{Hosts: map[string][]net.IP{"host.test": hosts}}
+	ctx := &ProxyCtx{Resolver: resolver}
+	conn, err := d.DialContext(withProxyCtx(context.Background(), ctx), "tcp", "host.test:80")
+	if len(ctx.ResolvedIPs) != len(ips) {
+		t.Errorf("expected the resolved addresses on the context, got %v", ctx.ResolvedIPs)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return conn, strings.Join(f.attempts, " "), err
+}
+
+func TestDialerHappyEyeballs(t *testing.T) {
+	f := &fakeDialer{}
+	d := &Dialer{FallbackDelay: 100 * time.Millisecond}
+
+	// the blackholed IPv6 address gets a head start, then IPv4 wins
+	conn, attempts, err := f.dialWith(t, d, "10.0.0.3", "fd00::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if attempts != "[fd00::1]:80@0s 10.0.0.3:80@100ms" {
+		t.Errorf("unexpected attempts %s", attempts)
+	}
+
+	// a refused connection starts the next attempt right away
+	conn, attempts, err = f.dialWith(t, d, "10.0.0.3", "fd00::2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if attempts != "[fd00::2]:80@0s 10.0.0.3:80@0s" {
+		t.Errorf("unexpected attempts %s", attempts)
+	}
+
+	d.Mode = PreferIPv4
+	conn, attempts, err = f.dialWith(t, d, "fd00::3", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if attempts != "10.0.0.1:80@0s [fd00::3]:80@100ms" {
+		t.Errorf("unexpected attempts %s", attempts)
+	}
+
+	d.Mode = IPv4Only
+	if _, attempts, err = f.dialWith(t, d, "fd00::3", "10.0.0.2"); err == nil || attempts != "10.0.0.2:80@0s" {
+		t.Errorf("expected a single failed IPv4 attempt, got %v %s", err, attempts)
+	}
+	d.Mode = IPv6Only
+	if _, _, err = f.dialWith(t, d, "10.0.0.3"); err == nil {
+		t.Error("expected no address to be usable")
+	}
+}
+
+func TestDialerSource(t *testing.T) {
+	f := &fakeDialer{}
+	var sources []string
+	d := &Dialer{SourceIP: net.ParseIP("fd00::99")}
+	f.start = time.Now()
+	d.dial = func(ctx context.Context, network, addr string, source net.IP) (net.Conn, error) {
+		sources = append(sources, addr+" from "+source.String())
+		return f.dial(ctx, network, addr, source)
+	}
+	resolver := &StaticResolver{Hosts: map[string][]net.IP{"host.test": {net.ParseIP("10.0.0.3"), net.ParseIP("fd00::3")}}}
+	conn, err := d.DialContext(withProxyCtx(context.Background(), &ProxyCtx{Resolver: resolver}), "tcp", "host.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	ctx := &ProxyCtx{Resolver: resolver, SourceIP: net.ParseIP("10.0.0.99")}
+	conn, err = d.DialContext(withProxyCtx(context.Background(), ctx), "tcp", "host.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if strings.Join(sources, ", ") != "[fd00::3]:80 from fd00::99, 10.0.0.3:80 from 10.0.0.99" {
+		t.Errorf("unexpected attempts %v", sources)
+	}
+}
+
+func TestProxySourceIP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Write([]byte(host))
+	}))
+	defer backend.Close()
+	// the whole 127.0.0.0/8 network is local on Linux, not everywhere
+	if c, err := (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}).Dial("tcp", backend.Listener.Addr().String()); err != nil {
+		t.Skip("cannot bind to 127.0.0.2:", err)
+	} else {
+		c.Close()
+	}
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if src := r.Header.Get("X-Source"); src != "" {
+			ctx.SourceIP = net.ParseIP(src)
+		}
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, src := range []string{"127.0.0.2", "", "127.0.0.3", "127.0.0.2"} {
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		req.Header.Set("X-Source", src)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		expected := src
+		if expected == "" {
+			expected = "127.0.0.1"
+		}
+		if string(b) != expected {
+			t.Errorf("expected the request to come from %s, got %s", expected, b)
+		}
+	}
+}
+
+func TestSourceIPWithTransport(t *testing.T) {
+	backend := httptest.NewServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if src := r.Header.Get("X-Source"); src != "" {
+			ctx.SourceIP = net.ParseIP(src)
+		}
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	status := func(src string) int {
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		req.Header.Set("X-Source", src)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	proxy.Transport = roundTripperFunc(http.DefaultTransport.RoundTrip)
+	if code := status(""); code != http.StatusOK {
+		t.Error("expected the request to go through the Transport, got", code)
+	}
+	if code := status("127.0.0.1"); code != http.StatusInternalServerError {
+		t.Error("expected the request with a source address to fail, got", code)
+	}
+	// an *http.Transport is copied like Tr
+	proxy.Transport = &http.Transport{DialContext: proxy.DialContext}
+	if code := status("127.0.0.1"); code != http.StatusOK {
+		t.Error("expected the request with a source address to go through the copy of the Transport, got", code)
+	}
+}
+
+func TestTrDial(t *testing.T) {
+	backend := httptest.NewServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	proxy := NewProxyHttpServer()
+	var dials int32
+	proxy.Tr.Dial = func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial(network, addr)
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Errorf("expected plain HTTP requests to dial with Tr.Dial, got %d dials", dials)
+	}
+}
+
+func TestTransportCache(t *testing.T) {
+	defer func(n int) { maxTransports = n }(maxTransports)
+	maxTransports = 2
+	var c transportCache
+	var clones int
+	get := func(base *http.Transport, source string) *http.Transport {
+		return c.get(base, transportKey{source: source}, nil, func() *http.Transport {
+			clones++
+			return base.Clone()
+		})
+	}
+	base := &http.Transport{}
+	a := get(base, "a")
+	get(base, "b")
+	if get(base, "a") != a || clones != 2 {
+		t.Errorf("expected the copy to be reused, got %d copies", clones)
+	}
+	get(base, "c")
+	if get(base, "a") != a {
+		t.Error("expected the copy used last to be kept")
+	}
+	if get(base, "b"); clones != 4 {
+		t.Errorf("expected the oldest copy to be dropped, got %d copies", clones)
+	}
+	if get(&http.Transport{}, "a") == a || len(c.entries) != 1 {
+		t.Errorf("expected the copies of the replaced transport to be dropped, got %d", len(c.entries))
+	}
+}
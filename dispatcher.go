@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -97,15 +98,33 @@ func ReqHostIs(hosts ...string) ReqConditionFunc {
 	}
 }
 
-var localHostIpv4 = regexp.MustCompile(`127\.0\.0\.\d+`)
-
-// IsLocalHost checks whether the destination host is explicitly local host
-// (buggy, there can be IPv6 addresses it doesn't catch)
+// IsLocalHost checks whether the destination host is explicitly local host,
+// that is "localhost" or a loopback IPv4 or IPv6 address, with or without port.
+// The host name is not resolved.
 var IsLocalHost ReqConditionFunc = func(req *http.Request, ctx *ProxyCtx) bool {
-	return req.URL.Host == "::1" ||
-		req.URL.Host == "0:0:0:0:0:0:0:1" ||
-		localHostIpv4.MatchString(req.URL.Host) ||
-		req.URL.Host == "localhost"
+	host := requestHostname(req)
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// IsPrivateNetwork checks whether the destination host is an IP address that is
+// not publicly routable: loopback, RFC 1918 and RFC 4193 private addresses,
+// link local and unspecified addresses. localhost matches too.
+// The host name is not resolved, see DstIpIn for conditions on the resolved address.
+var IsPrivateNetwork ReqConditionFunc = func(req *http.Request, ctx *ProxyCtx) bool {
+	if IsLocalHost(req, ctx) {
+		return true
+	}
+	ip := net.ParseIP(requestHostname(req))
+	return ip != nil && isPrivateIP(ip)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
 }
 
 // UrlMatches returns a ReqCondition testing whether the destination URL
@@ -127,8 +146,10 @@ func DstHostIs(host string) ReqConditionFunc {
 // SrcIpIs returns a ReqCondition testing whether the source IP of the request is one of the given strings
 func SrcIpIs(ips ...string) ReqCondition {
 	return ReqConditionFunc(func(req *http.Request, ctx *ProxyCtx) bool {
+		src := remoteIP(req)
+		srcIP := net.ParseIP(src)
 		for _, ip := range ips {
-			if strings.HasPrefix(req.RemoteAddr, ip+":") {
+			if ip == src || srcIP != nil && srcIP.Equal(net.ParseIP(ip)) {
 				return true
 			}
 		}
@@ -136,6 +157,170 @@ func SrcIpIs(ips ...string) ReqCondition {
 	})
 }
 
+// SrcIpIn returns a ReqCondition testing whether the source IP of the request is in one
+// of the given subnets, in CIDR notation like "10.0.0.0/8" or "fd00::/8". A plain IP
+// address stands for itself. It panics if a subnet cannot be parsed.
+func SrcIpIn(cidrs ...string) ReqConditionFunc {
+	nets := mustParseIPNets("SrcIpIn", cidrs)
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return ipInNets(net.ParseIP(remoteIP(req)), nets)
+	}
+}
+
+// DstIpIn returns a ReqCondition testing whether the destination host of the request
+// resolves to an address in one of the given subnets, in the same notation as SrcIpIn.
+// Host names are resolved with the resolver of the proxy, a request matches when any of the addresses is in a subnet.
+// It panics if a subnet cannot be parsed.
+func DstIpIn(cidrs ...string) ReqConditionFunc {
+	nets := mustParseIPNets("DstIpIn", cidrs)
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		host := requestHostname(req)
+		ips, err := ctx.lookupIP(req.Context(), host)
+		if err != nil {
+			if ctx != nil {
+				ctx.Logf("DstIpIn: cannot resolve %s: %v", host, err)
+			}
+			return false
+		}
+		for _, ip := range ips {
+			if ipInNets(ip, nets) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func mustParseIPNets(fn string, cidrs []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		n, err := parseIPNet(s)
+		if err != nil {
+			panic("goproxy: " + fn + ": " + err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// parseIPNet parses a subnet in CIDR notation, or a single IP address as the
+// subnet containing only that address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: s}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address part of req.RemoteAddr
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// requestHostname returns the host the request is directed to, without port
+// and IPv6 brackets
+func requestHostname(req *http.Request) string {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// requestPort returns the port the request is directed to, defaulting to the
+// port of the URL scheme
+func requestPort(req *http.Request) int {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		p, _ := strconv.Atoi(port)
+		return p
+	}
+	switch req.URL.Scheme {
+	case "https", "wss":
+		return 443
+	}
+	return 80
+}
+
+// MethodIs returns a ReqCondition testing whether the request method is one of the given methods
+func MethodIs(methods ...string) ReqConditionFunc {
+	methodSet := make(map[string]bool)
+	for _, m := range methods {
+		methodSet[m] = true
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return methodSet[req.Method]
+	}
+}
+
+// ReqPortIs returns a ReqCondition testing whether the destination port of the request is one
+// of the given ports. Requests without an explicit port are directed to the default port
+// of their scheme, and CONNECT requests always carry one.
+func ReqPortIs(ports ...int) ReqConditionFunc {
+	portSet := make(map[int]bool)
+	for _, p := range ports {
+		portSet[p] = true
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return portSet[requestPort(req)]
+	}
+}
+
+// ReqHeaderMatches returns a ReqCondition testing whether any value of the given request
+// header matches the regular expression
+func ReqHeaderMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return headerMatches(req.Header, name, re)
+	}
+}
+
+// RespHeaderMatches returns a RespCondition testing whether any value of the given
+// response header matches the regular expression
+func RespHeaderMatches(name string, re *regexp.Regexp) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && headerMatches(resp.Header, name, re)
+	})
+}
+
+func headerMatches(h http.Header, name string, re *regexp.Regexp) bool {
+	for _, v := range h.Values(name) {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
 // Not returns a ReqCondition negating the given ReqCondition
 func Not(r ReqCondition) ReqConditionFunc {
 	return func(req *http.Request, ctx *ProxyCtx) bool {
@@ -143,6 +328,62 @@ func Not(r ReqCondition) ReqConditionFunc {
 	}
 }
 
+// And returns a ReqCondition testing whether all the given ReqConditions hold
+func And(conds ...ReqCondition) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if !c.HandleReq(req, ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or returns a ReqCondition testing whether any of the given ReqConditions holds
+func Or(conds ...ReqCondition) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if c.HandleReq(req, ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RespNot returns a RespCondition negating the given RespCondition
+func RespNot(r RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		return !r.HandleResp(resp, ctx)
+	}
+}
+
+// RespAnd returns a RespCondition testing whether all the given RespConditions hold.
+// Since ReqConditions are RespConditions, conditions on the request can be mixed in.
+func RespAnd(conds ...RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if !c.HandleResp(resp, ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RespOr returns a RespCondition testing whether any of the given RespConditions holds
+func RespOr(conds ...RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if c.HandleResp(resp, ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // ContentTypeIs returns a RespCondition testing whether the HTTP response has Content-Type header equal
 // to one of the given strings.
 func ContentTypeIs(typ string, types ...string) RespCondition {
@@ -0,0 +1,63 @@
+package goproxy
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestAddressConditions(t *testing.T) {
+	tests := []struct {
+		name string
+		cond ReqConditionFunc
+		req  *http.Request
+		want bool
+	}{
+		{"SrcIpIn v4", SrcIpIn("10.0.0.0/8"), newCondRequest("GET", "http://a/", "10.1.2.3:55"), true},
+		{"SrcIpIn v4 miss", SrcIpIn("10.0.0.0/8"), newCondRequest("GET", "http://a/", "11.1.2.3:55"), false},
+		{"SrcIpIn v6", SrcIpIn("10.0.0.0/8", "fd00::/8"), newCondRequest("GET", "http://a/", "[fd12::1]:55"), true},
+		{"SrcIpIn single", SrcIpIn("::1"), newCondRequest("GET", "http://a/", "[::1]:55"), true},
+		{"SrcIpIs v6", SrcIpIs("::1").HandleReq, newCondRequest("GET", "http://a/", "[::1]:55"), true},
+		{"SrcIpIs no prefix match", SrcIpIs("10.0.0.1").HandleReq, newCondRequest("GET", "http://a/", "10.0.0.11:55"), false},
+		{"DstIpIn literal", DstIpIn("192.168.0.0/16"), newCondRequest("GET", "http://192.168.1.1:8080/", ""), true},
+		{"DstIpIn literal v6", DstIpIn("2001:db8::/32"), newCondRequest("GET", "http://[2001:db8::5]/", ""), true},
+		{"DstIpIn resolved", DstIpIn("127.0.0.0/8", "::1"), newCondRequest("GET", "http://localhost/", ""), true},
+		{"IsLocalHost port", IsLocalHost, newCondRequest("GET", "http://localhost:8080/", ""), true},
+		{"IsLocalHost v6", IsLocalHost, newCondRequest("GET", "http://[0:0:0:0:0:0:0:1]:80/", ""), true},
+		{"IsLocalHost v4", IsLocalHost, newCondRequest("GET", "http://127.3.4.5/", ""), true},
+		{"IsLocalHost remote", IsLocalHost, newCondRequest("GET", "http://127.0.0.1.example.com/", ""), false},
+		{"IsPrivateNetwork rfc1918", IsPrivateNetwork, newCondRequest("GET", "http://172.16.3.4/", ""), true},
+		{"IsPrivateNetwork ula", IsPrivateNetwork, newCondRequest("GET", "http://[fd00::1]/", ""), true},
+		{"IsPrivateNetwork link local", IsPrivateNetwork, newCondRequest("GET", "http://[fe80::1]/", ""), true},
+		{"IsPrivateNetwork public", IsPrivateNetwork, newCondRequest("GET", "http://8.8.8.8/", ""), false},
+	}
+	for _, tc := range tests {
+		if got := tc.cond(tc.req, nil); got != tc.want {
+			t.Errorf("%s: expected %v", tc.name, tc.want)
+		}
+	}
+}
+
+func TestRequestConditions(t *testing.T) {
+	req := newCondRequest("POST", "https://example.com/upload", "")
+	if !MethodIs("PUT", "POST")(req, nil) || MethodIs("GET")(req, nil) {
+		t.Error("MethodIs")
+	}
+	if !ReqPortIs(443)(req, nil) || ReqPortIs(80)(req, nil) {
+		t.Error("ReqPortIs should default to the port of the scheme")
+	}
+	connect := newCondRequest("CONNECT", "https://example.com:8443", "")
+	if !ReqPortIs(8443)(connect, nil) {
+		t.Error("ReqPortIs on CONNECT")
+	}
+	if !ReqHeaderMatches("X-Team", regexp.MustCompile("^inf"))(req, nil) {
+		t.Error("ReqHeaderMatches")
+	}
+	resp := &http.Response{Header: http.Header{"Cache-Control": []string{"public", "max-age=0"}}}
+	if !RespHeaderMatches("Cache-Control", regexp.MustCompile(`max-age=0$`)).HandleResp(resp, nil) {
+		t.Error("RespHeaderMatches should look at all values")
+	}
+	if RespHeaderMatches("Cache-Control", regexp.MustCompile(`.`)).HandleResp(nil, nil) {
+		t.Error("RespHeaderMatches should not match a missing response")
+	}
+}
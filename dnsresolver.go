@@ -0,0 +1,527 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSResolver is a Resolver sending its own DNS queries, so that it can cache
+// the answers for as long as their TTL says, and remember names which do not
+// exist for a while (negative caching).
+//
+// Names under the suffixes registered with Forward are sent to their own
+// servers, which is the way to resolve internal names with the internal DNS
+// servers and everything else with public ones (split horizon):
+//
+//	r := goproxy.NewDNSResolver("1.1.1.1:53", "8.8.8.8:53")
+//	r.Forward("corp.example.com", "10.0.0.2:53")
+//	proxy.Resolver = r
+type DNSResolver struct {
+	// Servers are the addresses of the DNS servers, as host:port. When empty
+	// the nameservers listed in /etc/resolv.conf are used.
+	Servers []string
+	// Timeout of a single query, 5 seconds if zero.
+	Timeout time.Duration
+	// NegativeTTL is how long names are remembered as missing when the server
+	// does not say, 30 seconds if zero. Negative caching is disabled when
+	// NegativeTTL is negative.
+	NegativeTTL time.Duration
+	// MaxTTL caps the time answers stay in the cache, 1 hour if zero.
+	MaxTTL time.Duration
+	// MaxEntries is the number of answers cached, the least recently used
+	// being dropped first, 10000 if zero.
+	MaxEntries int
+
+	mu      sync.Mutex
+	forward []dnsForward
+	ll      *list.List // of *dnsCacheEntry, most recently used first
+	cache   map[dnsCacheKey]*list.Element
+	now     func() time.Time
+}
+
+type dnsForward struct {
+	suffix  string
+	servers []string
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	key     dnsCacheKey
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+
+	dnsRcodeNameError = 3
+)
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// NewDNSResolver returns a DNSResolver querying the given servers, or the
+// system nameservers if none are given.
+func NewDNSResolver(servers ...string) *DNSResolver {
+	return &DNSResolver{Servers: servers}
+}
+
+// Forward sends the queries for suffix and its subdomains to servers instead
+// of Servers. The longest matching suffix wins.
+func (r *DNSResolver) Forward(suffix string, servers ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forward = append(r.forward, dnsForward{strings.ToLower(strings.Trim(suffix, ".")), servers})
+}
+
+// Flush empties the cache.
+func (r *DNSResolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ll, r.cache = nil, nil
+}
+
+func (r *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}, {IP: net.IPv6loopback}}, nil
+	}
+
+	var v4, v6 []net.IP
+	var err4, err6 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v6, err6 = r.lookup(ctx, name, dnsTypeAAAA)
+	}()
+	v4, err4 = r.lookup(ctx, name, dnsTypeA)
+	wg.Wait()
+
+	if len(v4) == 0 && len(v6) == 0 {
+		err := err4
+		if err == nil || isNotFound(err) {
+			err = err6
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, 0, len(v4)+len(v6))
+	for _, ip := range v4 {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	for _, ip := range v6 {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, nil
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func (r *DNSResolver) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// lookup returns the addresses of the given type for name, from the cache if
+// possible
+func (r *DNSResolver) lookup(ctx context.Context, name string, qtype uint16) ([]net.IP, error) {
+	key := dnsCacheKey{name, qtype}
+	r.mu.Lock()
+	if el, ok := r.cache[key]; ok {
+		e := el.Value.(*dnsCacheEntry)
+		if r.timeNow().Before(e.expires) {
+			r.ll.MoveToFront(el)
+			r.mu.Unlock()
+			return e.ips, e.err
+		}
+		r.ll.Remove(el)
+		delete(r.cache, key)
+	}
+	servers := r.serversFor(name)
+	r.mu.Unlock()
+
+	ips, ttl, err := r.query(ctx, servers, name, qtype)
+	if err != nil && !isNotFound(err) {
+		// failures of the servers are not cached
+		return nil, err
+	}
+	if err != nil || len(ips) == 0 {
+		if r.NegativeTTL < 0 {
+			return ips, err
+		}
+		if ttl < 0 {
+			ttl = r.NegativeTTL
+			if ttl == 0 {
+				ttl = 30 * time.Second
+			}
+		}
+	}
+	maxTTL := r.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = time.Hour
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	r.add(&dnsCacheEntry{key: key, ips: ips, err: err, expires: r.timeNow().Add(ttl)})
+	return ips, err
+}
+
+// add caches e, dropping the entries used least recently beyond MaxEntries
+func (r *DNSResolver) add(e *dnsCacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.ll = list.New()
+		r.cache = make(map[dnsCacheKey]*list.Element)
+	}
+	if el, ok := r.cache[e.key]; ok {
+		r.ll.Remove(el)
+	}
+	r.cache[e.key] = r.ll.PushFront(e)
+	maxEntries := r.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = 10000
+	}
+	for r.ll.Len() > maxEntries {
+		oldest := r.ll.Back()
+		r.ll.Remove(oldest)
+		delete(r.cache, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+func (r *DNSResolver) serversFor(name string) []string {
+	var best *dnsForward
+	for i, f := range r.forward {
+		if (name == f.suffix || strings.HasSuffix(name, "."+f.suffix)) &&
+			(best == nil || len(f.suffix) > len(best.suffix)) {
+			best = &r.forward[i]
+		}
+	}
+	if best != nil {
+		return best.servers
+	}
+	if len(r.Servers) > 0 {
+		return r.Servers
+	}
+	return systemNameservers()
+}
+
+var (
+	systemNameserversOnce sync.Once
+	systemNameserversList []string
+)
+
+func systemNameservers() []string {
+	systemNameserversOnce.Do(func() {
+		f, err := os.Open("/etc/resolv.conf")
+		if err == nil {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) >= 2 && fields[0] == "nameserver" {
+					systemNameserversList = append(systemNameserversList, net.JoinHostPort(fields[1], "53"))
+				}
+			}
+		}
+		if len(systemNameserversList) == 0 {
+			systemNameserversList = []string{"127.0.0.1:53"}
+		}
+	})
+	return systemNameserversList
+}
+
+// query asks servers in turn for the records of name. ttl is negative when
+// the answer didn't tell how long a negative answer may be cached.
+func (r *DNSResolver) query(ctx context.Context, servers []string, name string, qtype uint16) (ips []net.IP, ttl time.Duration, err error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	err = &net.DNSError{Err: "no DNS servers", Name: name}
+	for _, server := range servers {
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		var msg []byte
+		msg, err = dnsExchange(qctx, server, name, qtype)
+		cancel()
+		if err != nil {
+			err = &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTimeout: isTimeout(err), IsTemporary: true}
+			continue
+		}
+		ips, ttl, err = parseDNSAnswer(msg, name, qtype)
+		if err == nil || isNotFound(err) {
+			return ips, ttl, err
+		}
+		err.(*net.DNSError).Server = server
+	}
+	return nil, 0, err
+}
+
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// dnsExchange sends a query to server over UDP, and again over TCP if the
+// answer was truncated
+func dnsExchange(ctx context.Context, server, name string, qtype uint16) ([]byte, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	query, err := buildDNSQuery(binary.BigEndian.Uint16(id[:]), name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	if _, err := conn.Write(query); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			conn.Close()
+			return nil, ctxErr(ctx, err)
+		}
+		// ignore stray answers to other queries, and forged ones
+		if answersQuery(buf[:n], query) {
+			buf = buf[:n]
+			break
+		}
+	}
+	conn.Close()
+	if buf[2]&0x02 == 0 {
+		return buf, nil
+	}
+
+	conn, err = d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stopTCP := closeOnDone(ctx, conn)
+	defer stopTCP()
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if !answersQuery(msg, query) {
+		return nil, errDNSMalformed
+	}
+	return msg, nil
+}
+
+// answersQuery tells whether msg is a response with the ID and the question
+// of query
+func answersQuery(msg, query []byte) bool {
+	if len(msg) < 12 || !bytes.Equal(msg[:2], query[:2]) || msg[2]&0x80 == 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return false
+	}
+	name, off, err := readDNSName(msg, 12)
+	if err != nil || off+4 > len(msg) {
+		return false
+	}
+	qname, qoff, _ := readDNSName(query, 12)
+	// the type and the class
+	return name == qname && bytes.Equal(msg[off:off+4], query[qoff:qoff+4])
+}
+
+// closeOnDone closes conn when ctx is cancelled, until stop is called
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("invalid DNS name " + name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 0, 0, 1)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	return msg, nil
+}
+
+// readDNSName reads the possibly compressed name at off in msg, and returns it
+// along with the offset following it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, strings.ToLower(string(msg[off+1:off+1+l])))
+			off += 1 + l
+		}
+	}
+}
+
+// parseDNSAnswer extracts the addresses of the given type from a response.
+// The TTL returned is the smallest of the records, or the negative caching TTL
+// from the SOA record for empty answers, -1 if there is none.
+func parseDNSAnswer(msg []byte, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, &net.DNSError{Err: errDNSMalformed.Error(), Name: name}
+	}
+	rcode := msg[3] & 0x0F
+	if rcode != 0 && rcode != dnsRcodeNameError {
+		return nil, 0, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, 0, &net.DNSError{Err: errDNSMalformed.Error(), Name: name}
+		}
+		off = next + 4
+	}
+
+	var ips []net.IP
+	minTTL, negTTL := time.Duration(-1), time.Duration(-1)
+	for i := 0; i < ancount+nscount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, 0, &net.DNSError{Err: errDNSMalformed.Error(), Name: name}
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[next+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return nil, 0, &net.DNSError{Err: errDNSMalformed.Error(), Name: name}
+		}
+		off = rdata + rdlen
+		if i >= ancount {
+			if typ == dnsTypeSOA && rdlen >= 20 {
+				// the SOA minimum field bounds the negative caching TTL
+				soaMin := time.Duration(binary.BigEndian.Uint32(msg[off-4:])) * time.Second
+				if soaMin < ttl {
+					ttl = soaMin
+				}
+				negTTL = ttl
+			}
+			continue
+		}
+		if typ != qtype {
+			// CNAME records leading to the addresses
+			continue
+		}
+		if (typ == dnsTypeA && rdlen != net.IPv4len) || (typ == dnsTypeAAAA && rdlen != net.IPv6len) {
+			return nil, 0, &net.DNSError{Err: errDNSMalformed.Error(), Name: name}
+		}
+		ip := make(net.IP, rdlen)
+		copy(ip, msg[rdata:off])
+		ips = append(ips, ip)
+		if minTTL < 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	if rcode == dnsRcodeNameError {
+		return nil, negTTL, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if len(ips) == 0 {
+		return nil, negTTL, nil
+	}
+	return ips, minTTL, nil
+}
@@ -0,0 +1,366 @@
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DomainSet is a set of domain names, stored in a trie of reversed labels so
+// that a lookup costs the same whatever the size of the set. It is meant for
+// large blocklists, where ReqHostMatches with one regexp per domain would be
+// too slow.
+//
+// Entries come in three forms:
+//
+//	example.com      matches example.com only
+//	*.example.com    matches the subdomains of example.com, but not example.com
+//	.example.com     matches example.com and all its subdomains
+//
+// Internationalized names are stored in their punycode form, so that
+// "bücher.example" and "xn--bcher-kva.example" are the same entry.
+//
+// A DomainSet is a ReqCondition on the destination host of the request, and
+// since CONNECT requests are tested too, it can decide what to do with a
+// tunnel before any TLS handshake happens:
+//
+//	blocked := goproxy.NewDomainSet()
+//	blocked.LoadHosts(f)
+//	proxy.OnRequest(blocked).HandleConnect(goproxy.AlwaysReject)
+//	proxy.OnRequest(blocked).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "Blocked")
+//	})
+//
+// It is safe to add entries while the proxy is running.
+type DomainSet struct {
+	mu   sync.RWMutex
+	root domainNode
+	size int
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	// entry is the entry matching exactly the domain of this node
+	entry string
+	// wildcard is the entry matching the subdomains of this node
+	wildcard string
+}
+
+// NewDomainSet returns a DomainSet holding the given entries, and panics if one
+// of them is not valid.
+func NewDomainSet(entries ...string) *DomainSet {
+	s := &DomainSet{}
+	for _, e := range entries {
+		if err := s.Add(e); err != nil {
+			panic("goproxy: NewDomainSet: " + err.Error())
+		}
+	}
+	return s
+}
+
+// Len returns the number of entries in the set.
+func (s *DomainSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// Add adds an entry to the set. Adding an entry twice is not an error.
+func (s *DomainSet) Add(entry string) error {
+	domain, exact, sub := entry, true, false
+	switch {
+	case strings.HasPrefix(domain, "*."):
+		domain, exact, sub = domain[2:], false, true
+	case strings.HasPrefix(domain, "."):
+		domain, sub = domain[1:], true
+	}
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return fmt.Errorf("invalid domain set entry %q: %v", entry, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := &s.root
+	for rest := domain; rest != ""; {
+		var label string
+		rest, label = cutLastLabel(rest)
+		next := node.children[label]
+		if next == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainNode)
+			}
+			next = &domainNode{}
+			node.children[label] = next
+		}
+		node = next
+	}
+	if exact && node.entry == "" {
+		node.entry = entry
+		s.size++
+	}
+	if sub && node.wildcard == "" {
+		node.wildcard = entry
+		if exact {
+			// counted once already
+			return nil
+		}
+		s.size++
+	}
+	return nil
+}
+
+// Match tells whether host, with or without a port, is in the set, and returns
+// the entry it matched. When several entries match, the most specific one is
+// returned.
+func (s *DomainSet) Match(host string) (entry string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host, err := normalizeDomain(host)
+	if err != nil {
+		return "", false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	node := &s.root
+	for rest := host; rest != ""; {
+		if node.wildcard != "" {
+			entry = node.wildcard
+		}
+		var label string
+		rest, label = cutLastLabel(rest)
+		if node = node.children[label]; node == nil {
+			return entry, entry != ""
+		}
+	}
+	if node.entry != "" {
+		return node.entry, true
+	}
+	return entry, entry != ""
+}
+
+// HandleReq tests the destination host of the request, for CONNECT requests too.
+func (s *DomainSet) HandleReq(req *http.Request, ctx *ProxyCtx) bool {
+	_, ok := s.Match(requestHostname(req))
+	return ok
+}
+
+// HandleResp tests the destination host of the request the response answers.
+func (s *DomainSet) HandleResp(resp *http.Response, ctx *ProxyCtx) bool {
+	return s.HandleReq(ctx.Req, ctx)
+}
+
+// LoadList adds to the set the entries of a plain list, one entry per line.
+// Empty lines and lines starting with # are ignored.
+func (s *DomainSet) LoadList(r io.Reader) error {
+	return scanDomainLines(r, func(fields []string) error {
+		if len(fields) != 1 {
+			return errors.New("expected a single entry")
+		}
+		return s.Add(fields[0])
+	})
+}
+
+// LoadHosts adds to the set the host names of a file in hosts(5) format, as
+// distributed by many blocklists:
+//
+//	0.0.0.0 ads.example.com tracker.example.com # comment
+//
+// The addresses are ignored, and so are the usual local names like localhost
+// or broadcasthost. Names match exactly, not their subdomains.
+func (s *DomainSet) LoadHosts(r io.Reader) error {
+	return scanDomainLines(r, func(fields []string) error {
+		if len(fields) < 2 {
+			return errors.New("expected an address followed by host names")
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return fmt.Errorf("invalid address %q", fields[0])
+		}
+		for _, name := range fields[1:] {
+			if hostsLocalNames[strings.ToLower(name)] || strings.HasPrefix(name, "ip6-") {
+				continue
+			}
+			if err := s.Add(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"0.0.0.0":               true,
+}
+
+func scanDomainLines(r io.Reader, add func(fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := add(fields); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// cutLastLabel splits domain before its last label
+func cutLastLabel(domain string) (rest, label string) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return "", domain
+	}
+	return domain[:i], domain[i+1:]
+}
+
+// normalizeDomain lower cases domain, removes its trailing dot and converts its
+// non ASCII labels to punycode
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return "", errors.New("empty domain")
+	}
+	ascii := true
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if c >= utf8.RuneSelf {
+			ascii = false
+			continue
+		}
+		if c == '*' || c == '/' || c == ':' || c <= ' ' {
+			return "", fmt.Errorf("invalid character %q", c)
+		}
+	}
+	domain = strings.ToLower(domain)
+	if ascii {
+		if strings.Contains(domain, "..") || strings.HasPrefix(domain, ".") {
+			return "", errors.New("empty label")
+		}
+		return domain, nil
+	}
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", errors.New("empty label")
+		}
+		if !utf8.ValidString(label) {
+			return "", errors.New("invalid UTF-8")
+		}
+		for _, c := range label {
+			if c >= utf8.RuneSelf {
+				labels[i] = "xn--" + punycode(label)
+				break
+			}
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// punycode encodes a label as described by RFC 3492
+func punycode(label string) string {
+	const (
+		base        = 36
+		tmin        = 1
+		tmax        = 26
+		initialBias = 72
+		initialN    = 128
+	)
+	input := []rune(label)
+	var out []byte
+	for _, c := range input {
+		if c < utf8.RuneSelf {
+			out = append(out, byte(c))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := rune(initialN), 0, initialBias
+	for h < len(input) {
+		m := rune(utf8.MaxRune)
+		for _, c := range input {
+			if c >= n && c < m {
+				m = c
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, c := range input {
+			if c < n {
+				delta++
+			}
+			if c != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	const (
+		base = 36
+		tmin = 1
+		tmax = 26
+		skew = 38
+		damp = 700
+	)
+	if first {
+		delta /= damp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((base-tmin)*tmax)/2 {
+		delta /= base - tmin
+		k += base
+	}
+	return k + (base-tmin+1)*delta/(delta+skew)
+}
@@ -0,0 +1,137 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDomainSetMatch(t *testing.T) {
+	s := NewDomainSet("example.com", "*.ads.example.com", ".tracker.net", "bücher.example")
+	tests := []struct {
+		host  string
+		entry string
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com.", "example.com"},
+		{"example.com:443", "example.com"},
+		{"www.example.com", ""},
+		{"ads.example.com", ""},
+		{"x.ads.example.com", "*.ads.example.com"},
+		{"a.b.ads.example.com", "*.ads.example.com"},
+		{"tracker.net", ".tracker.net"},
+		{"pixel.tracker.net", ".tracker.net"},
+		{"nottracker.net", ""},
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"BÜCHER.example", "bücher.example"},
+		{"com", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		entry, ok := s.Match(tc.host)
+		if entry != tc.entry || ok != (tc.entry != "") {
+			t.Errorf("Match(%q) = %q, %v; expected %q", tc.host, entry, ok, tc.entry)
+		}
+	}
+	if s.Len() != 4 {
+		t.Errorf("expected 4 entries, got %d", s.Len())
+	}
+}
+
+func TestDomainSetMostSpecific(t *testing.T) {
+	s := NewDomainSet(".example.com", "*.cdn.example.com", "img.cdn.example.com")
+	for host, expected := range map[string]string{
+		"example.com":         ".example.com",
+		"cdn.example.com":     ".example.com",
+		"a.cdn.example.com":   "*.cdn.example.com",
+		"img.cdn.example.com": "img.cdn.example.com",
+	} {
+		if entry, _ := s.Match(host); entry != expected {
+			t.Errorf("Match(%q) = %q, expected %q", host, entry, expected)
+		}
+	}
+}
+
+func TestDomainSetInvalid(t *testing.T) {
+	s := NewDomainSet()
+	for _, e := range []string{"", "*", "a*.com", "a..com", "http://a.com", "a b"} {
+		if err := s.Add(e); err == nil {
+			t.Errorf("expected an error adding %q", e)
+		}
+	}
+}
+
+func TestPunycode(t *testing.T) {
+	for in, out := range map[string]string{
+		"bücher":   "bcher-kva",
+		"münchen":  "mnchen-3ya",
+		"ü":        "tda",
+		"例え":       "r8jz45g",
+		"пример":   "e1afmkfd",
+		"faß-über": "fa-ber-cta7u",
+	} {
+		if got := punycode(in); got != out {
+			t.Errorf("punycode(%q) = %q, expected %q", in, got, out)
+		}
+	}
+}
+
+func TestDomainSetLoad(t *testing.T) {
+	s := NewDomainSet()
+	hosts := `# blocklist
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com tracker.example.com # two names
+
+0.0.0.0 pixel.example.org
+`
+	if err := s.LoadHosts(strings.NewReader(hosts)); err != nil {
+		t.Fatal(err)
+	}
+	list := `
+# subdomains
+.doubleclick.example
+*.metrics.example
+`
+	if err := s.LoadList(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 5 {
+		t.Errorf("expected 5 entries, got %d", s.Len())
+	}
+	for _, host := range []string{"ads.example.com", "tracker.example.com", "pixel.example.org", "x.doubleclick.example", "a.metrics.example"} {
+		if _, ok := s.Match(host); !ok {
+			t.Errorf("expected %s to match", host)
+		}
+	}
+	for _, host := range []string{"localhost", "example.com", "metrics.example"} {
+		if _, ok := s.Match(host); ok {
+			t.Errorf("expected %s not to match", host)
+		}
+	}
+
+	if err := s.LoadHosts(strings.NewReader("0.0.0.0 a.com\nads.example.com\n")); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+	if err := s.LoadList(strings.NewReader("a.com b.com\n")); err == nil {
+		t.Error("expected an error for two entries on a line")
+	}
+}
+
+func TestDomainSetCondition(t *testing.T) {
+	s := NewDomainSet(".ads.example.com")
+	connect := &http.Request{Method: "CONNECT", URL: &url.URL{Host: "x.ads.example.com:443"}, Host: "x.ads.example.com:443"}
+	if !s.HandleReq(connect, nil) {
+		t.Error("expected the CONNECT request to match")
+	}
+	req := newCondRequest("GET", "http://ads.example.com/banner.png", "")
+	ctx := &ProxyCtx{Req: req}
+	if !s.HandleReq(req, ctx) || !s.HandleResp(nil, ctx) {
+		t.Error("expected the request to match")
+	}
+	if s.HandleReq(newCondRequest("GET", "http://example.com/", ""), nil) {
+		t.Error("expected the request not to match")
+	}
+}
@@ -0,0 +1,717 @@
+// Package adblock blocks requests going through a goproxy with Adblock Plus
+// network filters, the format of EasyList and of most browser blocklists.
+//
+//	m := adblock.NewMatcher()
+//	f, _ := os.Open("easylist.txt")
+//	m.Load(f)
+//	m.Install(proxy)
+//
+// The supported syntax is the one of network rules:
+//
+//	||ads.example.com^          the domain and its subdomains
+//	|https://example.com/ad     URL prefix, and suffix with a trailing |
+//	/banner/*/img^              wildcards and separators
+//	/ads[0-9]+\.js/             regular expressions
+//	@@||cdn.example.com^        exceptions
+//
+// with the options $third-party, $match-case, $domain= and the resource types
+// script, image, stylesheet, object, xmlhttprequest, subdocument, document,
+// font, media, websocket, ping and other, all of them negatable with ~.
+// Element hiding rules and rules with other options are skipped.
+//
+// A proxy only sees the request, not the page it comes from, so the page is
+// taken from the Referer or Origin header, and the resource type from the
+// Sec-Fetch-Dest header or the extension of the URL. Two hosts are deemed
+// third-party when their last two labels differ, or last three for country
+// code second level domains like co.uk.
+//
+// Unless the proxy eavesdrops HTTPS connections, only CONNECT requests are
+// seen for HTTPS sites. These are rejected when a rule blocks the whole host,
+// like ||ads.example.com^, and no exception rule is about that host.
+package adblock
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+type typeMask uint16
+
+const (
+	typeOther typeMask = 1 << iota
+	typeScript
+	typeImage
+	typeStylesheet
+	typeObject
+	typeXHR
+	typeSubdocument
+	typeDocument
+	typeFont
+	typeMedia
+	typeWebsocket
+	typePing
+	typeAll = 1<<iota - 1
+)
+
+var typeNames = map[string]typeMask{
+	"other":          typeOther,
+	"script":         typeScript,
+	"image":          typeImage,
+	"stylesheet":     typeStylesheet,
+	"css":            typeStylesheet,
+	"object":         typeObject,
+	"xmlhttprequest": typeXHR,
+	"xhr":            typeXHR,
+	"subdocument":    typeSubdocument,
+	"frame":          typeSubdocument,
+	"document":       typeDocument,
+	"doc":            typeDocument,
+	"font":           typeFont,
+	"media":          typeMedia,
+	"websocket":      typeWebsocket,
+	"ping":           typePing,
+}
+
+type rule struct {
+	text      string
+	exception bool
+
+	pattern      string
+	re           *regexp.Regexp
+	anchorDomain bool
+	anchorStart  bool
+	anchorEnd    bool
+	matchCase    bool
+
+	types typeMask
+	// document is set when the document type was given explicitly, which
+	// makes an exception rule apply to everything a page loads
+	document bool
+	// thirdParty is 1 for third-party requests only, -1 for first-party
+	// requests only, 0 for both
+	thirdParty int
+	domains    []string
+	notDomains []string
+}
+
+var errUnsupported = errors.New("adblock: unsupported rule")
+
+func parseRule(line string) (*rule, error) {
+	r := &rule{text: line, types: typeAll}
+	if strings.HasPrefix(line, "@@") {
+		r.exception = true
+		line = line[2:]
+	}
+	// regular expressions may contain $, options may not contain /
+	if i := strings.LastIndexByte(line, '$'); i >= 0 && !strings.Contains(line[i:], "/") {
+		if err := r.parseOptions(line[i+1:]); err != nil {
+			return nil, err
+		}
+		line = line[:i]
+	}
+
+	if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+		expr := line[1 : len(line)-1]
+		if !r.matchCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		r.re = re
+		return r, nil
+	}
+
+	switch {
+	case strings.HasPrefix(line, "||"):
+		r.anchorDomain = true
+		line = line[2:]
+	case strings.HasPrefix(line, "|"):
+		r.anchorStart = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "|") {
+		r.anchorEnd = true
+		line = line[:len(line)-1]
+	}
+	for strings.Contains(line, "**") {
+		line = strings.Replace(line, "**", "*", -1)
+	}
+	if !r.anchorDomain && !r.anchorStart {
+		line = strings.TrimPrefix(line, "*")
+	}
+	if strings.HasSuffix(line, "*") && !r.anchorEnd {
+		line = line[:len(line)-1]
+	}
+	if !r.matchCase {
+		line = strings.ToLower(line)
+	}
+	r.pattern = line
+	return r, nil
+}
+
+func (r *rule) parseOptions(options string) error {
+	var types, notTypes typeMask
+	for _, opt := range strings.Split(options, ",") {
+		opt = strings.TrimSpace(opt)
+		switch opt {
+		case "third-party", "3p":
+			r.thirdParty = 1
+			continue
+		case "~third-party", "~3p", "first-party", "1p":
+			r.thirdParty = -1
+			continue
+		case "match-case":
+			r.matchCase = true
+			continue
+		}
+		if strings.HasPrefix(opt, "domain=") {
+			for _, d := range strings.Split(opt[len("domain="):], "|") {
+				d = strings.ToLower(d)
+				if strings.HasPrefix(d, "~") {
+					r.notDomains = append(r.notDomains, d[1:])
+				} else if d != "" {
+					r.domains = append(r.domains, d)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(opt, "~") {
+			t, ok := typeNames[opt[1:]]
+			if !ok {
+				return errUnsupported
+			}
+			notTypes |= t
+			continue
+		}
+		t, ok := typeNames[opt]
+		if !ok {
+			return errUnsupported
+		}
+		types |= t
+		if t == typeDocument {
+			r.document = true
+		}
+	}
+	if types == 0 {
+		types = typeAll
+	}
+	r.types = types &^ notTypes
+	return nil
+}
+
+// anchoredDomain returns the domain of rules like ||example.com^, which match
+// example.com and its subdomains whatever the rest of the pattern.
+func (r *rule) anchoredDomain() string {
+	if !r.anchorDomain || r.re != nil {
+		return ""
+	}
+	i := strings.IndexAny(r.pattern, "^/*|")
+	if i <= 0 || (r.pattern[i] != '^' && r.pattern[i] != '/') {
+		return ""
+	}
+	return strings.ToLower(r.pattern[:i])
+}
+
+// blocksHost tells whether the rule blocks everything on the domain it is
+// anchored to, so that CONNECT requests to it can be rejected.
+func (r *rule) blocksHost() bool {
+	d := r.anchoredDomain()
+	return d != "" && len(r.pattern) == len(d)+1 && !r.anchorEnd &&
+		r.types == typeAll && r.thirdParty == 0 && len(r.domains) == 0 && len(r.notDomains) == 0
+}
+
+// commonTokens appear in so many URLs that indexing rules on them is useless
+var commonTokens = map[string]bool{"http": true, "https": true, "www": true, "com": true}
+
+// token returns the longest run of letters and digits of the pattern that is
+// a whole token of every URL the rule matches, or "" if there is none.
+func (r *rule) token() string {
+	if r.re != nil {
+		return ""
+	}
+	p := strings.ToLower(r.pattern)
+	best := ""
+	for s := 0; s < len(p); {
+		if !isTokenChar(p[s]) {
+			s++
+			continue
+		}
+		e := s
+		for e < len(p) && isTokenChar(p[e]) {
+			e++
+		}
+		startOK := (s == 0 && (r.anchorDomain || r.anchorStart)) || (s > 0 && p[s-1] != '*')
+		endOK := (e == len(p) && r.anchorEnd) || (e < len(p) && p[e] != '*')
+		if startOK && endOK && e-s > len(best) && !commonTokens[p[s:e]] {
+			best = p[s:e]
+		}
+		s = e
+	}
+	return best
+}
+
+func (r *rule) matches(q *request) bool {
+	if r.types&q.typ == 0 {
+		return false
+	}
+	if (r.thirdParty == 1 && !q.thirdParty) || (r.thirdParty == -1 && q.thirdParty) {
+		return false
+	}
+	if len(r.domains) > 0 && !domainIn(q.docHost, r.domains) {
+		return false
+	}
+	if domainIn(q.docHost, r.notDomains) {
+		return false
+	}
+	if r.re != nil {
+		return r.re.MatchString(q.url)
+	}
+	s := q.lower
+	if r.matchCase {
+		s = q.url
+	}
+	switch {
+	case r.anchorDomain:
+		for i := q.hostStart; i < q.hostEnd; i++ {
+			if (i == q.hostStart || s[i-1] == '.') && matchPattern(r.pattern, s[i:], r.anchorEnd) {
+				return true
+			}
+		}
+		return false
+	case r.anchorStart:
+		return matchPattern(r.pattern, s, r.anchorEnd)
+	}
+	for i := 0; i <= len(s); i++ {
+		if len(r.pattern) > 0 && r.pattern[0] != '^' {
+			j := strings.IndexByte(s[i:], r.pattern[0])
+			if j < 0 {
+				return false
+			}
+			i += j
+		}
+		if matchPattern(r.pattern, s[i:], r.anchorEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern tells whether the pattern p matches the beginning of s, or the
+// whole of s if anchorEnd is set.
+func matchPattern(p, s string, anchorEnd bool) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			p = p[1:]
+			if p == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(p, s[i:], anchorEnd) {
+					return true
+				}
+			}
+			return false
+		case '^':
+			if s == "" {
+				// the end of the URL counts as a separator
+				p = p[1:]
+				continue
+			}
+			if !isSeparator(s[0]) {
+				return false
+			}
+		default:
+			if s == "" || s[0] != p[0] {
+				return false
+			}
+		}
+		p, s = p[1:], s[1:]
+	}
+	return !anchorEnd || s == ""
+}
+
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func isSeparator(c byte) bool {
+	return !isTokenChar(c) && c != '_' && c != '-' && c != '.' && c != '%'
+}
+
+// domainIn tells whether host is one of domains or a subdomain of one of them
+func domainIn(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// request is what rules are matched against
+type request struct {
+	url, lower         string
+	hostStart, hostEnd int
+	host               string
+	docHost            string
+	thirdParty         bool
+	typ                typeMask
+}
+
+func newRequest(req *http.Request) *request {
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	q := newRequestURL(u.String(), requestType(req))
+	doc := req.Header.Get("Referer")
+	if doc == "" {
+		doc = req.Header.Get("Origin")
+	}
+	if du, err := url.Parse(doc); err == nil && du.Host != "" {
+		q.docHost = strings.ToLower(du.Hostname())
+		q.thirdParty = baseDomain(q.docHost) != baseDomain(q.host)
+	}
+	return q
+}
+
+func newRequestURL(s string, typ typeMask) *request {
+	q := &request{url: s, lower: strings.ToLower(s), typ: typ}
+	if i := strings.Index(s, "://"); i >= 0 {
+		q.hostStart = i + 3
+	}
+	q.hostEnd = len(s)
+	if i := strings.IndexAny(s[q.hostStart:], "/?#"); i >= 0 {
+		q.hostEnd = q.hostStart + i
+	}
+	host := q.lower[q.hostStart:q.hostEnd]
+	if i := strings.LastIndexByte(host, '@'); i >= 0 {
+		q.hostStart += i + 1
+		host = host[i+1:]
+	}
+	q.host = hostname(host)
+	q.docHost = q.host
+	return q
+}
+
+// hostname removes the port and IPv6 brackets from host
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// baseDomain guesses the registered domain of host, without a public suffix list
+func baseDomain(host string) string {
+	labels := strings.Split(host, ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return host
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+var fetchDestTypes = map[string]typeMask{
+	"script":   typeScript,
+	"image":    typeImage,
+	"style":    typeStylesheet,
+	"font":     typeFont,
+	"audio":    typeMedia,
+	"video":    typeMedia,
+	"track":    typeMedia,
+	"iframe":   typeSubdocument,
+	"frame":    typeSubdocument,
+	"document": typeDocument,
+	"object":   typeObject,
+	"embed":    typeObject,
+	"empty":    typeXHR,
+}
+
+var extensionTypes = map[string]typeMask{
+	".js":    typeScript,
+	".mjs":   typeScript,
+	".css":   typeStylesheet,
+	".png":   typeImage,
+	".jpg":   typeImage,
+	".jpeg":  typeImage,
+	".gif":   typeImage,
+	".webp":  typeImage,
+	".svg":   typeImage,
+	".ico":   typeImage,
+	".woff":  typeFont,
+	".woff2": typeFont,
+	".ttf":   typeFont,
+	".otf":   typeFont,
+	".mp4":   typeMedia,
+	".webm":  typeMedia,
+	".mp3":   typeMedia,
+	".html":  typeDocument,
+	".htm":   typeDocument,
+	".swf":   typeObject,
+}
+
+func requestType(req *http.Request) typeMask {
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return typeWebsocket
+	}
+	if t, ok := fetchDestTypes[req.Header.Get("Sec-Fetch-Dest")]; ok {
+		return t
+	}
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return typeXHR
+	}
+	if req.Header.Get("Ping-To") != "" || req.Header.Get("Content-Type") == "text/ping" {
+		return typePing
+	}
+	if t, ok := extensionTypes[strings.ToLower(path.Ext(req.URL.Path))]; ok {
+		return t
+	}
+	if strings.HasPrefix(req.Header.Get("Accept"), "text/html") {
+		return typeDocument
+	}
+	return typeOther
+}
+
+// ruleIndex finds the rules that may match a request without trying them all
+type ruleIndex struct {
+	domains map[string][]*rule
+	tokens  map[string][]*rule
+	generic []*rule
+}
+
+func newRuleIndex() *ruleIndex {
+	return &ruleIndex{domains: make(map[string][]*rule), tokens: make(map[string][]*rule)}
+}
+
+func (idx *ruleIndex) add(r *rule) {
+	if d := r.anchoredDomain(); d != "" {
+		idx.domains[d] = append(idx.domains[d], r)
+	} else if t := r.token(); t != "" {
+		idx.tokens[t] = append(idx.tokens[t], r)
+	} else {
+		idx.generic = append(idx.generic, r)
+	}
+}
+
+// find returns a rule matching q, for which accept is true
+func (idx *ruleIndex) find(q *request, accept func(*rule) bool) *rule {
+	try := func(rules []*rule) *rule {
+		for _, r := range rules {
+			if accept(r) && r.matches(q) {
+				return r
+			}
+		}
+		return nil
+	}
+	for d := q.host; d != ""; {
+		if r := try(idx.domains[d]); r != nil {
+			return r
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	for s := 0; s < len(q.lower); {
+		if !isTokenChar(q.lower[s]) {
+			s++
+			continue
+		}
+		e := s
+		for e < len(q.lower) && isTokenChar(q.lower[e]) {
+			e++
+		}
+		if r := try(idx.tokens[q.lower[s:e]]); r != nil {
+			return r
+		}
+		s = e
+	}
+	return try(idx.generic)
+}
+
+func anyRule(*rule) bool { return true }
+
+func documentRule(r *rule) bool { return r.document }
+
+// Matcher holds a set of filter rules. It is a goproxy.ReqCondition matching
+// the requests the rules block, and its Handle and HandleConnect methods
+// block them. It is safe to add rules while the proxy is running.
+type Matcher struct {
+	mu    sync.RWMutex
+	block *ruleIndex
+	allow *ruleIndex
+	size  int
+}
+
+// NewMatcher returns a Matcher without rules.
+func NewMatcher() *Matcher {
+	return &Matcher{block: newRuleIndex(), allow: newRuleIndex()}
+}
+
+// Len returns the number of rules of the matcher.
+func (m *Matcher) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+// AddRule adds a single rule. Empty lines, comments and element hiding rules
+// are ignored, an error is returned for rules that cannot be parsed or use
+// unsupported options.
+func (m *Matcher) AddRule(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' || isElementHiding(line) {
+		return nil
+	}
+	r, err := parseRule(line)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r.exception {
+		m.allow.add(r)
+	} else {
+		m.block.add(r)
+	}
+	m.size++
+	return nil
+}
+
+func isElementHiding(line string) bool {
+	return strings.Contains(line, "##") || strings.Contains(line, "#@#") ||
+		strings.Contains(line, "#?#") || strings.Contains(line, "#$#")
+}
+
+// Load adds the rules of a filter list, one per line. Rules that AddRule
+// rejects are skipped, since lists are written for browsers and use options
+// which make no sense in a proxy. Only errors reading r are returned.
+func (m *Matcher) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m.AddRule(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Match tells whether req is blocked, and by which rule.
+func (m *Matcher) Match(req *http.Request) (rule string, blocked bool) {
+	if req.Method == "CONNECT" {
+		host := req.URL.Host
+		if host == "" {
+			host = req.Host
+		}
+		return m.matchHost(hostname(host))
+	}
+	q := newRequest(req)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r := m.block.find(q, anyRule)
+	if r == nil || m.allow.find(q, anyRule) != nil {
+		return "", false
+	}
+	doc := req.Header.Get("Referer")
+	if doc == "" {
+		doc = req.Header.Get("Origin")
+	}
+	// $document exceptions on the page apply to everything it loads
+	if doc != "" && m.allow.find(newRequestURL(doc, typeDocument), documentRule) != nil {
+		return "", false
+	}
+	return r.text, true
+}
+
+func (m *Matcher) matchHost(host string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var blocked *rule
+	for d := host; d != "" && blocked == nil; {
+		for _, r := range m.block.domains[d] {
+			if r.blocksHost() {
+				blocked = r
+				break
+			}
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	if blocked == nil {
+		return "", false
+	}
+	// the requests inside the tunnel cannot be told apart, so any exception
+	// about the host lets the whole tunnel through
+	for d := host; d != ""; {
+		if len(m.allow.domains[d]) > 0 {
+			return "", false
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return blocked.text, true
+}
+
+// HandleReq tells whether req is blocked.
+func (m *Matcher) HandleReq(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	_, blocked := m.Match(req)
+	return blocked
+}
+
+// HandleResp tells whether the request of resp is blocked.
+func (m *Matcher) HandleResp(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	return m.HandleReq(ctx.Req, ctx)
+}
+
+// Handle answers blocked requests with 403 Forbidden.
+func (m *Matcher) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	rule, blocked := m.Match(req)
+	if !blocked {
+		return req, nil
+	}
+	ctx.Logf("adblock: %s blocked by %s", req.URL, rule)
+	return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by filter rule "+rule)
+}
+
+// HandleConnect rejects CONNECT requests to hosts blocked as a whole, and
+// leaves the decision to the other handlers otherwise.
+func (m *Matcher) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	rule, blocked := m.matchHost(hostname(host))
+	if !blocked {
+		return nil, ""
+	}
+	ctx.Logf("adblock: CONNECT %s blocked by %s", host, rule)
+	return goproxy.RejectConnect, host
+}
+
+// Install blocks the requests matched by m on proxy. It should be called
+// before registering the CONNECT handlers that would accept the request.
+func (m *Matcher) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnect(m)
+	proxy.OnRequest().Do(m)
+}
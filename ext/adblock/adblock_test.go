@@ -0,0 +1,194 @@
+package adblock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+const easyList = `[Adblock Plus 2.0]
+! Title: test list
+||ads.example.com^
+||tracker.net^$third-party
+/banner/*/img^
+|https://start.example.org/pre
+.swf|
+-ad-$script,domain=news.example|~sports.news.example
+||cdn.example.com^$image
+||metrics.example.com^$~xmlhttprequest
+/ads[0-9]+\.js/
+||social.example^$popup
+example.com##.ad-banner
+@@||ads.example.com/acceptable/
+@@||allowed.example^$document
+`
+
+func newTestRequest(method, rawurl string, header ...string) *http.Request {
+	req, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return req
+}
+
+func loadTestList(t *testing.T) *Matcher {
+	m := NewMatcher()
+	if err := m.Load(strings.NewReader(easyList)); err != nil {
+		t.Fatal(err)
+	}
+	// the $popup and element hiding rules are skipped
+	if m.Len() != 11 {
+		t.Fatalf("expected 11 rules, got %d", m.Len())
+	}
+	return m
+}
+
+func TestMatch(t *testing.T) {
+	m := loadTestList(t)
+	tests := []struct {
+		req  *http.Request
+		rule string
+	}{
+		{newTestRequest("GET", "http://ads.example.com/x.js"), "||ads.example.com^"},
+		{newTestRequest("GET", "http://a.ads.example.com:8080/"), "||ads.example.com^"},
+		{newTestRequest("GET", "http://ads.example.com.evil/"), ""},
+		{newTestRequest("GET", "http://notads.example.com/"), ""},
+		{newTestRequest("GET", "http://ads.example.com/acceptable/x.png"), ""},
+		{newTestRequest("GET", "http://tracker.net/p.gif", "Referer", "http://news.example/"), "||tracker.net^$third-party"},
+		{newTestRequest("GET", "http://tracker.net/p.gif", "Referer", "http://www.tracker.net/"), ""},
+		{newTestRequest("GET", "http://tracker.net/p.gif"), ""},
+		{newTestRequest("GET", "http://x.org/banner/top/img?x=1"), "/banner/*/img^"},
+		{newTestRequest("GET", "http://x.org/banner/top/imgs"), ""},
+		{newTestRequest("GET", "https://start.example.org/prefix"), "|https://start.example.org/pre"},
+		{newTestRequest("GET", "https://x.org/?u=https://start.example.org/prefix"), ""},
+		{newTestRequest("GET", "http://x.org/movie.swf"), ".swf|"},
+		{newTestRequest("GET", "http://x.org/movie.swf?x"), ""},
+		{newTestRequest("GET", "http://x.org/top-ad-1.js", "Referer", "http://www.news.example/"), "-ad-$script,domain=news.example|~sports.news.example"},
+		{newTestRequest("GET", "http://x.org/top-ad-1.js", "Referer", "http://sports.news.example/"), ""},
+		{newTestRequest("GET", "http://x.org/top-ad-1.css", "Referer", "http://news.example/"), ""},
+		{newTestRequest("GET", "http://x.org/top-ad-1", "Referer", "http://news.example/", "Sec-Fetch-Dest", "script"), "-ad-$script,domain=news.example|~sports.news.example"},
+		{newTestRequest("GET", "http://cdn.example.com/a.png"), "||cdn.example.com^$image"},
+		{newTestRequest("GET", "http://cdn.example.com/a.js"), ""},
+		{newTestRequest("GET", "http://metrics.example.com/hit"), "||metrics.example.com^$~xmlhttprequest"},
+		{newTestRequest("GET", "http://metrics.example.com/hit", "X-Requested-With", "XMLHttpRequest"), ""},
+		{newTestRequest("GET", "http://x.org/ADS42.js"), `/ads[0-9]+\.js/`},
+		{newTestRequest("GET", "http://social.example/"), ""},
+		{newTestRequest("GET", "http://ads.example.com/x.js", "Referer", "https://allowed.example/page"), ""},
+		// ads.example.com has an exception, so the tunnel stays open
+		{newTestRequest("CONNECT", "http://ads.example.com:443/"), ""},
+		{newTestRequest("CONNECT", "http://sub.cdn.example.com:443/"), ""},
+	}
+	for _, tc := range tests {
+		rule, blocked := m.Match(tc.req)
+		if rule != tc.rule || blocked != (tc.rule != "") {
+			t.Errorf("%s %s: got %q, expected %q", tc.req.Method, tc.req.URL, rule, tc.rule)
+		}
+	}
+}
+
+func TestMatchConnect(t *testing.T) {
+	m := NewMatcher()
+	for _, r := range []string{"||ads.example.com^", "||cdn.example.com^$image", "||tracker.net^$third-party"} {
+		if err := m.AddRule(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for host, expected := range map[string]bool{
+		"ads.example.com:443":   true,
+		"x.ads.example.com:443": true,
+		"cdn.example.com:443":   false,
+		"tracker.net:443":       false,
+		"example.com:443":       false,
+	} {
+		req := &http.Request{Method: "CONNECT", URL: &url.URL{Host: host}, Host: host}
+		if _, blocked := m.Match(req); blocked != expected {
+			t.Errorf("CONNECT %s: expected blocked=%v", host, expected)
+		}
+	}
+}
+
+func TestMatchCase(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("/Promo/$match-case")
+	if _, blocked := m.Match(newTestRequest("GET", "http://x.org/Promo/1")); !blocked {
+		t.Error("expected /Promo/ to be blocked")
+	}
+	if _, blocked := m.Match(newTestRequest("GET", "http://x.org/promo/1")); blocked {
+		t.Error("expected /promo/ not to be blocked")
+	}
+}
+
+func TestAddRuleErrors(t *testing.T) {
+	m := NewMatcher()
+	for _, r := range []string{"||a.com^$popup", "||a.com^$csp=script-src", "/a[/", "||a.com^$~nonsense"} {
+		if err := m.AddRule(r); err == nil {
+			t.Errorf("expected an error for %q", r)
+		}
+	}
+	for _, r := range []string{"", "! comment", "[Adblock Plus 2.0]", "example.com##.ad"} {
+		if err := m.AddRule(r); err != nil {
+			t.Errorf("expected %q to be ignored, got %v", r, err)
+		}
+	}
+	if m.Len() != 0 {
+		t.Errorf("expected no rules, got %d", m.Len())
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		p, s      string
+		anchorEnd bool
+		want      bool
+	}{
+		{"a*c", "abbbc", true, true},
+		{"a*c", "abbbcd", true, false},
+		{"a*c", "abbbcd", false, true},
+		{"a^", "a", true, true},
+		{"a^", "a/", false, true},
+		{"a^", "a-", false, false},
+		{"a^b", "a?b", true, true},
+		{"", "anything", false, true},
+	}
+	for _, tc := range tests {
+		if got := matchPattern(tc.p, tc.s, tc.anchorEnd); got != tc.want {
+			t.Errorf("matchPattern(%q, %q, %v) = %v", tc.p, tc.s, tc.anchorEnd, got)
+		}
+	}
+}
+
+func TestInstall(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer background.Close()
+
+	m := NewMatcher()
+	m.AddRule("/ads/")
+	proxy := goproxy.NewProxyHttpServer()
+	m.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for path, expected := range map[string]int{"/ads/1.png": http.StatusForbidden, "/img/1.png": http.StatusOK} {
+		resp, err := client.Get(background.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%s: expected status %d, got %d", path, expected, resp.StatusCode)
+		}
+	}
+}
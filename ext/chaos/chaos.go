@@ -0,0 +1,301 @@
+// Package chaos makes a goproxy misbehave on purpose, to test how clients
+// cope with slow, failing and broken upstream servers.
+//
+// Faults are attached to requests with rules, each rule firing with a given
+// probability for requests matching its condition:
+//
+//	inj := chaos.NewInjector(42)
+//	inj.Add(chaos.Rule{
+//		Cond:        goproxy.ReqHostIs("api.example.com:443"),
+//		Probability: 0.1,
+//		Fault:       chaos.ErrorStatus(http.StatusServiceUnavailable),
+//	})
+//	inj.Add(chaos.Rule{Probability: 0.5, Fault: chaos.Latency(200*time.Millisecond, 50*time.Millisecond)})
+//	inj.Install(proxy)
+//
+// Faults apply to plain HTTP as well as to MITM'd HTTPS requests. For websockets
+// they apply to the upgrade handshake, and the body faults to the stream of
+// frames the remote server sends once upgraded.
+package chaos
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ErrReset is the error a body broken by ResetMidBody fails with. The proxy
+// aborts the client connection when it sees it.
+var ErrReset = errors.New("chaos: connection reset")
+
+// Fault is something going wrong with a request. Faults are created by the
+// functions of this package, like Latency or Truncate.
+type Fault interface {
+	// onRequest is run before the request is sent upstream, it can delay
+	// it or return a response in its stead.
+	onRequest(req *http.Request, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response
+	// onResponse is run on the response from upstream.
+	onResponse(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response
+}
+
+// Rule fires Fault with the given Probability on requests matching Cond.
+type Rule struct {
+	// Cond selects the requests the rule applies to, nil matches all requests.
+	Cond goproxy.ReqCondition
+	// Probability of the fault firing for a matching request, between 0 and 1.
+	Probability float64
+	Fault       Fault
+}
+
+// Injector holds a set of rules and the random source deciding when they fire.
+type Injector struct {
+	mu    sync.Mutex
+	rnd   *rand.Rand
+	rules []Rule
+	// fired are the faults that fired for the requests waiting for their
+	// response
+	fired map[*goproxy.ProxyCtx][]Fault
+}
+
+// NewInjector returns an Injector without rules. The same seed and the same
+// sequence of requests always lead to the same faults, which keeps tests
+// deterministic.
+func NewInjector(seed int64) *Injector {
+	return &Injector{rnd: rand.New(rand.NewSource(seed)), fired: make(map[*goproxy.ProxyCtx][]Fault)}
+}
+
+// Add appends rules to the injector. It is safe to call while the proxy is running.
+func (inj *Injector) Add(rules ...Rule) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.rules = append(inj.rules, rules...)
+}
+
+// Reset removes all rules and reseeds the random source.
+func (inj *Injector) Reset(seed int64) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.rules = nil
+	inj.rnd = rand.New(rand.NewSource(seed))
+	inj.fired = make(map[*goproxy.ProxyCtx][]Fault)
+}
+
+func (inj *Injector) float64() float64 {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.rnd.Float64()
+}
+
+func (inj *Injector) int63n(n int64) int64 {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.rnd.Int63n(n)
+}
+
+func (inj *Injector) jitter(d, jitter time.Duration) time.Duration {
+	if jitter > 0 {
+		d += time.Duration(inj.int63n(int64(2*jitter))) - jitter
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (inj *Injector) firing(req *http.Request, ctx *goproxy.ProxyCtx) []Fault {
+	inj.mu.Lock()
+	rules := inj.rules
+	inj.mu.Unlock()
+	var faults []Fault
+	for _, rule := range rules {
+		if rule.Cond != nil && !rule.Cond.HandleReq(req, ctx) {
+			continue
+		}
+		if inj.float64() < rule.Probability {
+			faults = append(faults, rule.Fault)
+		}
+	}
+	return faults
+}
+
+// Handle decides which faults fire for req, and runs their request side. The
+// response side of the same faults is run by HandleResp, unless a fault
+// answered the request itself.
+func (inj *Injector) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	faults := inj.firing(req, ctx)
+	for _, f := range faults {
+		if resp := f.onRequest(req, ctx, inj); resp != nil {
+			return req, resp
+		}
+	}
+	if len(faults) > 0 {
+		inj.mu.Lock()
+		inj.fired[ctx] = faults
+		inj.mu.Unlock()
+	}
+	return req, nil
+}
+
+// HandleResp runs the response side of the faults Handle chose for the request
+// of resp. Nothing is done for failed requests.
+func (inj *Injector) HandleResp(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	inj.mu.Lock()
+	faults := inj.fired[ctx]
+	delete(inj.fired, ctx)
+	inj.mu.Unlock()
+	if resp == nil {
+		return resp
+	}
+	for _, f := range faults {
+		resp = f.onResponse(resp, ctx, inj)
+	}
+	return resp
+}
+
+// Install registers the injector on all requests and responses of proxy.
+func (inj *Injector) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(inj)
+	proxy.OnResponse().DoFunc(inj.HandleResp)
+}
+
+type requestFault func(req *http.Request, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response
+
+func (f requestFault) onRequest(req *http.Request, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+	return f(req, ctx, inj)
+}
+
+func (f requestFault) onResponse(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+	return resp
+}
+
+type responseFault func(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response
+
+func (f responseFault) onRequest(req *http.Request, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+	return nil
+}
+
+func (f responseFault) onResponse(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+	return f(resp, ctx, inj)
+}
+
+// Latency delays sending the request upstream by d, plus or minus a random
+// amount up to jitter.
+func Latency(d, jitter time.Duration) Fault {
+	return requestFault(func(req *http.Request, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+		wait := inj.jitter(d, jitter)
+		ctx.Logf("chaos: delaying request by %v", wait)
+		time.Sleep(wait)
+		return nil
+	})
+}
+
+// ErrorStatus answers the request with the given HTTP status, without
+// contacting the remote server.
+func ErrorStatus(code int) Fault {
+	return requestFault(func(req *http.Request, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+		ctx.Logf("chaos: answering with status %d", code)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, code, http.StatusText(code))
+	})
+}
+
+// SlowHeaders delays the response headers by d, plus or minus a random amount
+// up to jitter, after the remote server already answered.
+func SlowHeaders(d, jitter time.Duration) Fault {
+	return responseFault(func(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+		wait := inj.jitter(d, jitter)
+		ctx.Logf("chaos: delaying response headers by %v", wait)
+		time.Sleep(wait)
+		return resp
+	})
+}
+
+// ResetMidBody breaks the connection to the client after sending it n bytes
+// of the response body.
+func ResetMidBody(n int64) Fault {
+	return responseFault(func(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+		ctx.Logf("chaos: resetting connection after %d bytes", n)
+		wrapStream(resp, ctx, func(body io.ReadCloser) io.ReadCloser {
+			return &cutBody{body, n, ErrReset}
+		})
+		return resp
+	})
+}
+
+// Truncate ends the response body cleanly after n bytes.
+func Truncate(n int64) Fault {
+	return responseFault(func(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+		ctx.Logf("chaos: truncating response to %d bytes", n)
+		wrapStream(resp, ctx, func(body io.ReadCloser) io.ReadCloser {
+			return &cutBody{body, n, io.EOF}
+		})
+		return resp
+	})
+}
+
+// Corrupt flips a random bit in each byte of the response body with the
+// given probability.
+func Corrupt(rate float64) Fault {
+	return responseFault(func(resp *http.Response, ctx *goproxy.ProxyCtx, inj *Injector) *http.Response {
+		ctx.Logf("chaos: corrupting response body")
+		wrapStream(resp, ctx, func(body io.ReadCloser) io.ReadCloser {
+			return &corruptBody{body, rate, inj}
+		})
+		return resp
+	})
+}
+
+// wrapStream wraps the body of resp with wrap or, resp switching protocols,
+// the stream the remote server sends once upgraded.
+func wrapStream(resp *http.Response, ctx *goproxy.ProxyCtx, wrap func(io.ReadCloser) io.ReadCloser) {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = wrap(resp.Body)
+		return
+	}
+	upgraded := ctx.WrapUpgraded
+	ctx.WrapUpgraded = func(r io.Reader) io.Reader {
+		if upgraded != nil {
+			r = upgraded(r)
+		}
+		return wrap(ioutil.NopCloser(r))
+	}
+}
+
+type cutBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+type corruptBody struct {
+	io.ReadCloser
+	rate float64
+	inj  *Injector
+}
+
+func (b *corruptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	for i := 0; i < n; i++ {
+		if b.inj.float64() < b.rate {
+			p[i] ^= 1 << uint(b.inj.int63n(8))
+		}
+	}
+	return n, err
+}
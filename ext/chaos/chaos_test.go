@@ -0,0 +1,219 @@
+package chaos_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/chaos"
+)
+
+var body = strings.Repeat("0123456789", 1000)
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+func withInjector(inj *chaos.Injector) (*http.Client, func()) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	proxy := goproxy.NewProxyHttpServer()
+	inj.Install(proxy)
+	client, s := oneShotProxy(proxy)
+	return client, func() {
+		s.Close()
+		background.Close()
+	}
+}
+
+func get(t *testing.T, client *http.Client, u string) (int, string, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal("GET:", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b), err
+}
+
+func TestErrorStatusWithCondition(t *testing.T) {
+	inj := chaos.NewInjector(1)
+	inj.Add(chaos.Rule{Cond: goproxy.UrlHasPrefix("/fail"), Probability: 1, Fault: chaos.ErrorStatus(503)})
+	client, done := withInjector(inj)
+	defer done()
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer background.Close()
+
+	if code, _, _ := get(t, client, background.URL+"/fail"); code != 503 {
+		t.Error("expected 503 for /fail, got", code)
+	}
+	if code, b, _ := get(t, client, background.URL+"/ok"); code != 200 || b != body {
+		t.Error("expected untouched response for /ok, got", code)
+	}
+	// the later handlers still get the request
+	req := httptest.NewRequest("GET", background.URL+"/fail", nil)
+	if r, resp := inj.Handle(req, &goproxy.ProxyCtx{Req: req, Proxy: goproxy.NewProxyHttpServer()}); r != req || resp == nil || resp.StatusCode != 503 {
+		t.Errorf("expected the request to be returned with the 503, got %v", r)
+	}
+}
+
+func TestDeterministicSeed(t *testing.T) {
+	outcomes := func() string {
+		inj := chaos.NewInjector(7)
+		inj.Add(chaos.Rule{Probability: 0.5, Fault: chaos.ErrorStatus(500)})
+		client, done := withInjector(inj)
+		defer done()
+		background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer background.Close()
+		var seq []string
+		for i := 0; i < 20; i++ {
+			code, _, _ := get(t, client, background.URL)
+			seq = append(seq, http.StatusText(code))
+		}
+		return strings.Join(seq, ",")
+	}
+	first, second := outcomes(), outcomes()
+	if first != second {
+		t.Errorf("same seed gave different faults:\n%s\n%s", first, second)
+	}
+	if !strings.Contains(first, "OK") || !strings.Contains(first, "Internal Server Error") {
+		t.Error("expected a mix of faults and successes, got", first)
+	}
+}
+
+func TestBodyFaults(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer background.Close()
+
+	inj := chaos.NewInjector(1)
+	inj.Add(chaos.Rule{Cond: goproxy.UrlHasPrefix("/truncate"), Probability: 1, Fault: chaos.Truncate(10)},
+		chaos.Rule{Cond: goproxy.UrlHasPrefix("/reset"), Probability: 1, Fault: chaos.ResetMidBody(100)},
+		chaos.Rule{Cond: goproxy.UrlHasPrefix("/corrupt"), Probability: 1, Fault: chaos.Corrupt(1)},
+		chaos.Rule{Cond: goproxy.UrlHasPrefix("/slow"), Probability: 1, Fault: chaos.SlowHeaders(200*time.Millisecond, 0)})
+	client, done := withInjector(inj)
+	defer done()
+
+	if _, b, err := get(t, client, background.URL+"/truncate"); err != nil || b != body[:10] {
+		t.Errorf("expected truncated body, got %q %v", b, err)
+	}
+	// depending on buffering the reset is seen before or after the headers
+	if resp, err := client.Get(background.URL + "/reset"); err == nil {
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("expected broken body, got %d bytes", len(b))
+		}
+	}
+	_, b, err := get(t, client, background.URL+"/corrupt")
+	if err != nil || len(b) != len(body) {
+		t.Fatal("corrupted body should keep its size", len(b), err)
+	}
+	for i := range b {
+		if b[i] == body[i] {
+			t.Fatal("byte", i, "was not corrupted")
+		}
+	}
+	start := time.Now()
+	get(t, client, background.URL+"/slow")
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Error("slow headers arrived after", d)
+	}
+}
+
+func TestFaultsDecidedOnce(t *testing.T) {
+	inj := chaos.NewInjector(1)
+	var evaluated int
+	counting := goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		evaluated++
+		return true
+	})
+	inj.Add(
+		chaos.Rule{Cond: counting, Probability: 1, Fault: chaos.ErrorStatus(503)},
+		chaos.Rule{Probability: 1, Fault: chaos.Truncate(3)},
+	)
+	client, done := withInjector(inj)
+	defer done()
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer background.Close()
+
+	code, b, err := get(t, client, background.URL)
+	if code != 503 || b != http.StatusText(503) || err != nil {
+		t.Errorf("expected the synthetic response untouched, got %d %q %v", code, b, err)
+	}
+	if evaluated != 1 {
+		t.Errorf("expected the condition to be evaluated once, got %d", evaluated)
+	}
+}
+
+func TestWebsocketStreamFaults(t *testing.T) {
+	frames := "frames sent by the server"
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error("Hijack:", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		// answer once the frames of the client made it through the proxy
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Error("reading the frames of the client:", err)
+			return
+		}
+		io.WriteString(conn, frames)
+	}))
+	defer background.Close()
+	inj := chaos.NewInjector(1)
+	inj.Add(chaos.Rule{Probability: 1, Fault: chaos.Truncate(6)})
+	proxy := goproxy.NewProxyHttpServer()
+	inj.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest("GET", background.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("expected the upgrade to succeed, got", resp.Status)
+	}
+	io.WriteString(conn, "ping")
+	b, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != frames[:6] {
+		t.Errorf("expected the stream to be truncated, got %q", b)
+	}
+}
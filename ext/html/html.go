@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
 
@@ -83,6 +84,52 @@ func HandleStringReader(f func(r io.Reader, ctx *goproxy.ProxyCtx) io.Reader) go
 	})
 }
 
+// HandleRequestString is the request counterpart of HandleString. It converts a
+// request body of at most maxSize bytes to a utf8 string according to the charset
+// specified in the Content-Type header of the request, and encodes the string
+// returned by f back to that charset. Requests with a bigger body are answered
+// with 413 Request Entity Too Large.
+func HandleRequestString(maxSize int64, f func(s string, ctx *goproxy.ProxyCtx) string) goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		charsetName := strings.ToLower(params["charset"])
+		b, resp := goproxy.ReadRequestBody(req, maxSize)
+		if resp != nil {
+			return req, resp
+		}
+		if charsetName == "" || charsetName == "utf-8" {
+			goproxy.SetRequestBody(req, []byte(f(string(b), ctx)))
+			return req, nil
+		}
+		r, err := charset.NewReader(charsetName, bytes.NewReader(b))
+		if err != nil {
+			ctx.Warnf("Cannot convert from %v to utf-8: %v", charsetName, err)
+			return req, nil
+		}
+		s, err := ioutil.ReadAll(r)
+		if err != nil {
+			ctx.Warnf("Cannot convert from %v to utf-8: %v", charsetName, err)
+			return req, nil
+		}
+		var buf bytes.Buffer
+		w, err := charset.NewWriter(charsetName, &buf)
+		if err != nil {
+			ctx.Warnf("Can't translate to %v from utf-8: %v", charsetName, err)
+			return req, nil
+		}
+		if _, err := io.WriteString(w, f(string(s), ctx)); err != nil {
+			ctx.Warnf("Can't translate to %v from utf-8: %v", charsetName, err)
+			return req, nil
+		}
+		if err := w.Close(); err != nil {
+			ctx.Warnf("Can't translate to %v from utf-8: %v", charsetName, err)
+			return req, nil
+		}
+		goproxy.SetRequestBody(req, buf.Bytes())
+		return req, nil
+	})
+}
+
 type readFirstCloseBoth struct {
 	r io.ReadCloser
 	c io.Closer
@@ -0,0 +1,79 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// tcpPacket returns an IP packet holding a TCP segment. The packet is IPv6
+// unless both addresses are IPv4.
+func tcpPacket(src, dst *net.TCPAddr, seq, ack uint32, flags uint8, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // header of 5 words, without options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff) // window
+	copy(tcp[20:], payload)
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64                                 // TTL
+		ip[9] = 6                                  // TCP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+		pseudo := make([]byte, 12)
+		copy(pseudo, src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+		return append(ip, tcp...)
+	}
+
+	// IPv4 addresses are mapped to IPv6 ones for mixed connections
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6  // TCP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+
+	pseudo := make([]byte, 40)
+	copy(pseudo, ip[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+	pseudo[39] = 6
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	return append(ip, tcp...)
+}
+
+// sum returns the ones' complement sum of b, as 16 bit words
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b, RFC 1071, starting from
+// initial
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
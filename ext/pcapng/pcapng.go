@@ -0,0 +1,126 @@
+// Package pcapng records the traffic of a goproxy as PCAPNG captures, which
+// Wireshark and tshark open, HTTP dissection included.
+//
+// The requests and responses are written decrypted, MITM'd HTTPS included,
+// each request and its response on a TCP connection of its own, from the
+// address of the client to the one of the remote host. The packets are
+// synthetic: they carry the messages as HTTP/1.1 whatever the protocol used
+// with the client and the remote host, and their comments tell the session of
+// the request, as the proxy logs it.
+//
+//	rec, err := pcapng.NewFileRecorder("capture.pcapng", 100<<20, 10)
+//	...
+//	defer rec.Close()
+//	rec.Install(proxy)
+//
+// The bodies are written while they are sent, so long downloads and streams
+// are recorded as they go.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	blockSectionHeader  = 0x0a0d0d0a
+	blockInterface      = 0x00000001
+	blockEnhancedPacket = 0x00000006
+
+	byteOrderMagic       = 0x1a2b3c4d
+	sectionLengthUnknown = 0xffffffffffffffff
+	linkTypeRaw          = 101     // IPv4 or IPv6 packets, without link layer
+	timestampsPerSecond  = 1000000 // the default resolution, microseconds
+
+	optEndOfOpt     = 0
+	optComment      = 1
+	optIfName       = 2
+	optSHBUserAppl  = 4
+	maxOptionLength = 0xffff
+)
+
+// Writer writes IP packets as a PCAPNG capture of a single interface.
+type Writer struct {
+	w    io.Writer
+	size int64
+}
+
+// NewWriter writes the header of the capture to w, and returns a Writer
+// writing the packets after it.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{w: w}
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb, byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // version 1.0
+	binary.LittleEndian.PutUint64(shb[8:], sectionLengthUnknown)
+	shb = appendOption(shb, optSHBUserAppl, "goproxy")
+	if err := pw.writeBlock(blockSectionHeader, endOptions(shb)); err != nil {
+		return nil, err
+	}
+	// a snap length of zero means none
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb, linkTypeRaw)
+	idb = appendOption(idb, optIfName, "goproxy")
+	if err := pw.writeBlock(blockInterface, endOptions(idb)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Size returns the number of bytes written.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// WritePacket writes the IPv4 or IPv6 packet captured at t, with comment if
+// it is not empty.
+func (w *Writer) WritePacket(t time.Time, packet []byte, comment string) error {
+	ts := uint64(t.UnixNano() / (1e9 / timestampsPerSecond))
+	epb := make([]byte, 20, 20+len(packet)+3+8+len(comment))
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(packet)))
+	epb = pad(append(epb, packet...))
+	if comment != "" {
+		epb = endOptions(appendOption(epb, optComment, comment))
+	}
+	return w.writeBlock(blockEnhancedPacket, epb)
+}
+
+// writeBlock writes a block made of body, whose length is a multiple of 4
+func (w *Writer) writeBlock(typ uint32, body []byte) error {
+	block := make([]byte, 8, 12+len(body))
+	length := uint32(12 + len(body))
+	binary.LittleEndian.PutUint32(block, typ)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	block = append(block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(block[len(block)-4:], length)
+	n, err := w.w.Write(block)
+	w.size += int64(n)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value string) []byte {
+	if len(value) > maxOptionLength {
+		value = value[:maxOptionLength]
+	}
+	var h [4]byte
+	binary.LittleEndian.PutUint16(h[:], code)
+	binary.LittleEndian.PutUint16(h[2:], uint16(len(value)))
+	return pad(append(append(b, h[:]...), value...))
+}
+
+func endOptions(b []byte) []byte {
+	return append(b, optEndOfOpt, 0, 0, 0)
+}
+
+// pad pads b to a multiple of 4 bytes
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
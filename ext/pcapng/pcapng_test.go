@@ -0,0 +1,255 @@
+package pcapng_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/pcapng"
+)
+
+type packet struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	payload          []byte
+	comment          string
+}
+
+// readCapture parses the packets of a capture written by a Recorder
+func readCapture(t *testing.T, b []byte) []packet {
+	var packets []packet
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block %x", b)
+		}
+		typ, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if binary.LittleEndian.Uint32(b[length-4:]) != length {
+			t.Fatalf("block lengths differ")
+		}
+		body := b[8 : length-4]
+		b = b[length:]
+		switch typ {
+		case 0x0a0d0d0a:
+			if binary.LittleEndian.Uint32(body) != 0x1a2b3c4d {
+				t.Fatalf("bad byte order magic %x", body[:4])
+			}
+		case 1:
+			if binary.LittleEndian.Uint16(body) != 101 {
+				t.Fatalf("unexpected link type %d", binary.LittleEndian.Uint16(body))
+			}
+		case 6:
+			n := binary.LittleEndian.Uint32(body[12:])
+			data := body[20 : 20+n]
+			opts := body[20+(n+3)/4*4:]
+			var p packet
+			for len(opts) >= 4 && binary.LittleEndian.Uint16(opts) != 0 {
+				l := binary.LittleEndian.Uint16(opts[2:])
+				if binary.LittleEndian.Uint16(opts) == 1 {
+					p.comment = string(opts[4 : 4+l])
+				}
+				opts = opts[4+(l+3)/4*4:]
+			}
+			if data[0]>>4 != 4 || ipChecksum(data[:20]) != 0 {
+				t.Fatalf("bad IPv4 header %x", data[:20])
+			}
+			tcp := data[20:]
+			p.srcPort, p.dstPort = binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:])
+			p.seq, p.ack = binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:])
+			p.flags = tcp[13]
+			p.payload = tcp[20:]
+			packets = append(packets, p)
+		default:
+			t.Fatalf("unexpected block type %x", typ)
+		}
+	}
+	return packets
+}
+
+func ipChecksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+func TestRecorder(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	var capture bytes.Buffer
+	rec, err := pcapng.NewRecorder(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	rec.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Post(backend.URL+"/upload", "text/plain", strings.NewReader("request body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != body {
+		t.Fatal("unexpected body")
+	}
+	rec.Close()
+
+	packets := readCapture(t, capture.Bytes())
+	if len(packets) == 0 || packets[0].flags != 0x02 || !strings.HasPrefix(packets[0].comment, "session ") {
+		t.Fatalf("expected a SYN with the session first, got %+v", packets)
+	}
+	clientPort := packets[0].srcPort
+	// the decrypted HTTPS traffic is written on port 80
+	if packets[0].dstPort != 80 {
+		t.Errorf("unexpected port %d", packets[0].dstPort)
+	}
+	if len(packets) < 3 || packets[1].flags != 0x12 || packets[2].flags != 0x10 {
+		t.Fatalf("expected a SYN-ACK and an ACK after the SYN, got %+v", packets)
+	}
+	var sent, received []byte
+	var fins int
+	// the next sequence numbers of the client and of the remote host, the
+	// SYNs and the FINs counting as one byte
+	next := map[bool]uint32{true: packets[0].seq, false: packets[1].seq}
+	for i, p := range packets {
+		fromClient := p.srcPort == clientPort
+		if fromClient {
+			sent = append(sent, p.payload...)
+		} else {
+			received = append(received, p.payload...)
+		}
+		if p.seq != next[fromClient] {
+			t.Errorf("packet %d: expected seq %d, got %d", i, next[fromClient], p.seq)
+		}
+		if p.flags&0x10 != 0 && p.ack != next[!fromClient] {
+			t.Errorf("packet %d: expected ack %d, got %d", i, next[!fromClient], p.ack)
+		}
+		next[fromClient] = p.seq + uint32(len(p.payload))
+		if p.flags&0x03 != 0 {
+			next[fromClient]++
+		}
+		if p.flags&0x01 != 0 {
+			fins++
+		}
+	}
+	if !strings.HasPrefix(string(sent), "POST /upload HTTP/1.1\r\n") || !strings.HasSuffix(string(sent), "\r\n\r\nrequest body") {
+		t.Errorf("unexpected request %q", sent)
+	}
+	if !strings.HasPrefix(string(received), "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(string(received), "\r\n\r\n"+body) {
+		t.Errorf("unexpected response of %d bytes, starting with %q", len(received), received[:64])
+	}
+	if fins != 2 {
+		t.Errorf("expected the connection to be closed, got %d FINs", fins)
+	}
+}
+
+func TestFileRecorderRotation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 5000))
+	}))
+	defer backend.Close()
+	dir, err := ioutil.TempDir("", "goproxy-pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := pcapng.NewFileRecorder(filepath.Join(dir, "capture.pcapng"), 4000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	rec.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	rec.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "capture-*.pcapng"))
+	if len(files) != 2 {
+		t.Fatalf("expected the last 2 files, got %v", files)
+	}
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readCapture(t, b)
+	}
+	if strings.HasSuffix(files[0], "-000001.pcapng") {
+		t.Errorf("expected the first files to be removed, got %v", files)
+	}
+}
+
+func TestRecorderFailedMitmRequest(t *testing.T) {
+	// a host refusing the connections of the proxy
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backendURL := backend.URL
+	backend.Close()
+
+	var capture bytes.Buffer
+	rec, err := pcapng.NewRecorder(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	rec.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.CloseIdleConnections()
+	if resp, err := (&http.Client{Transport: tr}).Get(backendURL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the request to fail")
+	}
+	rec.Close()
+
+	var resets int
+	for _, p := range readCapture(t, capture.Bytes()) {
+		if p.flags&0x04 != 0 {
+			resets++
+		}
+	}
+	if resets != 1 {
+		t.Errorf("expected the failed request to be recorded as a reset, got %d resets", resets)
+	}
+}
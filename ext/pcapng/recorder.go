@@ -0,0 +1,491 @@
+package pcapng
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ErrClosed is returned when writing to a closed Recorder.
+var ErrClosed = errors.New("pcapng: recorder closed")
+
+// Recorder writes the requests of a proxy and their responses as TCP
+// connections to a PCAPNG capture.
+type Recorder struct {
+	// DecryptedPort is the port of the remote host the decrypted HTTPS
+	// requests are written with, since Wireshark dissects the traffic of
+	// port 443 as TLS. It is 80 if zero, and a negative value keeps the port
+	// of the remote host.
+	DecryptedPort int
+
+	mu      sync.Mutex
+	w       *Writer
+	file    io.Closer
+	next    func() (io.WriteCloser, error)
+	maxSize int64
+	flows   map[*goproxy.ProxyCtx]*flow
+	closed  bool
+}
+
+// NewRecorder returns a Recorder writing a single capture to w.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	pw, err := NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{w: pw, flows: make(map[*goproxy.ProxyCtx]*flow)}
+	if c, ok := w.(io.Closer); ok {
+		r.file = c
+	}
+	return r, nil
+}
+
+// NewFileRecorder returns a Recorder writing to a new file, named after path
+// with a sequence number, once the current one reaches maxSize bytes:
+// capture-000001.pcapng, capture-000002.pcapng and so on for capture.pcapng.
+// Only the last maxFiles files are kept, all of them if maxFiles is zero.
+// When maxSize is zero, the capture is written to path as a single file.
+func NewFileRecorder(path string, maxSize int64, maxFiles int) (*Recorder, error) {
+	if maxSize <= 0 {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		r, err := NewRecorder(f)
+		if err != nil {
+			f.Close()
+		}
+		return r, err
+	}
+
+	ext := filepath.Ext(path)
+	base := path[:len(path)-len(ext)]
+	var seq int
+	var files []string
+	next := func() (io.WriteCloser, error) {
+		seq++
+		name := fmt.Sprintf("%s-%06d%s", base, seq, ext)
+		f, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, name)
+		if maxFiles > 0 && len(files) > maxFiles {
+			os.Remove(files[0])
+			files = files[1:]
+		}
+		return f, nil
+	}
+	r := &Recorder{next: next, maxSize: maxSize, flows: make(map[*goproxy.ProxyCtx]*flow)}
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rotate starts the next file. Caller must hold r.mu.
+func (r *Recorder) rotate() error {
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			return err
+		}
+		r.file = nil
+	}
+	f, err := r.next()
+	if err != nil {
+		return err
+	}
+	if r.w, err = NewWriter(f); err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	return nil
+}
+
+// Close stops the recording and closes the file it is written to. The
+// requests in progress are not written further.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.flows = nil
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
+
+// Handle starts recording req, its body being written as the proxy sends it.
+func (r *Recorder) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	f := &flow{rec: r, ctx: ctx, desc: req.Method + " " + req.URL.String()}
+	f.client = tcpAddr(req.RemoteAddr)
+	f.reqHead, f.reqChunked = requestHead(req)
+	// the address of the remote host, from the connection the request
+	// is sent through
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if !f.started {
+				f.remote = info.Conn.RemoteAddr()
+			}
+		},
+	}))
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &bodyRecorder{ReadCloser: req.Body, f: f, request: true}
+	} else {
+		f.reqDone = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.flows != nil {
+		r.flows[ctx] = f
+	}
+	return req, nil
+}
+
+// HandleResp records resp, its body being written as the proxy sends it. A
+// failed request is recorded as a reset connection.
+func (r *Recorder) HandleResp(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.flows[ctx]
+	if f == nil {
+		return resp
+	}
+	f.start()
+	if resp == nil {
+		f.write(false, flagRST|flagACK, nil, "")
+		delete(r.flows, ctx)
+		return resp
+	}
+
+	head, chunked := responseHead(resp, ctx.Req)
+	f.respChunked = chunked
+	status := resp.Status
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	f.write(false, flagPSH|flagACK, head, fmt.Sprintf("session %d: %s", ctx.Session, status))
+	if resp.Body == nil || resp.Body == http.NoBody || !hasBody(resp, ctx.Req) {
+		f.finish()
+		delete(r.flows, ctx)
+		return resp
+	}
+	resp.Body = &bodyRecorder{ReadCloser: resp.Body, f: f}
+	return resp
+}
+
+// Install records all the requests of proxy and their responses. Other
+// handlers may change them before or after they are recorded, depending on
+// whether they were added first.
+func (r *Recorder) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(r)
+	proxy.OnResponse().DoFunc(r.HandleResp)
+}
+
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagPSH = 0x08
+	flagACK = 0x10
+
+	maxSegment = 1460
+)
+
+// flow is the TCP connection a request and its response are written on
+type flow struct {
+	rec            *Recorder
+	ctx            *goproxy.ProxyCtx
+	desc           string
+	client, server *net.TCPAddr
+	remote         net.Addr
+	clientSeq      uint32
+	serverSeq      uint32
+
+	reqHead     []byte
+	reqChunked  bool
+	respChunked bool
+	started     bool
+	reqDone     bool
+	done        bool
+}
+
+// start writes the handshake and the head of the request, once the address
+// of the remote host is known. Caller must hold f.rec.mu.
+func (f *flow) start() {
+	if f.started {
+		return
+	}
+	f.started = true
+	f.server = f.serverAddr()
+	// TCP sequence numbers start at random values, the session makes
+	// consecutive connections of a client distinct
+	f.clientSeq = uint32(f.ctx.Session) << 20
+	f.serverSeq = ^f.clientSeq
+	comment := fmt.Sprintf("session %d", f.ctx.Session)
+	// the SYNs count as one byte
+	f.write(true, flagSYN, nil, comment)
+	f.clientSeq++
+	f.write(false, flagSYN|flagACK, nil, "")
+	f.serverSeq++
+	f.write(true, flagACK, nil, "")
+	f.write(true, flagPSH|flagACK, f.reqHead, comment+": "+f.desc)
+	if f.reqDone && f.reqChunked {
+		f.write(true, flagPSH|flagACK, []byte("0\r\n\r\n"), "")
+	}
+}
+
+func (f *flow) serverAddr() *net.TCPAddr {
+	req := f.ctx.Req
+	addr := &net.TCPAddr{IP: net.IPv4zero}
+	if a, ok := f.remote.(*net.TCPAddr); ok {
+		addr.IP, addr.Port = a.IP, a.Port
+	} else if len(f.ctx.ResolvedIPs) > 0 {
+		addr.IP = f.ctx.ResolvedIPs[0]
+	} else if ip := net.ParseIP(req.URL.Hostname()); ip != nil {
+		addr.IP = ip
+	}
+	if addr.Port == 0 {
+		addr.Port, _ = strconv.Atoi(req.URL.Port())
+	}
+	if addr.Port == 0 {
+		addr.Port = 80
+		if req.URL.Scheme == "https" {
+			addr.Port = 443
+		}
+	}
+	if req.URL.Scheme == "https" && f.rec.DecryptedPort >= 0 {
+		addr.Port = f.rec.DecryptedPort
+		if addr.Port == 0 {
+			addr.Port = 80
+		}
+	}
+	return addr
+}
+
+// body writes the data of a body, in a chunk of the chunked encoding when it
+// is used. Caller must hold f.rec.mu.
+func (f *flow) body(request bool, data []byte) {
+	chunked := f.respChunked
+	if request {
+		chunked = f.reqChunked
+	}
+	if chunked {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%x\r\n", len(data))
+		b.Write(data)
+		b.WriteString("\r\n")
+		data = b.Bytes()
+	}
+	f.write(request, flagPSH|flagACK, data, "")
+}
+
+// endBody ends a body. Caller must hold f.rec.mu.
+func (f *flow) endBody(request bool) {
+	if request {
+		if f.reqDone {
+			return
+		}
+		f.reqDone = true
+		if f.started && f.reqChunked {
+			f.write(true, flagPSH|flagACK, []byte("0\r\n\r\n"), "")
+		}
+		return
+	}
+	if f.respChunked {
+		f.write(false, flagPSH|flagACK, []byte("0\r\n\r\n"), "")
+	}
+	f.finish()
+}
+
+// finish closes the connection, the remote host first. Caller must hold
+// f.rec.mu.
+func (f *flow) finish() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.write(false, flagFIN|flagACK, nil, "")
+	f.serverSeq++
+	f.write(true, flagFIN|flagACK, nil, "")
+	f.clientSeq++
+	f.write(false, flagACK, nil, "")
+}
+
+// write writes data from the client or from the remote host, in segments.
+// Caller must hold f.rec.mu.
+func (f *flow) write(fromClient bool, flags uint8, data []byte, comment string) {
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > maxSegment {
+			n = maxSegment
+		}
+		src, dst, seq, ack := f.client, f.server, &f.clientSeq, f.serverSeq
+		if !fromClient {
+			src, dst, seq, ack = f.server, f.client, &f.serverSeq, f.clientSeq
+		}
+		if flags&flagACK == 0 {
+			ack = 0
+		}
+		packet := tcpPacket(src, dst, *seq, ack, flags, data[:n])
+		*seq += uint32(n)
+		data = data[n:]
+		if err := f.rec.writePacket(packet, comment); err != nil {
+			if err != ErrClosed {
+				f.ctx.Warnf("pcapng: %v", err)
+			}
+			return
+		}
+		comment = ""
+	}
+}
+
+// writePacket writes packet to the current file, starting the next one when
+// it is full. Caller must hold r.mu.
+func (r *Recorder) writePacket(packet []byte, comment string) error {
+	if r.closed {
+		return ErrClosed
+	}
+	if r.maxSize > 0 && r.w.Size() >= r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	return r.w.WritePacket(time.Now(), packet, comment)
+}
+
+// bodyRecorder writes a body as it is read
+type bodyRecorder struct {
+	io.ReadCloser
+	f       *flow
+	request bool
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	rec := b.f.rec
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !b.f.done {
+		// the connection is known once the request body is sent
+		b.f.start()
+		if n > 0 {
+			b.f.body(b.request, p[:n])
+		}
+		if err == io.EOF {
+			b.end()
+		}
+	}
+	return n, err
+}
+
+func (b *bodyRecorder) Close() error {
+	rec := b.f.rec
+	rec.mu.Lock()
+	if b.f.started {
+		b.end()
+	} else {
+		b.f.reqDone = true
+	}
+	rec.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// end ends the body. Caller must hold b.f.rec.mu.
+func (b *bodyRecorder) end() {
+	b.f.endBody(b.request)
+	if !b.request && b.f.rec.flows != nil {
+		delete(b.f.rec.flows, b.f.ctx)
+	}
+}
+
+func tcpAddr(hostport string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(hostport)
+	addr := &net.TCPAddr{IP: net.IPv4zero}
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP = ip
+	}
+	addr.Port, _ = strconv.Atoi(port)
+	return addr
+}
+
+// requestHead returns the head of req as sent in HTTP/1.1, and whether its
+// body is chunked
+func requestHead(req *http.Request) ([]byte, bool) {
+	var b bytes.Buffer
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), host)
+	h := req.Header.Clone()
+	h.Del("Host")
+	h.Del("Content-Length")
+	h.Del("Transfer-Encoding")
+	chunked := false
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength >= 0 {
+			h.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+		} else {
+			h.Set("Transfer-Encoding", "chunked")
+			chunked = true
+		}
+	}
+	h.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes(), chunked
+}
+
+// responseHead returns the head of resp as sent in HTTP/1.1, and whether its
+// body is chunked
+func responseHead(resp *http.Response, req *http.Request) ([]byte, bool) {
+	var b bytes.Buffer
+	status := resp.Status
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+	fmt.Fprintf(&b, "HTTP/1.1 %s\r\n", status)
+	h := resp.Header.Clone()
+	chunked := false
+	if hasBody(resp, req) && resp.Body != nil && resp.Body != http.NoBody {
+		h.Del("Content-Length")
+		h.Del("Transfer-Encoding")
+		if resp.ContentLength >= 0 {
+			h.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		} else {
+			h.Set("Transfer-Encoding", "chunked")
+			chunked = true
+		}
+	}
+	h.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes(), chunked
+}
+
+func hasBody(resp *http.Response, req *http.Request) bool {
+	if req != nil && req.Method == "HEAD" {
+		return false
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
@@ -2,7 +2,12 @@ package goproxy
 
 import (
 	"bufio"
+	"context"
+	"crypto"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -15,6 +20,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ConnectActionLiteral int
@@ -36,6 +42,10 @@ var (
 	httpsRegexp     = regexp.MustCompile(`^https:\/\/`)
 )
 
+// defaultTLSHandshakeTimeout bounds the TLS handshakes of the proxy with the
+// remote hosts when Tr doesn't, as the one of http.DefaultTransport
+var defaultTLSHandshakeTimeout = 10 * time.Second
+
 // ConnectAction enables the caller to override the standard connect flow.
 // When Action is ConnectHijack, it is up to the implementer to send the
 // HTTP 200, or any other valid http response back to the client from within the
@@ -44,6 +54,10 @@ type ConnectAction struct {
 	Action    ConnectActionLiteral
 	Hijack    func(req *http.Request, client net.Conn, ctx *ProxyCtx)
 	TLSConfig func(host string, ctx *ProxyCtx) (*tls.Config, error)
+	// UploadLimiter and DownloadLimiter, if not nil, throttle the data a
+	// ConnectAccept tunnel sends to the remote host and to the client respectively.
+	UploadLimiter   *RateLimiter
+	DownloadLimiter *RateLimiter
 }
 
 func stripPort(s string) string {
@@ -54,16 +68,33 @@ func stripPort(s string) string {
 	return s[:ix]
 }
 
-func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
-	if proxy.Tr.Dial != nil {
+func (proxy *ProxyHttpServer) dial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	dc := context.Background()
+	if ctx != nil {
+		var trace *requestTrace
+		dc, trace = ctx.context()
+		defer func() {
+			if c != nil {
+				trace.use(c)
+			}
+			trace.save(ctx)
+		}()
+	}
+	if proxy.ConnectDialer != nil {
+		return proxy.ConnectDialer.DialContext(dc, network, addr)
+	}
+	if proxy.Tr != nil && proxy.Tr.Dial != nil {
 		return proxy.Tr.Dial(network, addr)
 	}
-	return net.Dial(network, addr)
+	if proxy.Tr != nil && proxy.Tr.DialContext != nil {
+		return proxy.Tr.DialContext(dc, network, addr)
+	}
+	return proxy.DialContext(dc, network, addr)
 }
 
-func (proxy *ProxyHttpServer) connectDial(network, addr string) (c net.Conn, err error) {
+func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
 	if proxy.ConnectDial == nil {
-		return proxy.dial(network, addr)
+		return proxy.dial(ctx, network, addr)
 	}
 	return proxy.ConnectDial(network, addr)
 }
@@ -77,7 +108,8 @@ type halfClosable interface {
 var _ halfClosable = (*net.TCPConn)(nil)
 
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore,
+		Timings: Timings{Start: time.Now()}}
 
 	hij, ok := w.(http.Hijacker)
 	if !ok {
@@ -106,29 +138,42 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
-		targetSiteCon, err := proxy.connectDial("tcp", host)
+		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
 		if err != nil {
 			httpError(proxyClient, ctx, err)
 			return
 		}
 		ctx.Logf("Accepting CONNECT to %s", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		tunnelStart := time.Now()
 
 		targetTCP, targetOK := targetSiteCon.(halfClosable)
 		proxyClientTCP, clientOK := proxyClient.(halfClosable)
 		if targetOK && clientOK {
-			go copyAndClose(ctx, targetTCP, proxyClientTCP)
-			go copyAndClose(ctx, proxyClientTCP, targetTCP)
+			go func() {
+				var wg sync.WaitGroup
+				wg.Add(2)
+				go func() {
+					copyAndClose(ctx, targetTCP, proxyClientTCP, todo.UploadLimiter)
+					wg.Done()
+				}()
+				go func() {
+					copyAndClose(ctx, proxyClientTCP, targetTCP, todo.DownloadLimiter)
+					wg.Done()
+				}()
+				wg.Wait()
+				ctx.finishTimings(tunnelStart)
+			}()
 		} else {
 			go func() {
 				var wg sync.WaitGroup
 				wg.Add(2)
-				go copyOrWarn(ctx, targetSiteCon, proxyClient, &wg)
-				go copyOrWarn(ctx, proxyClient, targetSiteCon, &wg)
+				go copyOrWarn(ctx, targetSiteCon, proxyClient, todo.UploadLimiter, &wg)
+				go copyOrWarn(ctx, proxyClient, targetSiteCon, todo.DownloadLimiter, &wg)
 				wg.Wait()
 				proxyClient.Close()
 				targetSiteCon.Close()
-
+				ctx.finishTimings(tunnelStart)
 			}()
 		}
 
@@ -137,7 +182,7 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	case ConnectHTTPMitm:
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
-		targetSiteCon, err := proxy.connectDial("tcp", host)
+		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
 		if err != nil {
 			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
 			return
@@ -187,18 +232,29 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				return
 			}
 		}
+		if proxy.KeyLog.logs(r, ctx) {
+			tlsConfig = proxy.KeyLog.withKeyLog(tlsConfig)
+		}
 		go func() {
 			//TODO: cache connections to the remote website
-			rawClientTls := tls.Server(proxyClient, tlsConfig)
+			hello := &helloConn{Conn: proxyClient}
+			rawClientTls := tls.Server(hello, tlsConfig)
 			if err := rawClientTls.Handshake(); err != nil {
 				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
 				return
 			}
+			if clientHello, err := hello.clientHello(); err != nil {
+				ctx.Warnf("Cannot parse the ClientHello of %v: %v", r.Host, err)
+			} else {
+				ctx.ClientHello = clientHello
+			}
 			defer rawClientTls.Close()
 			clientTlsReader := bufio.NewReader(rawClientTls)
 			for !isEof(clientTlsReader) {
 				req, err := http.ReadRequest(clientTlsReader)
-				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData}
+				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData,
+					Resolver: ctx.Resolver, SourceIP: ctx.SourceIP, SourceInterface: ctx.SourceInterface,
+					Timings: Timings{Start: time.Now()}, User: ctx.User, ClientHello: ctx.ClientHello}
 				if err != nil && err != io.EOF {
 					return
 				}
@@ -221,17 +277,27 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				if resp == nil {
 					if isWebSocketRequest(req) {
 						ctx.Logf("Request looks like websocket upgrade.")
-						proxy.serveWebsocketTLS(ctx, w, req, tlsConfig, rawClientTls)
+						proxy.serveWebsocketTLS(ctx, w, req, rawClientTls)
 						return
 					}
 					if err != nil {
 						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
+						ctx.Error = err
+						proxy.filterResponse(nil, ctx)
 						return
 					}
 					removeProxyHeaders(ctx, req)
 					resp, err = ctx.RoundTrip(req)
-					if err != nil {
+					var certErr *UpstreamCertError
+					if errors.As(err, &certErr) {
+						ctx.Warnf("Rejected the certificate of mitm'd server %v", err)
+						ctx.Error = err
+						resp = certErrorResponse(req, certErr)
+					} else if err != nil {
 						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
+						// the response handlers see every request fail
+						ctx.Error = err
+						proxy.filterResponse(nil, ctx)
 						return
 					}
 					ctx.Logf("resp %v", resp.Status)
@@ -264,7 +330,10 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					return
 				}
 				chunked := newChunkedWriter(rawClientTls)
-				if _, err := io.Copy(chunked, resp.Body); err != nil {
+				bodyStart := time.Now()
+				_, err = io.Copy(chunked, resp.Body)
+				ctx.finishTimings(bodyStart)
+				if err != nil {
 					ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
 					return
 				}
@@ -301,15 +370,15 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 	}
 }
 
-func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, wg *sync.WaitGroup) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, limiter *RateLimiter, wg *sync.WaitGroup) {
+	if _, err := io.Copy(dst, NewLimitedReader(src, limiter)); err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 	wg.Done()
 }
 
-func copyAndClose(ctx *ProxyCtx, dst, src halfClosable) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, limiter *RateLimiter) {
+	if _, err := io.Copy(dst, NewLimitedReader(src, limiter)); err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 
@@ -317,6 +386,18 @@ func copyAndClose(ctx *ProxyCtx, dst, src halfClosable) {
 	src.CloseRead()
 }
 
+// upstreamTLSConfig returns the TLS configuration to connect to an upstream
+// proxy, the one of the transport of the proxy if it has one
+func (proxy *ProxyHttpServer) upstreamTLSConfig() *tls.Config {
+	if tr, ok := proxy.Transport.(*http.Transport); ok {
+		return tr.TLSClientConfig
+	}
+	if proxy.Tr != nil {
+		return proxy.Tr.TLSClientConfig
+	}
+	return nil
+}
+
 func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn, error) {
 	https_proxy := os.Getenv("HTTPS_PROXY")
 	if https_proxy == "" {
@@ -351,7 +432,7 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 			if connectReqHandler != nil {
 				connectReqHandler(connectReq)
 			}
-			c, err := proxy.dial(network, u.Host)
+			c, err := proxy.dial(nil, network, u.Host)
 			if err != nil {
 				return nil, err
 			}
@@ -382,11 +463,11 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 			u.Host += ":443"
 		}
 		return func(network, addr string) (net.Conn, error) {
-			c, err := proxy.dial(network, u.Host)
+			c, err := proxy.dial(nil, network, u.Host)
 			if err != nil {
 				return nil, err
 			}
-			c = tls.Client(c, proxy.Tr.TLSClientConfig)
+			c = tls.Client(c, proxy.upstreamTLSConfig())
 			connectReq := &http.Request{
 				Method: "CONNECT",
 				URL:    &url.URL{Opaque: addr},
@@ -428,12 +509,21 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 
 		hostname := stripPort(host)
 		config := defaultTLSConfig.Clone()
+		if ctx.Proxy.MitmTLSConfig != nil {
+			config = ctx.Proxy.MitmTLSConfig.Clone()
+		}
 		ctx.Logf("signing for %s", stripPort(host))
 
+		signer := ca
+		if ca == &GoproxyCa && ctx.Proxy.CA != nil {
+			signer = ctx.Proxy.CA
+		}
 		genCert := func() (*tls.Certificate, error) {
-			return signHost(*ca, []string{hostname})
+			return ctx.signCert(signer, []string{hostname}, ctx.Proxy.CertProfile, nil)
 		}
-		if ctx.certStore != nil {
+		if profile := ctx.Proxy.CertProfile; profile != nil && profile.MirrorUpstream {
+			cert, err = ctx.mirrorCert(host, signer, profile)
+		} else if ctx.certStore != nil {
 			cert, err = ctx.certStore.Fetch(hostname, genCert)
 		} else {
 			cert, err = genCert()
@@ -448,3 +538,116 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 		return config, nil
 	}
 }
+
+// signCert signs a certificate with signer, with a key of the KeyPool of the
+// proxy if it has one, see signHostProfile.
+func (ctx *ProxyCtx) signCert(signer *tls.Certificate, hosts []string, profile *CertProfile, upstream *x509.Certificate) (*tls.Certificate, error) {
+	start := time.Now()
+	var key crypto.Signer
+	if pool := ctx.Proxy.KeyPool; pool != nil {
+		var err error
+		if key, err = pool.Get(); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := signHostProfile(*signer, hosts, profile, upstream, key)
+	if err == nil {
+		names := hosts
+		if upstream != nil {
+			names = upstream.DNSNames
+		}
+		ctx.Logf("Signed certificate for %v in %v", names, time.Since(start))
+	}
+	return cert, err
+}
+
+// mirrorCert returns a certificate signed by signer copying the certificate
+// of host.
+func (ctx *ProxyCtx) mirrorCert(host string, signer *tls.Certificate, profile *CertProfile) (*tls.Certificate, error) {
+	hostname := stripPort(host)
+	upstream, err := ctx.upstreamCert(host)
+	if err != nil {
+		ctx.Warnf("Cannot get the certificate of %s, signing for the host name: %v", host, err)
+		return ctx.signCert(signer, []string{hostname}, profile, nil)
+	}
+	genCert := func() (*tls.Certificate, error) {
+		return ctx.signCert(signer, []string{hostname}, profile, upstream)
+	}
+	if ctx.certStore == nil {
+		return genCert()
+	}
+	fingerprint := sha256.Sum256(upstream.Raw)
+	key := "sha256-" + hex.EncodeToString(fingerprint[:])
+	if upstream.VerifyHostname(hostname) != nil {
+		// the certificate names the host too
+		key += "-" + hostname
+	}
+	return ctx.certStore.Fetch(key, genCert)
+}
+
+// upstreamCert returns the certificate host presents, when asked for its
+// host name. The certificate is checked as Tr checks the ones of the requests,
+// so that the certificates of impostors are not mirrored when Tr applies a
+// VerifyPolicy.
+func (ctx *ProxyCtx) upstreamCert(host string) (*x509.Certificate, error) {
+	if !hasPort.MatchString(host) {
+		host += ":443"
+	}
+	c, err := ctx.Proxy.connectDial(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ctx.Proxy.tlsHandshakeTimeout()))
+	config, err := ctx.upstreamTLSConfig(stripPort(host))
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(c, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn.ConnectionState().PeerCertificates[0], nil
+}
+
+// upstreamTLSConfig returns the configuration of the TLS connections the proxy
+// makes itself to hostname, for websockets and mirrored certificates. The
+// certificates are checked as Tr does, and the client certificate and key log
+// are the ones of the request of ctx.
+func (ctx *ProxyCtx) upstreamTLSConfig(hostname string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if tr := ctx.Proxy.Tr; tr != nil && tr.TLSClientConfig != nil {
+		config = tr.TLSClientConfig.Clone()
+	}
+	config.ServerName = hostname
+	if verify := config.VerifyConnection; verify != nil {
+		// as VerifyPolicy.Apply, tell the name of the hosts given by their
+		// IP address, which the connection state lacks
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			cs.ServerName = hostname
+			return verify(cs)
+		}
+	}
+	if ctx.Proxy.ClientCerts != nil {
+		cert, err := ctx.Proxy.ClientCerts.SelectClientCert(hostname, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			config.GetClientCertificate = clientCertFunc(cert)
+		}
+	}
+	if ctx.Proxy.KeyLog.logs(ctx.Req, ctx) {
+		config.KeyLogWriter = ctx.Proxy.KeyLog
+	}
+	return config, nil
+}
+
+// tlsHandshakeTimeout returns the TLSHandshakeTimeout of Tr, or
+// defaultTLSHandshakeTimeout if it has none
+func (proxy *ProxyHttpServer) tlsHandshakeTimeout() time.Duration {
+	if proxy.Tr != nil && proxy.Tr.TLSHandshakeTimeout > 0 {
+		return proxy.Tr.TLSHandshakeTimeout
+	}
+	return defaultTLSHandshakeTimeout
+}
@@ -0,0 +1,230 @@
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+var (
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// passwords holds the two encodings of the password: the PKCS#12 schemes
+// derive their keys from its BMPString, PBES2 from its UTF-8 bytes.
+type passwords struct {
+	utf8, bmp []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decrypt decrypts data with the password based algorithm alg.
+func decrypt(alg pkix.AlgorithmIdentifier, data []byte, pw passwords) ([]byte, error) {
+	block, iv, err := pbeCipher(alg, pw)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("pkcs12: encrypted data is not a multiple of the block size")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	// a wrong password is usually noticed here, when the files have no MAC
+	n := int(out[len(out)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(out[len(out)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, ErrIncorrectPassword
+	}
+	return out[:len(out)-n], nil
+}
+
+func pbeCipher(alg pkix.AlgorithmIdentifier, pw passwords) (cipher.Block, []byte, error) {
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC),
+		alg.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC),
+		alg.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, nil, fmt.Errorf("pkcs12: %v", err)
+		}
+		kdf := func(id byte, size int) []byte {
+			return pkcs12KDF(sha1.New, params.Salt, pw.bmp, params.Iterations, id, size)
+		}
+		iv := kdf(2, 8)
+		switch {
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+			block, err := des.NewTripleDESCipher(kdf(1, 24))
+			return block, iv, err
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC):
+			return newRC2Cipher(kdf(1, 16), 128), iv, nil
+		default:
+			return newRC2Cipher(kdf(1, 5), 40), iv, nil
+		}
+
+	case alg.Algorithm.Equal(oidPBES2):
+		var params pbes2Params
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, nil, fmt.Errorf("pkcs12: %v", err)
+		}
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, nil, fmt.Errorf("pkcs12: unsupported key derivation function %v", params.KeyDerivationFunc.Algorithm)
+		}
+		var kdfParams pbkdf2Params
+		if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+			return nil, nil, fmt.Errorf("pkcs12: %v", err)
+		}
+		var prf func() hash.Hash
+		switch prfOid := kdfParams.PRF.Algorithm; {
+		case len(prfOid) == 0, prfOid.Equal(oidHMACWithSHA1):
+			prf = sha1.New
+		case prfOid.Equal(oidHMACWithSHA256):
+			prf = sha256.New
+		default:
+			return nil, nil, fmt.Errorf("pkcs12: unsupported pseudorandom function %v", prfOid)
+		}
+
+		var keyLen int
+		var newCipher func([]byte) (cipher.Block, error)
+		switch scheme := params.EncryptionScheme.Algorithm; {
+		case scheme.Equal(oidAES128CBC):
+			keyLen, newCipher = 16, aes.NewCipher
+		case scheme.Equal(oidAES192CBC):
+			keyLen, newCipher = 24, aes.NewCipher
+		case scheme.Equal(oidAES256CBC):
+			keyLen, newCipher = 32, aes.NewCipher
+		case scheme.Equal(oidDESEDE3CBC):
+			keyLen, newCipher = 24, des.NewTripleDESCipher
+		default:
+			return nil, nil, fmt.Errorf("pkcs12: unsupported encryption scheme %v", scheme)
+		}
+		var iv []byte
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, nil, fmt.Errorf("pkcs12: %v", err)
+		}
+		block, err := newCipher(pbkdf2(prf, pw.utf8, kdfParams.Salt, kdfParams.Iterations, keyLen))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(iv) != block.BlockSize() {
+			return nil, nil, errors.New("pkcs12: invalid IV length")
+		}
+		return block, iv, nil
+	}
+	return nil, nil, fmt.Errorf("pkcs12: unsupported encryption algorithm %v", alg.Algorithm)
+}
+
+// pkcs12KDF derives size bytes from password and salt, as described in
+// appendix B of RFC 7292. id tells what the bytes are for: 1 for a key, 2 for
+// an IV and 3 for a MAC key.
+func pkcs12KDF(newHash func() hash.Hash, salt, password []byte, iterations int, id byte, size int) []byte {
+	h := newHash()
+	v := h.BlockSize()
+
+	// repeat fills a multiple of v bytes with b
+	repeat := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	in := append(repeat(salt), repeat(password)...)
+
+	var out []byte
+	one := big.NewInt(1)
+	for len(out) < size {
+		h.Reset()
+		h.Write(d)
+		h.Write(in)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			break
+		}
+
+		// add B+1 to each v bytes block of the input, modulo 2^(8v)
+		b := new(big.Int).SetBytes(repeat(a)[:v])
+		b.Add(b, one)
+		for j := 0; j < len(in); j += v {
+			ij := new(big.Int).SetBytes(in[j : j+v])
+			ij.Add(ij, b)
+			sum := ij.Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			block := in[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(sum):], sum)
+		}
+	}
+	return out[:size]
+}
+
+// pbkdf2 is the key derivation function of RFC 8018.
+func pbkdf2(prf func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	mac := hmac.New(prf, password)
+	var out []byte
+	for block := uint32(1); len(out) < keyLen; block++ {
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := mac.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
@@ -0,0 +1,244 @@
+// Package pkcs12 decodes the PKCS#12 (.p12, .pfx) files browsers, OSes and
+// OpenSSL export keys and certificates in, as described by RFC 7292.
+//
+// Both the legacy encryption schemes (3DES and RC2 with the PKCS#12 key
+// derivation) and the PBES2 ones OpenSSL 3 uses by default (AES with PBKDF2)
+// are supported.
+//
+// goproxy depends on the standard library only, hence this package rather
+// than a dependency on golang.org/x/crypto/pkcs12, which lacks PBES2, or on
+// software.sslmate.com/src/go-pkcs12. Each scheme it accepts is tested
+// against files written by OpenSSL.
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+)
+
+// ErrIncorrectPassword is returned when the password doesn't decrypt the data.
+var ErrIncorrectPassword = errors.New("pkcs12: incorrect password")
+
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidSHA1                = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// Decode returns the private key and the certificates held by pfxData. The
+// private key is nil if there is none, otherwise it is the same type as what
+// x509.ParsePKCS8PrivateKey returns.
+func Decode(pfxData []byte, password string) (key interface{}, certs []*x509.Certificate, err error) {
+	var pfx pfxPdu
+	if rest, err := asn1.Unmarshal(pfxData, &pfx); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	} else if len(rest) != 0 {
+		return nil, nil, errors.New("pkcs12: trailing data")
+	}
+	if pfx.Version != 3 {
+		return nil, nil, fmt.Errorf("pkcs12: unsupported version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return nil, nil, errors.New("pkcs12: only password-protected files are supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+
+	// the empty password is either encoded as two zero bytes, or not at
+	// all, depending on the implementation that wrote the file
+	bmpPasswords := [][]byte{bmpString(password)}
+	if password == "" {
+		bmpPasswords = append(bmpPasswords, nil)
+	}
+	bmpPassword := bmpPasswords[0]
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) > 0 {
+		err = ErrIncorrectPassword
+		for _, p := range bmpPasswords {
+			if err = verifyMac(&pfx.MacData, authSafe, p); err != ErrIncorrectPassword {
+				bmpPassword = p
+				break
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	pw := passwords{utf8: []byte(password), bmp: bmpPassword}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %v", err)
+	}
+	for _, ci := range contents {
+		var data []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &data); err != nil {
+				return nil, nil, fmt.Errorf("pkcs12: %v", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, fmt.Errorf("pkcs12: %v", err)
+			}
+			eci := ed.EncryptedContentInfo
+			if data, err = decrypt(eci.ContentEncryptionAlgorithm, eci.EncryptedContent, pw); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("pkcs12: unsupported content type %v", ci.ContentType)
+		}
+
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(data, &bags); err != nil {
+			return nil, nil, fmt.Errorf("pkcs12: %v", err)
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, fmt.Errorf("pkcs12: %v", err)
+				}
+				if !cb.ID.Equal(oidX509Certificate) {
+					continue
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, err
+				}
+				certs = append(certs, cert)
+			case bag.ID.Equal(oidKeyBag):
+				if key, err = x509.ParsePKCS8PrivateKey(bag.Value.Bytes); err != nil {
+					return nil, nil, err
+				}
+			case bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+				var info encryptedPrivateKeyInfo
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &info); err != nil {
+					return nil, nil, fmt.Errorf("pkcs12: %v", err)
+				}
+				der, err := decrypt(info.Algorithm, info.EncryptedData, pw)
+				if err != nil {
+					return nil, nil, err
+				}
+				if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	return key, certs, nil
+}
+
+func verifyMac(md *macData, message, password []byte) error {
+	newHash, err := hashFor(md.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	key := pkcs12KDF(newHash, md.MacSalt, password, md.Iterations, 3, newHash().Size())
+	mac := hmac.New(newHash, key)
+	mac.Write(message)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+func hashFor(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidSHA384):
+		return sha512.New384, nil
+	case oid.Equal(oidSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("pkcs12: unsupported digest algorithm %v", oid)
+}
+
+// bmpString returns s as a zero terminated UTF-16 big endian string, the
+// encoding of passwords in the key derivation of PKCS#12.
+func bmpString(s string) []byte {
+	var b bytes.Buffer
+	for _, r := range utf16.Encode([]rune(s)) {
+		b.WriteByte(byte(r >> 8))
+		b.WriteByte(byte(r))
+	}
+	b.Write([]byte{0, 0})
+	return b.Bytes()
+}
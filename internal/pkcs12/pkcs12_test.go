@@ -0,0 +1,134 @@
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The files of testdata were written by OpenSSL 3.0 from ca.crt and its key,
+// with the password "secret":
+//
+//	modern.p12: openssl pkcs12 -export (AES-256-CBC, PBKDF2 and a SHA-256 MAC)
+//	legacy.p12: openssl pkcs12 -export -legacy (RC2-40 and 3DES)
+//	nopass.p12: openssl pkcs12 -export -legacy -certpbe NONE -passout pass:
+//	mac-<hash>.p12: openssl pkcs12 -export -macalg <hash>
+//	key-pbe-<scheme>.pem: openssl pkcs8 -topk8 -v1 <scheme>
+//	key-pbes2-<cipher>-<prf>.pem: openssl pkcs8 -topk8 -v2 <cipher> -v2prf hmacWith<prf>
+//
+// OpenSSL leaves out the PRF when it is HMAC-SHA1, its default.
+
+func readCA(t *testing.T) *x509.Certificate {
+	data, err := ioutil.ReadFile("testdata/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestDecode(t *testing.T) {
+	ca := readCA(t)
+	for file, password := range map[string]string{
+		"modern.p12":     "secret",
+		"legacy.p12":     "secret",
+		"nopass.p12":     "",
+		"mac-sha1.p12":   "secret",
+		"mac-sha384.p12": "secret",
+		"mac-sha512.p12": "secret",
+	} {
+		pfx, err := ioutil.ReadFile("testdata/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, certs, err := Decode(pfx, password)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if len(certs) != 1 || !certs[0].Equal(ca) {
+			t.Errorf("%s: expected the CA certificate, got %d certificates", file, len(certs))
+		}
+		if k, ok := key.(*ecdsa.PrivateKey); !ok || !k.PublicKey.Equal(ca.PublicKey) {
+			t.Errorf("%s: expected the key of the CA, got %T", file, key)
+		}
+
+		if _, _, err := Decode(pfx, "wrong"); err != ErrIncorrectPassword {
+			t.Errorf("%s: expected ErrIncorrectPassword, got %v", file, err)
+		}
+	}
+}
+
+// TestDecrypt decrypts a key with each of the encryption schemes accepted
+func TestDecrypt(t *testing.T) {
+	ca := readCA(t)
+	files, err := filepath.Glob("testdata/key-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 11 {
+		t.Fatalf("expected the 3 PKCS#12 schemes and the 8 PBES2 ones, got %v", files)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(data)
+		var info encryptedPrivateKeyInfo
+		if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+			t.Fatal(err)
+		}
+		pw := passwords{utf8: []byte("secret"), bmp: bmpString("secret")}
+		der, err := decrypt(info.Algorithm, info.EncryptedData, pw)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if k, ok := key.(*ecdsa.PrivateKey); !ok || !k.PublicKey.Equal(ca.PublicKey) {
+			t.Errorf("%s: expected the key of the CA, got %T, %v", file, key, err)
+		}
+
+		// without a MAC, the padding tells a wrong password most of the time
+		wrong := passwords{utf8: []byte("wrong"), bmp: bmpString("wrong")}
+		if der, err := decrypt(info.Algorithm, info.EncryptedData, wrong); err == nil {
+			if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+				t.Errorf("%s: expected the wrong password to fail", file)
+			}
+		}
+	}
+}
+
+func TestRC2(t *testing.T) {
+	// test vectors of RFC 2268
+	for _, v := range []struct {
+		key, plain, cipher string
+		bits               int
+	}{
+		{"0000000000000000", "0000000000000000", "ebb773f993278eff", 63},
+		{"ffffffffffffffff", "ffffffffffffffff", "278b27e42e2f0d49", 64},
+		{"3000000000000000", "1000000000000001", "30649edf9be7d2c2", 64},
+	} {
+		c := newRC2Cipher(mustHex(v.key), v.bits)
+		out := make([]byte, 8)
+		c.Encrypt(out, mustHex(v.plain))
+		if hex.EncodeToString(out) != v.cipher {
+			t.Errorf("key %s: expected %s, got %x", v.key, v.cipher, out)
+		}
+		c.Decrypt(out, out)
+		if !bytes.Equal(out, mustHex(v.plain)) {
+			t.Errorf("key %s: expected decryption to give back %s, got %x", v.key, v.plain, out)
+		}
+	}
+}
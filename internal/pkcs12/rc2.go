@@ -0,0 +1,122 @@
+package pkcs12
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+)
+
+// RC2 (RFC 2268), which old PKCS#12 files, such as the ones of Windows and of
+// OpenSSL 1.x, encrypt their certificates with.
+
+const rc2BlockSize = 8
+
+var piTable = mustHex("d978f9c419ddb5ed28e9fd794aa0d89dc67e37832b76538e624c6488448bfba2" +
+	"179a59f587b34f1361456d8d09817d32bd8f40eb86b77b0bf09521225c6b4e82" +
+	"54d66593ce60b21c7356c014a78cf1dc1275ca1f3bbee4d1423dd430a33cb626" +
+	"6fbf0eda4669075727f21d9bbc944303f811c7f690ef3ee706c3d52fc8661ed7" +
+	"08e8eade8052eef784aa72ac354d6a2a961ad2715a1549744b9fd05e0418a4ec" +
+	"c2e0416e0f51cbcc2491af50a1f47039997c3a8523b8b47afc02365b25559731" +
+	"2d5dfa98e38a92ae05df2910676cbac9d300e6cfe19ea82c6316013f58e289a9" +
+	"0d38341bab33ffb0bb480c5fb9b1cd2ec5f3db47e5a59c770aa62068fe7fc1ad")
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+type rc2Cipher struct {
+	k [64]uint16
+}
+
+// newRC2Cipher returns the RC2 cipher of key, limited to effectiveBits bits.
+func newRC2Cipher(key []byte, effectiveBits int) cipher.Block {
+	var l [128]byte
+	t := len(key)
+	copy(l[:], key)
+	for i := t; i < 128; i++ {
+		l[i] = piTable[l[i-1]+l[i-t]]
+	}
+	t8 := (effectiveBits + 7) / 8
+	tm := byte(0xff >> uint(8*t8-effectiveBits))
+	l[128-t8] = piTable[l[128-t8]&tm]
+	for i := 127 - t8; i >= 0; i-- {
+		l[i] = piTable[l[i+1]^l[i+t8]]
+	}
+
+	c := &rc2Cipher{}
+	for i := range c.k {
+		c.k[i] = uint16(l[2*i]) | uint16(l[2*i+1])<<8
+	}
+	return c
+}
+
+func (c *rc2Cipher) BlockSize() int { return rc2BlockSize }
+
+var rc2Shifts = [4]int{1, 2, 3, 5}
+
+func (c *rc2Cipher) Encrypt(dst, src []byte) {
+	var r [4]uint16
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint16(src[2*i:])
+	}
+	j := 0
+	mix := func() {
+		for i := 0; i < 4; i++ {
+			r[i] += c.k[j] + (r[(i+3)%4] & r[(i+2)%4]) + (^r[(i+3)%4] & r[(i+1)%4])
+			j++
+			r[i] = bits.RotateLeft16(r[i], rc2Shifts[i])
+		}
+	}
+	mash := func() {
+		for i := 0; i < 4; i++ {
+			r[i] += c.k[r[(i+3)%4]&63]
+		}
+	}
+	for _, rounds := range []int{5, -1, 6, -1, 5} {
+		if rounds < 0 {
+			mash()
+		}
+		for n := 0; n < rounds; n++ {
+			mix()
+		}
+	}
+	for i := range r {
+		binary.LittleEndian.PutUint16(dst[2*i:], r[i])
+	}
+}
+
+func (c *rc2Cipher) Decrypt(dst, src []byte) {
+	var r [4]uint16
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint16(src[2*i:])
+	}
+	j := 63
+	unmix := func() {
+		for i := 3; i >= 0; i-- {
+			r[i] = bits.RotateLeft16(r[i], -rc2Shifts[i])
+			r[i] -= c.k[j] + (r[(i+3)%4] & r[(i+2)%4]) + (^r[(i+3)%4] & r[(i+1)%4])
+			j--
+		}
+	}
+	unmash := func() {
+		for i := 3; i >= 0; i-- {
+			r[i] -= c.k[r[(i+3)%4]&63]
+		}
+	}
+	for _, rounds := range []int{5, -1, 6, -1, 5} {
+		if rounds < 0 {
+			unmash()
+		}
+		for n := 0; n < rounds; n++ {
+			unmix()
+		}
+	}
+	for i := range r {
+		binary.LittleEndian.PutUint16(dst[2*i:], r[i])
+	}
+}
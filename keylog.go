@@ -0,0 +1,120 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// KeyLog writes the TLS secrets of MITM'd connections in the NSS key log
+// format, for Wireshark to decrypt captured traffic. It logs both the
+// connections of the clients to the proxy and those of the proxy to the
+// remote hosts:
+//
+//	keyLog, err := goproxy.OpenKeyLog(os.Getenv("SSLKEYLOGFILE"))
+//	...
+//	keyLog.When(goproxy.ReqHostIs("api.example.com:443", "api.example.com"))
+//	proxy.KeyLog = keyLog
+//
+// Anyone reading the key log can decrypt the logged traffic, only enable it
+// for debugging.
+type KeyLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	disabled bool
+	conds    []ReqCondition
+}
+
+// NewKeyLog returns an enabled KeyLog writing to w.
+func NewKeyLog(w io.Writer) *KeyLog {
+	return &KeyLog{w: w}
+}
+
+// OpenKeyLog returns an enabled KeyLog appending to file, created readable
+// only by the current user if it doesn't exist.
+func OpenKeyLog(file string) (*KeyLog, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyLog(f), nil
+}
+
+// When limits the logged sessions to those matching all of conds. For the
+// connections of the clients, they test the CONNECT request, and for those to
+// the remote hosts, the requests sent through them.
+func (k *KeyLog) When(conds ...ReqCondition) *KeyLog {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.conds = conds
+	return k
+}
+
+// SetEnabled enables or disables the key log. While it is disabled, no
+// secret is written, even for connections made when it was enabled.
+func (k *KeyLog) SetEnabled(enabled bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.disabled = !enabled
+}
+
+// Enabled tells whether the key log is enabled.
+func (k *KeyLog) Enabled() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return !k.disabled
+}
+
+// Write writes a line of the key log, unless it is disabled. The lines of
+// concurrent handshakes are not interleaved.
+func (k *KeyLog) Write(line []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.disabled {
+		return len(line), nil
+	}
+	return k.w.Write(line)
+}
+
+// Close closes the writer of the key log, if it is an io.Closer.
+func (k *KeyLog) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.disabled = true
+	if c, ok := k.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// logs tells whether the secrets of the connections of req are logged
+func (k *KeyLog) logs(req *http.Request, ctx *ProxyCtx) bool {
+	if k == nil || req == nil {
+		return false
+	}
+	k.mu.Lock()
+	disabled, conds := k.disabled, k.conds
+	k.mu.Unlock()
+	if disabled {
+		return false
+	}
+	for _, cond := range conds {
+		if !cond.HandleReq(req, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// withKeyLog returns config logging its secrets to k
+func (k *KeyLog) withKeyLog(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.KeyLogWriter = k
+	return config
+}
@@ -0,0 +1,59 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "https://")
+
+	var buf bytes.Buffer
+	keyLog := NewKeyLog(&buf).When(ReqHostIs(backendHost))
+	proxy, err := New(WithEnvProxy(false), WithKeyLog(keyLog))
+	orFatal("New", err, t)
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+
+	// the client randoms of the logged connections
+	randoms := func(host string) map[string]bool {
+		tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		defer tr.CloseIdleConnections()
+		resp, err := tr.RoundTrip(newCondRequest("GET", "https://"+host+"/", ""))
+		orFatal("RoundTrip", err, t)
+		resp.Body.Close()
+
+		keyLog.mu.Lock()
+		defer keyLog.mu.Unlock()
+		randoms := make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if fields := strings.Fields(line); len(fields) == 3 {
+				randoms[fields[1]] = true
+			}
+		}
+		buf.Reset()
+		return randoms
+	}
+
+	if r := randoms(backendHost); len(r) != 2 {
+		t.Errorf("expected the secrets of the client and upstream connections, got %v", r)
+	}
+	// localhost doesn't match the condition
+	if r := randoms(strings.Replace(backendHost, "127.0.0.1", "localhost", 1)); len(r) != 0 {
+		t.Errorf("expected no secrets for other hosts, got %v", r)
+	}
+	keyLog.SetEnabled(false)
+	if r := randoms(backendHost); len(r) != 0 {
+		t.Errorf("expected no secrets once disabled, got %v", r)
+	}
+}
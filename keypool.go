@@ -0,0 +1,112 @@
+package goproxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyPool provides the private keys of the certificates of MITM'd hosts.
+// Generating an RSA key takes long enough to delay the first TLS handshake
+// with a host noticeably, a pool generates them in the background instead:
+//
+//	pool := goproxy.NewKeyPool(goproxy.KeyRSA2048, 32, 2)
+//	defer pool.Close()
+//	proxy.KeyPool = pool
+//
+// The keys of a pool are used whatever CertProfile.Key is.
+type KeyPool struct {
+	// first for the alignment of atomic operations on 32-bit platforms
+	hits, misses int64
+
+	alg    KeyAlgorithm
+	keys   chan crypto.Signer
+	shared crypto.Signer
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// KeyPoolStats tells how a KeyPool kept up with the demand.
+type KeyPoolStats struct {
+	// Hits is the number of keys taken from the pool
+	Hits int64
+	// Misses is the number of keys generated while the caller waited, the
+	// pool being empty
+	Misses int64
+	// Ready is the number of keys in the pool
+	Ready int
+}
+
+// NewKeyPool returns a pool keeping up to size keys of kind alg ready,
+// generated by workers goroutines until Close is called. KeyDefault is RSA
+// 2048 bits.
+func NewKeyPool(alg KeyAlgorithm, size, workers int) *KeyPool {
+	if size < 1 {
+		size = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	p := &KeyPool{alg: alg, keys: make(chan crypto.Signer, size), stop: make(chan struct{})}
+	for i := 0; i < workers; i++ {
+		go p.fill()
+	}
+	return p
+}
+
+// NewSharedKeyPool returns a pool always providing key: all the certificates
+// get the same key, which makes signing them fast, but lets anyone holding
+// the key of one impersonate every MITM'd host.
+func NewSharedKeyPool(key crypto.Signer) *KeyPool {
+	return &KeyPool{shared: key}
+}
+
+func (p *KeyPool) fill() {
+	for {
+		key, err := generateKey(p.alg, rand.Reader)
+		if err != nil {
+			// Get reports the error
+			return
+		}
+		select {
+		case p.keys <- key:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Get returns a key of the pool, or generates one if it is empty. A key is
+// never returned twice, unless the pool is shared.
+func (p *KeyPool) Get() (crypto.Signer, error) {
+	if p.shared != nil {
+		atomic.AddInt64(&p.hits, 1)
+		return p.shared, nil
+	}
+	select {
+	case key := <-p.keys:
+		atomic.AddInt64(&p.hits, 1)
+		return key, nil
+	default:
+	}
+	atomic.AddInt64(&p.misses, 1)
+	return generateKey(p.alg, rand.Reader)
+}
+
+// Stats returns the counters of the pool, to export as metrics.
+func (p *KeyPool) Stats() KeyPoolStats {
+	return KeyPoolStats{
+		Hits:   atomic.LoadInt64(&p.hits),
+		Misses: atomic.LoadInt64(&p.misses),
+		Ready:  len(p.keys),
+	}
+}
+
+// Close stops the workers of the pool. Get still works, generating keys.
+func (p *KeyPool) Close() {
+	if p.stop == nil {
+		return
+	}
+	p.once.Do(func() { close(p.stop) })
+}
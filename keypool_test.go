@@ -0,0 +1,56 @@
+package goproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestKeyPool(t *testing.T) {
+	pool := NewKeyPool(KeyECDSAP256, 4, 2)
+	defer pool.Close()
+	for i := 0; i < 100 && pool.Stats().Ready < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ready := pool.Stats().Ready; ready != 4 {
+		t.Fatalf("expected the pool to fill up to 4 keys, got %d", ready)
+	}
+	seen := map[*ecdsa.PrivateKey]bool{}
+	for i := 0; i < 6; i++ {
+		key, err := pool.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, ok := key.(*ecdsa.PrivateKey)
+		if !ok || seen[k] {
+			t.Fatalf("expected a new P-256 key, got %T", key)
+		}
+		seen[k] = true
+	}
+	if stats := pool.Stats(); stats.Hits+stats.Misses != 6 || stats.Hits < 4 {
+		t.Errorf("expected at least 4 keys from the pool, got %+v", stats)
+	}
+}
+
+func TestSharedKeyPool(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	proxy := NewProxyHttpServer()
+	proxy.KeyPool = NewSharedKeyPool(key)
+	ctx := &ProxyCtx{Proxy: proxy}
+	for _, host := range []string{"a.example.com:443", "b.example.com:443"} {
+		config, err := TLSConfigFromCA(&EcdsaCa)(host, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if !key.PublicKey.Equal(leaf.PublicKey) || config.Certificates[0].PrivateKey != key {
+			t.Errorf("%s: expected the shared key", host)
+		}
+		if err := leaf.VerifyHostname(host[:len(host)-4]); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package goproxy
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Option configures the proxy created by New.
+type Option func(*options) error
+
+type options struct {
+	logger                 Logger
+	verbose                bool
+	transport              http.RoundTripper
+	dialer                 ContextDialer
+	ca                     *tls.Certificate
+	mitmTLSConfig          *tls.Config
+	certStore              CertStorage
+	certProfile            *CertProfile
+	keyPool                *KeyPool
+	verifyPolicy           *VerifyPolicy
+	clientCerts            ClientCertSelector
+	keyLog                 *KeyLog
+	timeouts               *Timeouts
+	envProxy               bool
+	keepProxyHeaders       bool
+	keepDestinationHeaders bool
+}
+
+// Timeouts of the connections of the proxy to remote hosts. A zero value
+// means no timeout.
+type Timeouts struct {
+	// Dial bounds each connection attempt
+	Dial time.Duration
+	// TLSHandshake bounds the TLS handshake with the remote host
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the headers of a response once the
+	// request was sent
+	ResponseHeader time.Duration
+	// IdleConn is how long a connection may stay idle before it is closed
+	IdleConn time.Duration
+}
+
+// New returns a proxy configured by opts. Without options, it is the same as
+// the one NewProxyHttpServer returns. Unlike NewProxyHttpServer, New checks
+// the configuration and returns an error if it cannot work:
+//
+//	proxy, err := goproxy.New(
+//		goproxy.WithCA(ca),
+//		goproxy.WithTimeouts(goproxy.Timeouts{Dial: 10 * time.Second, ResponseHeader: time.Minute}),
+//		goproxy.WithEnvProxy(false),
+//	)
+func New(opts ...Option) (*ProxyHttpServer, error) {
+	o := options{envProxy: true}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	if o.mitmTLSConfig != nil && o.ca == nil {
+		return nil, errors.New("goproxy: WithMitmTLSConfig needs WithCA, the builtin CA is public")
+	}
+	if o.ca == nil {
+		builtin := GoproxyCa
+		if err := checkCA(&builtin); err != nil {
+			return nil, fmt.Errorf("goproxy: builtin CA: %v", err)
+		}
+	}
+
+	proxy := NewProxyHttpServer()
+	if o.logger != nil {
+		proxy.Logger = o.logger
+	}
+	proxy.Verbose = o.verbose
+	proxy.KeepHeader = o.keepProxyHeaders
+	proxy.KeepDestinationHeaders = o.keepDestinationHeaders
+	proxy.CA = o.ca
+	proxy.MitmTLSConfig = o.mitmTLSConfig
+	proxy.CertStore = o.certStore
+	proxy.CertProfile = o.certProfile
+	proxy.KeyPool = o.keyPool
+	proxy.ClientCerts = o.clientCerts
+	proxy.KeyLog = o.keyLog
+
+	switch tr := o.transport.(type) {
+	case nil:
+	case *http.Transport:
+		// the options configure the transport, not the one of the caller
+		proxy.Tr = tr.Clone()
+	default:
+		proxy.Transport = tr
+	}
+	if !o.envProxy {
+		proxy.Tr.Proxy = nil
+		proxy.ConnectDial = nil
+	}
+	switch d := o.dialer.(type) {
+	case nil:
+	case *Dialer:
+		proxy.Dialer = d
+	default:
+		if tr, ok := o.transport.(*http.Transport); ok && (tr.DialContext != nil || tr.Dial != nil) {
+			return nil, fmt.Errorf("goproxy: WithDialer conflicts with the dialer of the transport given to WithTransport")
+		}
+		proxy.ConnectDialer = d
+		proxy.Tr.DialContext = d.DialContext
+	}
+
+	if o.verifyPolicy != nil {
+		if proxy.Transport != nil {
+			return nil, fmt.Errorf("goproxy: WithVerifyPolicy needs an *http.Transport, not a %T, set its TLS configuration to VerifyPolicy.TLSConfig instead", proxy.Transport)
+		}
+		o.verifyPolicy.Apply(proxy.Tr)
+	}
+	if o.clientCerts != nil && proxy.Transport != nil {
+		return nil, fmt.Errorf("goproxy: WithClientCerts needs an *http.Transport, not a %T", proxy.Transport)
+	}
+	if o.keyLog != nil && proxy.Transport != nil {
+		return nil, fmt.Errorf("goproxy: WithKeyLog needs an *http.Transport, not a %T", proxy.Transport)
+	}
+	if t := o.timeouts; t != nil {
+		if proxy.Transport != nil {
+			return nil, fmt.Errorf("goproxy: WithTimeouts needs an *http.Transport, not a %T", proxy.Transport)
+		}
+		if t.Dial > 0 {
+			if o.dialer != nil && proxy.Dialer == nil {
+				return nil, fmt.Errorf("goproxy: Timeouts.Dial needs a *goproxy.Dialer, set the timeout of the %T instead", o.dialer)
+			}
+			// a copy, since the Dialer may be the one of the caller
+			var d Dialer
+			if proxy.Dialer != nil {
+				d = *proxy.Dialer
+			}
+			d.Timeout = t.Dial
+			proxy.Dialer = &d
+		}
+		proxy.Tr.TLSHandshakeTimeout = t.TLSHandshake
+		proxy.Tr.ResponseHeaderTimeout = t.ResponseHeader
+		proxy.Tr.IdleConnTimeout = t.IdleConn
+	}
+	return proxy, nil
+}
+
+// WithLogger makes the proxy log to l.
+func WithLogger(l Logger) Option {
+	return func(o *options) error {
+		if l == nil {
+			return errors.New("goproxy: WithLogger: nil logger")
+		}
+		o.logger = l
+		return nil
+	}
+}
+
+// WithVerbose sets ProxyHttpServer.Verbose.
+func WithVerbose(verbose bool) Option {
+	return func(o *options) error {
+		o.verbose = verbose
+		return nil
+	}
+}
+
+// WithTransport makes the proxy send the requests with rt. A copy of an
+// *http.Transport, which the other options configure, becomes
+// ProxyHttpServer.Tr, any other RoundTripper ProxyHttpServer.Transport.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) error {
+		if rt == nil {
+			return errors.New("goproxy: WithTransport: nil transport")
+		}
+		o.transport = rt
+		return nil
+	}
+}
+
+// WithDialer makes the proxy connect to remote hosts with d. A *Dialer
+// becomes ProxyHttpServer.Dialer, other dialers are used both for CONNECT
+// requests and by Tr.
+func WithDialer(d ContextDialer) Option {
+	return func(o *options) error {
+		if d == nil {
+			return errors.New("goproxy: WithDialer: nil dialer")
+		}
+		o.dialer = d
+		return nil
+	}
+}
+
+// WithCA makes the proxy sign the certificates of MITM'd hosts with ca
+// instead of GoproxyCa. The first certificate of ca must be a CA whose key is
+// the private key of ca.
+func WithCA(ca tls.Certificate) Option {
+	return func(o *options) error {
+		if err := checkCA(&ca); err != nil {
+			return fmt.Errorf("goproxy: WithCA: %v", err)
+		}
+		o.ca = &ca
+		return nil
+	}
+}
+
+// WithMitmTLSConfig sets ProxyHttpServer.MitmTLSConfig. It requires WithCA.
+func WithMitmTLSConfig(config *tls.Config) Option {
+	return func(o *options) error {
+		if config == nil {
+			return errors.New("goproxy: WithMitmTLSConfig: nil config")
+		}
+		o.mitmTLSConfig = config
+		return nil
+	}
+}
+
+// WithCertStore makes the proxy keep the certificates it signs in store.
+func WithCertStore(store CertStorage) Option {
+	return func(o *options) error {
+		o.certStore = store
+		return nil
+	}
+}
+
+// WithCertProfile makes the proxy sign the certificates of MITM'd hosts as
+// described by profile.
+func WithCertProfile(profile CertProfile) Option {
+	return func(o *options) error {
+		if profile.Validity < 0 || profile.Backdate < 0 {
+			return errors.New("goproxy: WithCertProfile: negative duration")
+		}
+		if profile.Key < KeyDefault || profile.Key > KeyEd25519 {
+			return fmt.Errorf("goproxy: WithCertProfile: unknown key algorithm %d", profile.Key)
+		}
+		o.certProfile = &profile
+		return nil
+	}
+}
+
+// WithKeyPool makes the proxy take the keys of the certificates of MITM'd
+// hosts from pool.
+func WithKeyPool(pool *KeyPool) Option {
+	return func(o *options) error {
+		if pool == nil {
+			return errors.New("goproxy: WithKeyPool: nil pool")
+		}
+		o.keyPool = pool
+		return nil
+	}
+}
+
+// WithVerifyPolicy makes the proxy check the certificates of the remote hosts
+// with policy, instead of accepting them all.
+func WithVerifyPolicy(policy *VerifyPolicy) Option {
+	return func(o *options) error {
+		if policy == nil {
+			return errors.New("goproxy: WithVerifyPolicy: nil policy")
+		}
+		o.verifyPolicy = policy
+		return nil
+	}
+}
+
+// WithClientCerts makes the proxy present the client certificates selector
+// picks to the remote hosts requiring them.
+func WithClientCerts(selector ClientCertSelector) Option {
+	return func(o *options) error {
+		if selector == nil {
+			return errors.New("goproxy: WithClientCerts: nil selector")
+		}
+		o.clientCerts = selector
+		return nil
+	}
+}
+
+// WithKeyLog makes the proxy write the TLS secrets of MITM'd connections to
+// keyLog.
+func WithKeyLog(keyLog *KeyLog) Option {
+	return func(o *options) error {
+		if keyLog == nil {
+			return errors.New("goproxy: WithKeyLog: nil key log")
+		}
+		o.keyLog = keyLog
+		return nil
+	}
+}
+
+// WithTimeouts sets the timeouts of the connections to remote hosts. They
+// apply to Tr, so they cannot be combined with a RoundTripper other than an
+// *http.Transport.
+func WithTimeouts(t Timeouts) Option {
+	return func(o *options) error {
+		if t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.IdleConn < 0 {
+			return errors.New("goproxy: WithTimeouts: negative timeout")
+		}
+		o.timeouts = &t
+		return nil
+	}
+}
+
+// WithEnvProxy tells whether the proxy forwards its requests to the proxies
+// given by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables,
+// which it does by default.
+func WithEnvProxy(on bool) Option {
+	return func(o *options) error {
+		o.envProxy = on
+		return nil
+	}
+}
+
+// WithKeepProxyHeaders sets ProxyHttpServer.KeepHeader: the proxy related
+// headers of the requests, such as Proxy-Authorization, are sent upstream.
+func WithKeepProxyHeaders(keep bool) Option {
+	return func(o *options) error {
+		o.keepProxyHeaders = keep
+		return nil
+	}
+}
+
+// WithKeepDestinationHeaders sets ProxyHttpServer.KeepDestinationHeaders.
+func WithKeepDestinationHeaders(keep bool) Option {
+	return func(o *options) error {
+		o.keepDestinationHeaders = keep
+		return nil
+	}
+}
+
+// checkCA makes sure ca can sign certificates, and sets its Leaf.
+func checkCA(ca *tls.Certificate) error {
+	if len(ca.Certificate) == 0 {
+		return errors.New("no certificate")
+	}
+	if ca.PrivateKey == nil {
+		return errors.New("no private key")
+	}
+	leaf, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+	// old self-signed roots have no basic constraints
+	if leaf.BasicConstraintsValid && !leaf.IsCA {
+		return errors.New("certificate of " + leaf.Subject.CommonName + " is not a CA")
+	}
+	if leaf.KeyUsage != 0 && leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("certificate of " + leaf.Subject.CommonName + " cannot sign certificates")
+	}
+	signer, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key %T", ca.PrivateKey)
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(leaf.PublicKey) {
+		return errors.New("private key does not match the certificate")
+	}
+	ca.Leaf = leaf
+	return nil
+}
@@ -0,0 +1,138 @@
+package goproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDefaults(t *testing.T) {
+	proxy, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Tr == nil || proxy.Tr.Proxy == nil || proxy.Logger == nil || proxy.CA != nil {
+		t.Errorf("expected the defaults of NewProxyHttpServer, got %+v", proxy)
+	}
+	if proxy, err = New(WithEnvProxy(false)); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Tr.Proxy != nil || proxy.ConnectDial != nil {
+		t.Error("expected the environment to be ignored")
+	}
+	if proxy, err = New(WithTransport(&http.Transport{Proxy: http.ProxyFromEnvironment}), WithEnvProxy(false)); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Tr.Proxy != nil {
+		t.Error("expected the environment to be ignored by the transport given")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	leaf, err := signHost(EcdsaCa, []string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatch := EcdsaCa
+	mismatch.PrivateKey = GoproxyCa.PrivateKey
+	for name, opts := range map[string][]Option{
+		"needs WithCA":       {WithMitmTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})},
+		"is not a CA":        {WithCA(*leaf)},
+		"does not match":     {WithCA(mismatch)},
+		"no certificate":     {WithCA(tls.Certificate{})},
+		"needs an *http":     {WithTransport(roundTripperFunc(nil)), WithTimeouts(Timeouts{ResponseHeader: time.Second})},
+		"needs a *goproxy":   {WithDialer(&net.Dialer{}), WithTimeouts(Timeouts{Dial: time.Second})},
+		"conflicts with":     {WithTransport(&http.Transport{DialContext: (&net.Dialer{}).DialContext}), WithDialer(&net.Dialer{})},
+		"negative timeout":   {WithTimeouts(Timeouts{IdleConn: -1})},
+		"negative duration":  {WithCertProfile(CertProfile{Validity: -time.Hour})},
+		"nil logger":         {WithLogger(nil)},
+		"WithTransport: nil": {WithTransport(nil)},
+	} {
+		if _, err := New(opts...); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expected an error containing %q, got %v", name, err)
+		}
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestNewCopiesTransport(t *testing.T) {
+	tr := &http.Transport{}
+	dialer := &Dialer{Mode: IPv4Only}
+	proxy, err := New(WithTransport(tr), WithDialer(dialer), WithVerifyPolicy(&VerifyPolicy{}),
+		WithTimeouts(Timeouts{Dial: time.Second, TLSHandshake: time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clone itself may set the HTTP/2 protocols of the transport given
+	if proxy.Tr == tr || (tr.TLSClientConfig != nil && tr.TLSClientConfig.VerifyConnection != nil) || tr.DialTLSContext != nil ||
+		tr.TLSHandshakeTimeout != 0 {
+		t.Error("expected the transport given not to be changed")
+	}
+	if proxy.Dialer == dialer || dialer.Timeout != 0 || proxy.Dialer.Mode != IPv4Only {
+		t.Error("expected the dialer given not to be changed")
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	proxy, err := New(
+		WithTimeouts(Timeouts{Dial: time.Second, TLSHandshake: 2 * time.Second, ResponseHeader: 3 * time.Second}),
+		WithVerbose(true),
+		WithKeepProxyHeaders(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Dialer == nil || proxy.Dialer.Timeout != time.Second || proxy.Tr.TLSHandshakeTimeout != 2*time.Second ||
+		proxy.Tr.ResponseHeaderTimeout != 3*time.Second {
+		t.Error("expected the timeouts to be set")
+	}
+	if !proxy.Verbose || !proxy.KeepHeader || proxy.KeepDestinationHeaders {
+		t.Error("expected the flags to be set")
+	}
+}
+
+func TestNewWithCA(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	proxy, err := New(WithCA(EcdsaCa), WithEnvProxy(false), WithMitmTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}),
+		WithCertProfile(CertProfile{Validity: 24 * time.Hour, Key: KeyEd25519}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	ca, _ := x509.ParseCertificate(EcdsaCa.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "hello" {
+		t.Errorf("unexpected body %q", b)
+	}
+	if resp.TLS == nil || resp.TLS.PeerCertificates[0].CheckSignatureFrom(ca) != nil {
+		t.Error("expected the certificate to be signed by the CA of the proxy")
+	}
+	if _, ok := resp.TLS.PeerCertificates[0].PublicKey.(ed25519.PublicKey); !ok {
+		t.Errorf("expected the certificate to follow the profile, got a %T key", resp.TLS.PeerCertificates[0].PublicKey)
+	}
+}
@@ -2,6 +2,7 @@ package goproxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"io"
 	"log"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"regexp"
 	"sync/atomic"
+	"time"
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -25,12 +27,59 @@ type ProxyHttpServer struct {
 	reqHandlers     []ReqHandler
 	respHandlers    []RespHandler
 	httpsHandlers   []HttpsHandler
-	Tr              *http.Transport
+	// Tr sends the requests to the remote hosts when Transport is nil.
+	//
+	// The requests are sent by the first of ProxyCtx.RoundTripper, Transport
+	// and Tr that is set. The connections the proxy opens itself, for CONNECT
+	// requests and websockets, are made by the first of ConnectDial,
+	// ConnectDialer, the dialer of Tr and DialContext. Tr dials with
+	// DialContext unless replaced, which connects with Tr.Dial if set, with
+	// Dialer to the addresses Resolver returns otherwise: Dialer and Resolver
+	// are ignored by the connections made otherwise. The source addresses, ClientCerts and KeyLog apply to
+	// the requests sent by Tr or by a Transport that is an *http.Transport,
+	// the others fail when they need them.
+	Tr *http.Transport
+	// Transport, if not nil, sends the requests to the remote hosts instead
+	// of Tr. It can be any http.RoundTripper: a transport.Transport, a test
+	// double or a wrapper of Tr. ProxyCtx.RoundTripper overrides it for a
+	// single request.
+	Transport http.RoundTripper
 	// ConnectDial will be used to create TCP connections for CONNECT requests
-	// if nil Tr.Dial will be used
+	// if nil ConnectDialer will be used
 	ConnectDial func(network string, addr string) (net.Conn, error)
-	CertStore   CertStorage
-	KeepHeader  bool
+	// ConnectDialer, if not nil, makes the connections the proxy opens
+	// itself, for CONNECT requests and websockets, instead of the dialer of
+	// Tr. The context it gets holds the ProxyCtx of the request.
+	ConnectDialer ContextDialer
+	CertStore     CertStorage
+	KeepHeader    bool
+	// CA, if not nil, signs the certificates of MITM'd hosts instead of
+	// GoproxyCa, for the ConnectActions using GoproxyCa such as MitmConnect.
+	CA *tls.Certificate
+	// MitmTLSConfig, if not nil, is the base of the TLS configuration
+	// presented to the clients of MITM'd connections.
+	MitmTLSConfig *tls.Config
+	// CertProfile, if not nil, describes the certificates signed for MITM'd
+	// hosts: their validity, key and subject.
+	CertProfile *CertProfile
+	// KeyPool, if not nil, provides the keys of the certificates of MITM'd
+	// hosts, instead of generating them while the client waits.
+	KeyPool *KeyPool
+	// ClientCerts, if not nil, selects the client certificates presented to
+	// the remote hosts requiring mutual TLS, for the MITM'd requests and the
+	// HTTPS requests sent through Tr.
+	ClientCerts ClientCertSelector
+	// KeyLog, if not nil, receives the TLS secrets of the MITM'd connections
+	// and of the HTTPS requests sent through Tr.
+	KeyLog *KeyLog
+	// Resolver, if not nil, resolves the hosts the proxy connects to instead of
+	// the system resolver. ProxyCtx.Resolver overrides it for a single request.
+	Resolver Resolver
+	// Dialer, if not nil, makes the connections to remote hosts. The default
+	// one races IPv6 and IPv4 addresses.
+	Dialer *Dialer
+
+	transports transportCache
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
@@ -113,7 +162,7 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	if r.Method == "CONNECT" {
 		proxy.handleHttps(w, r)
 	} else {
-		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy}
+		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, Timings: Timings{Start: time.Now()}}
 
 		var err error
 		ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
@@ -127,6 +176,7 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			if isWebSocketRequest(r) {
 				ctx.Logf("Request looks like websocket upgrade.")
 				proxy.serveWebsocket(ctx, w, r)
+				return
 			}
 
 			if !proxy.KeepHeader {
@@ -177,12 +227,37 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		}
 		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
 		w.WriteHeader(resp.StatusCode)
-		nr, err := io.Copy(w, resp.Body)
+		bodyStart := time.Now()
+		body := &readErrorRecorder{Reader: resp.Body}
+		nr, err := io.Copy(w, body)
 		if err := resp.Body.Close(); err != nil {
 			ctx.Warnf("Can't close response body %v", err)
 		}
 		ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+		ctx.finishTimings(bodyStart)
+		if body.err != nil {
+			// Returning normally would let net/http terminate the chunked body
+			// properly, and the client would mistake a broken download for a
+			// complete one. Abort the connection instead, as
+			// httputil.ReverseProxy does.
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// readErrorRecorder keeps the error reading from Reader failed with, other
+// than io.EOF, to tell it apart from the errors writing to the client
+type readErrorRecorder struct {
+	io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
 	}
+	return n, err
 }
 
 // NewProxyHttpServer creates and returns a proxy server, logging to stderr by default
@@ -195,8 +270,8 @@ func NewProxyHttpServer() *ProxyHttpServer {
 		NonproxyHandler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", 500)
 		}),
-		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
 	}
+	proxy.Tr = &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment, DialContext: proxy.DialContext}
 
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 
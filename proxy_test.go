@@ -19,11 +19,13 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/elazarl/goproxy"
 	goproxy_image "github.com/elazarl/goproxy/ext/image"
+	"github.com/elazarl/goproxy/transport"
 )
 
 var acceptAllCerts = &tls.Config{InsecureSkipVerify: true}
@@ -506,6 +508,22 @@ func constantHttpServer(content []byte) (addr string) {
 	return l.Addr().String()
 }
 
+func TestBrokenUpstreamBodyAborts(t *testing.T) {
+	// the chunked body is cut before its last chunk
+	s := constantHttpServer([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n"))
+	client, l := oneShotProxy(goproxy.NewProxyHttpServer(), t)
+	defer l.Close()
+	// the connection is aborted, before or after the headers were sent
+	resp, err := client.Get("http://" + s)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if b, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("expected the broken body to fail for the client too, got %q", b)
+	}
+}
+
 func TestIcyResponse(t *testing.T) {
 	// TODO: fix this test
 	/*s := constantHttpServer([]byte("ICY 200 OK\r\n\r\nblablabla"))
@@ -665,6 +683,52 @@ func TestGoproxyThroughProxy(t *testing.T) {
 
 }
 
+type countingTransport struct {
+	rt    http.RoundTripper
+	count int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.count, 1)
+	return c.rt.RoundTrip(req)
+}
+
+type countingDialer struct {
+	net.Dialer
+	count int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.count, 1)
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestCustomTransportAndDialer(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	tr := &countingTransport{rt: &transport.Transport{}}
+	proxy.Transport = tr
+	dialer := &countingDialer{}
+	proxy.ConnectDialer = dialer
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected bobo, got", r)
+	}
+	if n := atomic.LoadInt32(&tr.count); n != 1 {
+		t.Error("Expected the request to go through the transport, got", n)
+	}
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected bobo through the tunnel, got", r)
+	}
+	if n := atomic.LoadInt32(&dialer.count); n != 1 {
+		t.Error("Expected the CONNECT tunnel to use the dialer, got", n)
+	}
+	if n := atomic.LoadInt32(&tr.count); n != 1 {
+		t.Error("Expected the tunnel not to use the transport, got", n)
+	}
+}
+
 func TestGoproxyHijackConnect(t *testing.T) {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.OnRequest(goproxy.ReqHostIs(srv.Listener.Addr().String())).
@@ -1007,3 +1071,62 @@ func TestResponseContentLength(t *testing.T) {
 		t.Fatalf("Wrong response Content-Length.")
 	}
 }
+
+func TestWebsocketBodyHandlers(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error("Hijack:", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Error("reading the frames of the client:", err)
+			return
+		}
+		conn.Write(b)
+	}))
+	defer background.Close()
+
+	// handlers reading and wrapping the body, as for any other response
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(goproxy.HandleBytes(func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		if len(b) != 0 {
+			t.Errorf("expected the 101 response to have no body, got %q", b)
+		}
+		return b
+	}))
+	proxy.OnResponse().Do(goproxy.LimitResponse(func(ctx *goproxy.ProxyCtx) *goproxy.RateLimiter {
+		return goproxy.NewRateLimiter(1<<20, nil)
+	}))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest("GET", background.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("expected the upgrade to succeed, got", resp.Status)
+	}
+	io.WriteString(conn, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Errorf("expected the frames to be relayed, got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,211 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting throughput to a fixed number of bytes
+// per second. Limiters can be nested: a limiter created with a parent only lets
+// data through once both it and all of its ancestors have capacity, so a
+// per-user limiter can sit inside a global one:
+//
+//	global := goproxy.NewRateLimiter(10<<20, nil) // 10MB/s for everyone
+//	alice := goproxy.NewRateLimiter(1<<20, global) // at most 1MB/s of it for alice
+//
+// A RateLimiter is safe for concurrent use, all readers and writers sharing a
+// limiter share its bandwidth.
+type RateLimiter struct {
+	parent *RateLimiter
+
+	mu     sync.Mutex
+	rate   float64 // bytes per second, <= 0 means unlimited
+	tokens float64
+	last   time.Time
+}
+
+const (
+	minRateChunk = 512
+	maxRateChunk = 32 * 1024
+)
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond bytes per second,
+// nested inside parent (which may be nil). A non-positive rate does not
+// limit, but data still has to pass through the parent.
+func NewRateLimiter(bytesPerSecond int64, parent *RateLimiter) *RateLimiter {
+	l := &RateLimiter{parent: parent, last: time.Now()}
+	l.SetRate(bytesPerSecond)
+	l.tokens = l.burst()
+	return l
+}
+
+// SetRate changes the limit of l, it takes effect for data passed after the call.
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = float64(bytesPerSecond)
+	if b := l.burst(); l.tokens > b {
+		l.tokens = b
+	}
+}
+
+// burst is the largest amount of data l lets through at once, about a tenth
+// of a second worth of traffic. Caller must hold l.mu or own l exclusively.
+func (l *RateLimiter) burst() float64 {
+	b := l.rate / 10
+	if b < minRateChunk {
+		b = minRateChunk
+	}
+	if b > maxRateChunk {
+		b = maxRateChunk
+	}
+	return b
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if b := l.burst(); l.tokens > b {
+			l.tokens = b
+		}
+	}
+	l.last = now
+}
+
+// reserve takes n bytes from the bucket, possibly going into debt, and
+// returns how long the caller has to wait until the debt is paid back.
+func (l *RateLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// chunk returns the size of the largest read or write that should be done
+// in one go, so that no single operation overshoots any limiter in the chain.
+func (l *RateLimiter) chunk() int {
+	size := maxRateChunk
+	for ; l != nil; l = l.parent {
+		l.mu.Lock()
+		if l.rate > 0 {
+			if b := int(l.burst()); b < size {
+				size = b
+			}
+		}
+		l.mu.Unlock()
+	}
+	return size
+}
+
+// WaitN blocks until n bytes may pass through l and all its ancestors.
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	now := time.Now()
+	var wait time.Duration
+	for cur := l; cur != nil; cur = cur.parent {
+		if d := cur.reserve(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+// NewLimitedReader returns a reader reading from r no faster than l allows.
+// A nil limiter returns r itself.
+func NewLimitedReader(r io.Reader, l *RateLimiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r, l}
+}
+
+func (lr *limitedReader) Read(b []byte) (int, error) {
+	if max := lr.l.chunk(); len(b) > max {
+		b = b[:max]
+	}
+	n, err := lr.r.Read(b)
+	lr.l.WaitN(n)
+	return n, err
+}
+
+// readCloser reads from Reader and closes Closer, usually the original body
+// Reader is wrapping.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *RateLimiter
+}
+
+// NewLimitedWriter returns a writer writing to w no faster than l allows.
+// A nil limiter returns w itself.
+func NewLimitedWriter(w io.Writer, l *RateLimiter) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{w, l}
+}
+
+func (lw *limitedWriter) Write(b []byte) (nw int, err error) {
+	max := lw.l.chunk()
+	for len(b) > 0 {
+		p := b
+		if len(p) > max {
+			p = p[:max]
+		}
+		lw.l.WaitN(len(p))
+		n, err := lw.w.Write(p)
+		nw += n
+		if err != nil {
+			return nw, err
+		}
+		b = b[n:]
+	}
+	return nw, nil
+}
+
+// LimitResponse returns a RespHandler throttling the response body to the
+// limiter returned by f. f may return nil to leave a response alone, which
+// makes it easy to pick a limiter per client or per user:
+//
+//	global := goproxy.NewRateLimiter(50<<20, nil)
+//	slow := goproxy.NewRateLimiter(64<<10, global)
+//	proxy.OnResponse().Do(goproxy.LimitResponse(func(ctx *goproxy.ProxyCtx) *goproxy.RateLimiter {
+//		if strings.HasPrefix(ctx.Req.RemoteAddr, "10.1.") {
+//			return slow
+//		}
+//		return global
+//	}))
+func LimitResponse(f func(ctx *ProxyCtx) *RateLimiter) RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil {
+			return resp
+		}
+		if l := f(ctx); l != nil {
+			resp.Body = &readCloser{NewLimitedReader(resp.Body, l), resp.Body}
+		}
+		return resp
+	})
+}
@@ -0,0 +1,68 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readThrough reads size bytes through l. It reports failures with
+// t.Errorf, since it runs in goroutines other than the test's too.
+func readThrough(t *testing.T, l *RateLimiter, size int) time.Duration {
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, NewLimitedReader(bytes.NewReader(make([]byte, size)), l))
+	if err != nil || n != int64(size) {
+		t.Errorf("expected to read %d bytes, got %d: %v", size, n, err)
+	}
+	return time.Since(start)
+}
+
+func TestRateLimiterThrottles(t *testing.T) {
+	// 5KB at 10KB/s, minus the initial burst, should take at least 0.3s
+	l := NewRateLimiter(10*1024, nil)
+	if d := readThrough(t, l, 5*1024); d < 300*time.Millisecond {
+		t.Errorf("read 5KB in %v with a 10KB/s limit", d)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	if d := readThrough(t, NewRateLimiter(0, nil), 1<<20); d > 200*time.Millisecond {
+		t.Errorf("unlimited limiter took %v to read 1MB", d)
+	}
+}
+
+func TestRateLimiterHierarchy(t *testing.T) {
+	global := NewRateLimiter(10*1024, nil)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		// each child allows a lot more than the parent, the parent must win
+		child := NewRateLimiter(1<<20, global)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readThrough(t, child, 3*1024)
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("read 6KB through a 10KB/s parent in %v", d)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLimitedWriter(&buf, NewRateLimiter(10*1024, nil))
+	start := time.Now()
+	n, err := w.Write(make([]byte, 5*1024))
+	orFatal("Write", err, t)
+	if n != 5*1024 || buf.Len() != 5*1024 {
+		t.Fatalf("short write %d %d", n, buf.Len())
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("wrote 5KB in %v with a 10KB/s limit", d)
+	}
+}
@@ -0,0 +1,233 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// RemoteSigner is a crypto.Signer whose private key lives in another
+// process, served by ServeSigner, so that the key of the CA never is in the
+// memory of the proxy:
+//
+//	signer, err := goproxy.DialSigner("unix", "/run/goproxy/signer.sock")
+//	...
+//	ca := tls.Certificate{Certificate: chain, PrivateKey: signer}
+//	proxy, err := goproxy.New(goproxy.WithCA(ca))
+//
+// A RemoteSigner returned by DialSigner connects again when the connection
+// breaks, as when the signer restarts.
+type RemoteSigner struct {
+	// dial connects to the signer again, nil if unknown
+	dial func() (io.ReadWriteCloser, error)
+
+	mu sync.Mutex
+	// conn is nil once broken: an error leaves the gob streams out of sync
+	conn   io.ReadWriteCloser
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	closed bool
+	pub    crypto.PublicKey
+	pubDer []byte
+}
+
+type signerRequest struct {
+	// Public asks for the public key instead of a signature
+	Public     bool
+	Digest     []byte
+	Hash       crypto.Hash
+	SaltLength int
+	PSS        bool
+}
+
+type signerResponse struct {
+	Data []byte
+	Err  string
+}
+
+var errSignerClosed = errors.New("goproxy: RemoteSigner closed")
+
+// DialSigner connects to the signer served by ServeSigner at address.
+func DialSigner(network, address string) (*RemoteSigner, error) {
+	dial := func() (io.ReadWriteCloser, error) {
+		return net.Dial(network, address)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return newRemoteSigner(conn, dial)
+}
+
+// NewRemoteSigner returns the signer served by ServeSigner at the other end
+// of conn. It fails for good once conn breaks, use DialSigner to connect
+// again.
+func NewRemoteSigner(conn io.ReadWriteCloser) (*RemoteSigner, error) {
+	return newRemoteSigner(conn, nil)
+}
+
+func newRemoteSigner(conn io.ReadWriteCloser, dial func() (io.ReadWriteCloser, error)) (*RemoteSigner, error) {
+	s := &RemoteSigner{dial: dial}
+	s.use(conn)
+	der, err := s.call(&signerRequest{Public: true})
+	if err == nil {
+		s.pub, err = x509.ParsePKIXPublicKey(der)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.pubDer = der
+	return s, nil
+}
+
+func (s *RemoteSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *RemoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := &signerRequest{Digest: digest, Hash: opts.HashFunc()}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		req.PSS, req.SaltLength = true, pss.SaltLength
+	}
+	return s.call(req)
+}
+
+// Close closes the connection to the signer.
+func (s *RemoteSigner) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *RemoteSigner) use(conn io.ReadWriteCloser) {
+	s.conn, s.enc, s.dec = conn, gob.NewEncoder(conn), gob.NewDecoder(conn)
+}
+
+// call sends req to the signer. A connection that was already open may have
+// been broken meanwhile, by a restart of the signer: the request is sent again
+// on a new one if it fails, signing twice being harmless.
+func (s *RemoteSigner) call(req *signerRequest) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for retry := s.conn != nil && s.dial != nil; ; retry = false {
+		if s.conn == nil {
+			if err := s.redial(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := s.exchange(req)
+		if err == nil {
+			if resp.Err != "" {
+				return nil, errors.New(resp.Err)
+			}
+			return resp.Data, nil
+		}
+		if !retry {
+			return nil, err
+		}
+	}
+}
+
+// exchange sends req and reads its response, breaking the connection when
+// either fails. Caller must hold s.mu.
+func (s *RemoteSigner) exchange(req *signerRequest) (*signerResponse, error) {
+	var resp signerResponse
+	err := s.enc.Encode(req)
+	if err == nil {
+		err = s.dec.Decode(&resp)
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// redial connects to the signer again, checking that it still has the key of
+// the first connection. Caller must hold s.mu.
+func (s *RemoteSigner) redial() error {
+	if s.closed {
+		return errSignerClosed
+	}
+	if s.dial == nil {
+		return errors.New("goproxy: the connection to the signer is broken")
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	s.use(conn)
+	if s.pubDer == nil {
+		return nil
+	}
+	resp, err := s.exchange(&signerRequest{Public: true})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(resp.Data, s.pubDer) {
+		s.conn.Close()
+		s.conn = nil
+		return errors.New("goproxy: the signer has another key since connecting again")
+	}
+	return nil
+}
+
+// ServeSigner signs with key for the RemoteSigners connecting to l, until
+// l is closed. Anyone able to connect to l can sign certificates with key,
+// listen on a unix socket only the proxy can access.
+func ServeSigner(l net.Listener, key crypto.Signer) error {
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSignerConn(conn, key, pub)
+	}
+}
+
+func serveSignerConn(conn net.Conn, key crypto.Signer, pub []byte) {
+	defer conn.Close()
+	enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+	for {
+		var req signerRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		var resp signerResponse
+		if req.Public {
+			resp.Data = pub
+		} else {
+			var opts crypto.SignerOpts = req.Hash
+			if req.PSS {
+				opts = &rsa.PSSOptions{SaltLength: req.SaltLength, Hash: req.Hash}
+			}
+			sig, err := key.Sign(rand.Reader, req.Digest, opts)
+			if err != nil {
+				resp.Err = err.Error()
+			}
+			resp.Data = sig
+		}
+		if err := enc.Encode(&resp); err != nil {
+			return
+		}
+	}
+}
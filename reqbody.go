@@ -0,0 +1,217 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// ReadRequestBody reads the whole body of req, as long as it is not bigger than
+// maxSize bytes. When the body is too big, it returns a 413 response the handler
+// should answer the client with. Either way the body of req can still be read
+// from the beginning afterwards.
+func ReadRequestBody(req *http.Request, maxSize int64) ([]byte, *http.Response) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.ContentLength > maxSize {
+		return nil, requestTooLarge(req, maxSize)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if int64(len(b)) > maxSize {
+		// give the data we consumed back, so that the body is still whole
+		// in case the caller decides to forward it regardless
+		req.Body = &readCloser{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		return nil, requestTooLarge(req, maxSize)
+	}
+	req.Body.Close()
+	if err != nil {
+		return nil, NewResponse(req, ContentTypeText, http.StatusBadRequest, "Cannot read request body: "+err.Error())
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+func requestTooLarge(req *http.Request, maxSize int64) *http.Response {
+	return NewResponse(req, ContentTypeText, http.StatusRequestEntityTooLarge,
+		"Request body larger than "+strconv.FormatInt(maxSize, 10)+" bytes")
+}
+
+// SetRequestBody replaces the body of req with b, and fixes the framing of the
+// request accordingly. Chunked requests stay chunked, other requests get a
+// Content-Length matching b.
+func SetRequestBody(req *http.Request, b []byte) {
+	if len(b) == 0 {
+		// an empty but non-nil body would make the transport think the
+		// length is unknown
+		req.Body = http.NoBody
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		req.TransferEncoding = nil
+		req.ContentLength = 0
+		req.Header.Del("Content-Length")
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		return
+	}
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(b))
+	req.Header.Set("Content-Length", strconv.Itoa(len(b)))
+}
+
+// HandleRequestBytes is the request counterpart of HandleBytes. It will read the
+// entire body of the request, up to maxSize bytes, run f on it and replace the
+// body with the result. Requests with a bigger body are answered with
+// 413 Request Entity Too Large.
+func HandleRequestBytes(maxSize int64, f func(b []byte, ctx *ProxyCtx) []byte) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		b, resp := ReadRequestBody(req, maxSize)
+		if resp != nil {
+			return req, resp
+		}
+		SetRequestBody(req, f(b, ctx))
+		return req, nil
+	})
+}
+
+// HandleRequestJSON decodes a JSON request body, of at most maxSize bytes, and
+// replaces it with the JSON encoding of whatever f returns. Numbers are
+// decoded as json.Number so that they survive the round trip unchanged.
+// Requests whose body is not valid JSON are sent as they are.
+func HandleRequestJSON(maxSize int64, f func(v interface{}, ctx *ProxyCtx) interface{}) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		b, resp := ReadRequestBody(req, maxSize)
+		if resp != nil {
+			return req, resp
+		}
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			ctx.Warnf("Cannot decode JSON request body: %v", err)
+			return req, nil
+		}
+		nb, err := json.Marshal(f(v, ctx))
+		if err != nil {
+			ctx.Warnf("Cannot encode JSON request body: %v", err)
+			return req, nil
+		}
+		SetRequestBody(req, nb)
+		return req, nil
+	})
+}
+
+// HandleRequestForm lets f edit the fields of an application/x-www-form-urlencoded
+// request body of at most maxSize bytes. Other requests are left alone.
+func HandleRequestForm(maxSize int64, f func(form url.Values, ctx *ProxyCtx) url.Values) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "application/x-www-form-urlencoded" {
+			return req, nil
+		}
+		b, resp := ReadRequestBody(req, maxSize)
+		if resp != nil {
+			return req, resp
+		}
+		form, err := url.ParseQuery(string(b))
+		if err != nil {
+			ctx.Warnf("Cannot parse form request body: %v", err)
+			return req, nil
+		}
+		SetRequestBody(req, []byte(f(form, ctx).Encode()))
+		return req, nil
+	})
+}
+
+// HandleRequestMultipart lets f edit a multipart/form-data request body of at most
+// maxSize bytes. The body is rewritten with the same boundary, values first
+// then files, each sorted by name. Other requests are left alone.
+func HandleRequestMultipart(maxSize int64, f func(form *multipart.Form, ctx *ProxyCtx) *multipart.Form) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "multipart/form-data" || params["boundary"] == "" {
+			return req, nil
+		}
+		b, resp := ReadRequestBody(req, maxSize)
+		if resp != nil {
+			return req, resp
+		}
+		// the body is already in memory, no need to spill files to disk
+		form, err := multipart.NewReader(bytes.NewReader(b), params["boundary"]).ReadForm(maxSize + 1)
+		if err != nil {
+			ctx.Warnf("Cannot parse multipart request body: %v", err)
+			return req, nil
+		}
+		defer form.RemoveAll()
+		nb, err := encodeMultipart(f(form, ctx), params["boundary"])
+		if err != nil {
+			ctx.Warnf("Cannot encode multipart request body: %v", err)
+			return req, nil
+		}
+		SetRequestBody(req, nb)
+		return req, nil
+	})
+}
+
+func encodeMultipart(form *multipart.Form, boundary string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for _, name := range sortedKeys(form.Value) {
+		for _, v := range form.Value[name] {
+			if err := w.WriteField(name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	names := make([]string, 0, len(form.File))
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, fh := range form.File[name] {
+			pw, err := w.CreatePart(fh.Header)
+			if err != nil {
+				return nil, err
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(pw, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
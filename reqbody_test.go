@@ -0,0 +1,119 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+// echoServer answers with the request body, and its Content-Length in a header
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Request-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Write(b)
+	}))
+}
+
+func post(t *testing.T, client *http.Client, u, contentType, body string) (*http.Response, string) {
+	resp, err := client.Post(u, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal("POST:", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("ReadAll:", err)
+	}
+	return resp, string(b)
+}
+
+func TestHandleRequestBytes(t *testing.T) {
+	echo := echoServer()
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(goproxy.HandleRequestBytes(100, func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return bytes.Replace(b, []byte("cat"), []byte("tiger"), -1)
+	}))
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	resp, body := post(t, client, echo.URL, "text/plain", "a cat and a cat")
+	if body != "a tiger and a tiger" {
+		t.Error("body was not rewritten:", body)
+	}
+	if l := resp.Header.Get("X-Request-Length"); l != strconv.Itoa(len(body)) {
+		t.Error("wrong Content-Length sent upstream:", l)
+	}
+	if resp, _ := post(t, client, echo.URL, "text/plain", strings.Repeat("x", 101)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("expected 413 for a big body, got", resp.Status)
+	}
+}
+
+func TestHandleRequestBytesTooLargeDropped(t *testing.T) {
+	echo := echoServer()
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(goproxy.HandleRequestBytes(100, func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return b
+	}))
+	// a response handler dropping the 413 still has the request
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		return nil
+	})
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+	if resp, _ := post(t, client, echo.URL, "text/plain", strings.Repeat("x", 101)); resp.StatusCode != http.StatusInternalServerError {
+		t.Error("expected 500 for the dropped response, got", resp.Status)
+	}
+}
+
+func TestHandleRequestJSON(t *testing.T) {
+	echo := echoServer()
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(goproxy.HandleRequestJSON(1000, func(v interface{}, ctx *goproxy.ProxyCtx) interface{} {
+		m := v.(map[string]interface{})
+		m["admin"] = false
+		return m
+	}))
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	_, body := post(t, client, echo.URL, "application/json", `{"admin":true,"id":12345678901234567890}`)
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &m); err != nil {
+		t.Fatal("invalid JSON sent upstream", body, err)
+	}
+	if string(m["admin"]) != "false" || string(m["id"]) != "12345678901234567890" {
+		t.Error("unexpected JSON sent upstream", body)
+	}
+}
+
+func TestHandleRequestForm(t *testing.T) {
+	echo := echoServer()
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(goproxy.HandleRequestForm(1000, func(form url.Values, ctx *goproxy.ProxyCtx) url.Values {
+		form.Set("user", "bob")
+		return form
+	}))
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	_, body := post(t, client, echo.URL, "application/x-www-form-urlencoded", "user=alice&q=1")
+	if form, _ := url.ParseQuery(body); form.Get("user") != "bob" || form.Get("q") != "1" {
+		t.Error("form was not rewritten", body)
+	}
+	if _, body := post(t, client, echo.URL, "text/plain", "user=alice"); body != "user=alice" {
+		t.Error("non form body was rewritten", body)
+	}
+}
@@ -0,0 +1,126 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// Resolver resolves the host names the proxy connects to. *net.Resolver
+// implements it, and so do DNSResolver and StaticResolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type proxyCtxKey struct{}
+
+// withProxyCtx stores ctx in a context, so that dialers called by
+// http.Transport know which request they dial for
+func withProxyCtx(parent context.Context, ctx *ProxyCtx) context.Context {
+	return context.WithValue(parent, proxyCtxKey{}, ctx)
+}
+
+// proxyCtxFrom returns the ProxyCtx stored in c, or nil
+func proxyCtxFrom(c context.Context) *ProxyCtx {
+	ctx, _ := c.Value(proxyCtxKey{}).(*ProxyCtx)
+	return ctx
+}
+
+// context returns the context of the request of ctx, holding ctx itself and
+// tracing the connections dialed with it
+func (ctx *ProxyCtx) context() (context.Context, *requestTrace) {
+	parent := context.Background()
+	if ctx.Req != nil {
+		parent = ctx.Req.Context()
+	}
+	return ctx.withRequestTrace(parent)
+}
+
+// resolver returns the resolver to use for the request of ctx, which may be nil
+func (ctx *ProxyCtx) resolver() Resolver {
+	if ctx != nil && ctx.Resolver != nil {
+		return ctx.Resolver
+	}
+	if ctx != nil && ctx.Proxy != nil && ctx.Proxy.Resolver != nil {
+		return ctx.Proxy.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// lookupIP resolves host with the resolver of ctx, which may be nil
+func (ctx *ProxyCtx) lookupIP(c context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := ctx.resolver().LookupIPAddr(c, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// StaticResolver answers from a fixed table of host names, like /etc/hosts,
+// and asks Fallback for the other names. Combined with ProxyCtx.Resolver, it
+// overrides the addresses of some hosts for the requests matching a rule:
+//
+//	staging := &goproxy.StaticResolver{Hosts: map[string][]net.IP{
+//		"api.example.com": {net.ParseIP("10.0.0.12")},
+//	}}
+//	proxy.OnRequest(goproxy.ReqHeaderMatches("X-Env", regexp.MustCompile("^staging$"))).DoFunc(
+//		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//			ctx.Resolver = staging
+//			return r, nil
+//		})
+type StaticResolver struct {
+	// Hosts maps lower case host names to their addresses
+	Hosts map[string][]net.IP
+	// Fallback resolves the names missing from Hosts. If nil, they are not found.
+	Fallback Resolver
+}
+
+// NewStaticResolver returns a StaticResolver holding the entries of a file in
+// hosts(5) format.
+func NewStaticResolver(r io.Reader, fallback Resolver) (*StaticResolver, error) {
+	s := &StaticResolver{Hosts: make(map[string][]net.IP), Fallback: fallback}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, errors.New("goproxy: invalid hosts line: " + scanner.Text())
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			s.Hosts[name] = append(s.Hosts[name], ip)
+		}
+	}
+	return s, scanner.Err()
+}
+
+func (s *StaticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := s.Hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: ip}
+		}
+		return addrs, nil
+	}
+	if s.Fallback == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return s.Fallback.LookupIPAddr(ctx, host)
+}
@@ -0,0 +1,524 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeRecord struct {
+	ip  string
+	ttl uint32
+}
+
+// fakeDNS is a DNS server answering A and AAAA queries from a table
+type fakeDNS struct {
+	addr     string
+	udp      net.PacketConn
+	tcp      net.Listener
+	queries  int32
+	mu       sync.Mutex
+	records  map[string][]fakeRecord
+	nxdomain map[string]bool
+	soaMin   uint32
+	truncate bool
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	s := &fakeDNS{records: make(map[string][]fakeRecord), nxdomain: make(map[string]bool), soaMin: 5}
+	var err error
+	for i := 0; i < 10; i++ {
+		if s.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		// the TCP fallback must use the same port
+		if s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String()); err == nil {
+			break
+		}
+		s.udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = s.udp.LocalAddr().String()
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *fakeDNS) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *fakeDNS) add(name, ip string, ttl uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = append(s.records[name], fakeRecord{ip, ttl})
+}
+
+func (s *fakeDNS) count() int {
+	return int(atomic.LoadInt32(&s.queries))
+}
+
+func (s *fakeDNS) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		truncate := s.truncate
+		s.mu.Unlock()
+		if resp := s.answer(buf[:n], truncate); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *fakeDNS) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := conn.Read(length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := conn.Read(query); err != nil {
+				return
+			}
+			resp := s.answer(query, false)
+			binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+			conn.Write(append(length[:], resp...))
+		}()
+	}
+}
+
+func (s *fakeDNS) answer(query []byte, truncate bool) []byte {
+	atomic.AddInt32(&s.queries, 1)
+	name, off, err := readDNSName(query, 12)
+	if err != nil {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[off:])
+	resp := append([]byte(nil), query[:off+4]...)
+	flags := uint16(0x8180)
+	if truncate {
+		flags |= 0x0200
+		binary.BigEndian.PutUint16(resp[2:], flags)
+		return resp
+	}
+	s.mu.Lock()
+	var answers [][]byte
+	for _, rec := range s.records[name] {
+		ip := net.ParseIP(rec.ip)
+		var rdata []byte
+		if ip4 := ip.To4(); ip4 != nil && qtype == dnsTypeA {
+			rdata = ip4
+		} else if ip.To4() == nil && qtype == dnsTypeAAAA {
+			rdata = ip
+		} else {
+			continue
+		}
+		rr := []byte{0xC0, 12, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(rr[2:], qtype)
+		binary.BigEndian.PutUint32(rr[6:], rec.ttl)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+		answers = append(answers, append(rr, rdata...))
+	}
+	nx := s.nxdomain[name]
+	s.mu.Unlock()
+
+	if nx {
+		flags |= dnsRcodeNameError
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	if len(answers) == 0 {
+		binary.BigEndian.PutUint16(resp[8:], 1)
+		soa := []byte{0xC0, 12, 0, dnsTypeSOA, 0, 1, 0, 0, 0x0E, 0x10, 0, 22, 0, 0}
+		minimum := make([]byte, 20)
+		s.mu.Lock()
+		binary.BigEndian.PutUint32(minimum[16:], s.soaMin)
+		s.mu.Unlock()
+		resp = append(append(resp, soa...), minimum...)
+	}
+	return resp
+}
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestDNSResolver(servers ...string) (*DNSResolver, *fakeClock) {
+	clock := &fakeClock{time.Unix(1000000, 0)}
+	r := NewDNSResolver(servers...)
+	r.Timeout = time.Second
+	r.now = clock.now
+	return r, clock
+}
+
+func lookupStrings(t *testing.T, r Resolver, host string) []string {
+	addrs, err := r.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		t.Fatalf("cannot resolve %s: %v", host, err)
+	}
+	var ips []string
+	for _, a := range addrs {
+		ips = append(ips, a.IP.String())
+	}
+	return ips
+}
+
+func TestDNSResolverCache(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.Close()
+	dns.add("www.example.test", "10.0.0.1", 60)
+	dns.add("www.example.test", "fd00::1", 20)
+	dns.add("v4.example.test", "10.0.0.2", 60)
+	r, clock := newTestDNSResolver(dns.addr)
+
+	if ips := lookupStrings(t, r, "www.example.test"); strings.Join(ips, " ") != "10.0.0.1 fd00::1" {
+		t.Fatalf("unexpected addresses %v", ips)
+	}
+	lookupStrings(t, r, "WWW.example.test.")
+	if dns.count() != 2 {
+		t.Errorf("expected the second lookup to be cached, got %d queries", dns.count())
+	}
+	clock.t = clock.t.Add(30 * time.Second)
+	lookupStrings(t, r, "www.example.test")
+	if dns.count() != 3 {
+		t.Errorf("expected the AAAA record to expire, got %d queries", dns.count())
+	}
+	clock.t = clock.t.Add(31 * time.Second)
+	lookupStrings(t, r, "www.example.test")
+	if dns.count() != 5 {
+		t.Errorf("expected both records to expire, got %d queries", dns.count())
+	}
+
+	// the empty AAAA answer is cached for the SOA minimum TTL
+	lookupStrings(t, r, "v4.example.test")
+	lookupStrings(t, r, "v4.example.test")
+	if dns.count() != 7 {
+		t.Errorf("expected the empty answer to be cached, got %d queries", dns.count())
+	}
+	clock.t = clock.t.Add(6 * time.Second)
+	lookupStrings(t, r, "v4.example.test")
+	if dns.count() != 8 {
+		t.Errorf("expected the empty answer to expire, got %d queries", dns.count())
+	}
+}
+
+func TestDNSResolverNegativeCache(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.Close()
+	dns.mu.Lock()
+	dns.nxdomain["missing.example.test"] = true
+	dns.soaMin = 30
+	dns.mu.Unlock()
+	r, clock := newTestDNSResolver(dns.addr)
+
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupIPAddr(context.Background(), "missing.example.test")
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Fatalf("expected a not found error, got %v", err)
+		}
+	}
+	if dns.count() != 2 {
+		t.Errorf("expected the missing name to be cached, got %d queries", dns.count())
+	}
+	clock.t = clock.t.Add(31 * time.Second)
+	r.LookupIPAddr(context.Background(), "missing.example.test")
+	if dns.count() != 4 {
+		t.Errorf("expected the negative entry to expire, got %d queries", dns.count())
+	}
+
+	r.NegativeTTL = -1
+	r.Flush()
+	r.LookupIPAddr(context.Background(), "missing.example.test")
+	r.LookupIPAddr(context.Background(), "missing.example.test")
+	if dns.count() != 8 {
+		t.Errorf("expected negative caching to be disabled, got %d queries", dns.count())
+	}
+}
+
+func TestDNSResolverMaxEntries(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.Close()
+	dns.mu.Lock()
+	dns.nxdomain["a.example.test"] = true
+	dns.nxdomain["b.example.test"] = true
+	dns.nxdomain["c.example.test"] = true
+	dns.mu.Unlock()
+	r, _ := newTestDNSResolver(dns.addr)
+	// the A and AAAA answers of 2 names
+	r.MaxEntries = 4
+
+	for _, name := range []string{"a", "b", "a", "c", "a", "b"} {
+		r.LookupIPAddr(context.Background(), name+".example.test")
+	}
+	if dns.count() != 8 || len(r.cache) != 4 {
+		t.Errorf("expected b.example.test to be dropped and asked for again, got %d queries and %d entries", dns.count(), len(r.cache))
+	}
+}
+
+func TestDNSResolverSplitHorizon(t *testing.T) {
+	public := newFakeDNS(t)
+	defer public.Close()
+	corp := newFakeDNS(t)
+	defer corp.Close()
+	public.add("www.example.test", "192.0.2.1", 60)
+	public.add("wiki.corp.example.test", "192.0.2.2", 60)
+	corp.add("wiki.corp.example.test", "10.1.0.2", 60)
+	corp.add("corp.example.test", "10.1.0.1", 60)
+
+	r, _ := newTestDNSResolver(public.addr)
+	r.Forward(".corp.example.test.", corp.addr)
+	for host, expected := range map[string]string{
+		"www.example.test":       "192.0.2.1",
+		"wiki.corp.example.test": "10.1.0.2",
+		"corp.example.test":      "10.1.0.1",
+	} {
+		if ips := lookupStrings(t, r, host); len(ips) != 1 || ips[0] != expected {
+			t.Errorf("%s resolved to %v, expected %s", host, ips, expected)
+		}
+	}
+	if public.count() != 2 || corp.count() != 4 {
+		t.Errorf("unexpected number of queries: %d public, %d corp", public.count(), corp.count())
+	}
+}
+
+func TestDNSResolverTCPFallback(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.Close()
+	dns.mu.Lock()
+	dns.truncate = true
+	dns.mu.Unlock()
+	dns.add("big.example.test", "10.0.0.3", 60)
+	r, _ := newTestDNSResolver(dns.addr)
+	if ips := lookupStrings(t, r, "big.example.test"); len(ips) != 1 || ips[0] != "10.0.0.3" {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+	if dns.count() != 4 {
+		t.Errorf("expected two queries over UDP and two over TCP, got %d", dns.count())
+	}
+}
+
+func TestDNSResolverServerFailure(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, _ := newTestDNSResolver(conn.LocalAddr().String())
+	r.Timeout = 50 * time.Millisecond
+	_, err = r.LookupIPAddr(context.Background(), "www.example.test")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsTimeout {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestDNSResolverForgedAnswers(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.Close()
+	dns.add("www.example.test", "10.0.0.1", 60)
+	dns.add("evil.example.test", "192.0.2.66", 60)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// answers with the ID of the query, for another question, before the
+	// genuine one
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			_, off, _ := readDNSName(query, 12)
+			qtype := binary.BigEndian.Uint16(query[off:])
+			forged, _ := buildDNSQuery(binary.BigEndian.Uint16(query), "evil.example.test", qtype)
+			conn.WriteTo(dns.answer(forged, false), addr)
+			wrongType, _ := buildDNSQuery(binary.BigEndian.Uint16(query), "www.example.test", dnsTypeA+dnsTypeAAAA-qtype)
+			conn.WriteTo(dns.answer(wrongType, false), addr)
+			conn.WriteTo(dns.answer(query, false), addr)
+		}
+	}()
+
+	r, _ := newTestDNSResolver(conn.LocalAddr().String())
+	if ips := lookupStrings(t, r, "www.example.test"); len(ips) != 1 || ips[0] != "10.0.0.1" {
+		t.Errorf("expected the answers to other questions to be ignored, got %v", ips)
+	}
+}
+
+func TestStaticResolver(t *testing.T) {
+	fallback := &StaticResolver{Hosts: map[string][]net.IP{"other.test": {net.ParseIP("10.9.9.9")}}}
+	r, err := NewStaticResolver(strings.NewReader(`
+# overrides
+10.0.0.1 api.example.test API2.example.test
+fd00::1  api.example.test
+`), fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := lookupStrings(t, r, "API.example.test"); strings.Join(ips, " ") != "10.0.0.1 fd00::1" {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+	if ips := lookupStrings(t, r, "api2.example.test."); strings.Join(ips, " ") != "10.0.0.1" {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+	if ips := lookupStrings(t, r, "other.test"); strings.Join(ips, " ") != "10.9.9.9" {
+		t.Errorf("expected the fallback to be used, got %v", ips)
+	}
+	if _, err := fallback.LookupIPAddr(context.Background(), "nowhere.test"); err == nil {
+		t.Error("expected an error without fallback")
+	}
+	if _, err := NewStaticResolver(strings.NewReader("api.example.test 10.0.0.1\n"), nil); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
+
+func TestProxyResolver(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	_, tlsPort, _ := net.SplitHostPort(tlsBackend.Listener.Addr().String())
+
+	proxy := NewProxyHttpServer()
+	proxy.Resolver = &StaticResolver{Hosts: map[string][]net.IP{"backend.test": {net.ParseIP("127.0.0.1")}}}
+	override := &StaticResolver{Hosts: map[string][]net.IP{"override.test": {net.ParseIP("127.0.0.1")}}}
+	proxy.OnRequest(ReqHostMatches(regexp.MustCompile("^override"))).DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Resolver = override
+		return r, nil
+	})
+	var mu sync.Mutex
+	var resolved []string
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ip := range ctx.ResolvedIPs {
+			resolved = append(resolved, ip.String())
+		}
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for _, u := range []string{
+		"http://backend.test:" + port + "/",
+		"http://override.test:" + port + "/",
+		"https://backend.test:" + tlsPort + "/",
+	} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatalf("%s: %v", u, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "backend" {
+			t.Errorf("%s: unexpected body %q", u, b)
+		}
+	}
+	mu.Lock()
+	if strings.Join(resolved, " ") != "127.0.0.1 127.0.0.1" {
+		t.Errorf("unexpected resolved addresses %v", resolved)
+	}
+	mu.Unlock()
+
+	if resp, _ := client.Get("http://unknown.test:" + port + "/"); resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Error("expected an unknown host to fail")
+	}
+}
+
+func TestProxyResolverSameHost(t *testing.T) {
+	// the same port on two addresses, the staging one answering differently
+	prod := httptest.NewServer(ConstantHanlder("prod"))
+	defer prod.Close()
+	_, port, _ := net.SplitHostPort(prod.Listener.Addr().String())
+	l, err := net.Listen("tcp", "127.0.0.2:"+port)
+	if err != nil {
+		t.Skip("cannot listen on 127.0.0.2:", err)
+	}
+	staging := httptest.NewUnstartedServer(ConstantHanlder("staging"))
+	staging.Listener.Close()
+	staging.Listener = l
+	staging.Start()
+	defer staging.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Resolver = &StaticResolver{Hosts: map[string][]net.IP{"api.test": {net.ParseIP("127.0.0.1")}}}
+	stagingResolver := &StaticResolver{Hosts: map[string][]net.IP{"api.test": {net.ParseIP("127.0.0.2")}}}
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if r.Header.Get("X-Env") == "staging" {
+			ctx.Resolver = stagingResolver
+		}
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	defer tr.CloseIdleConnections()
+
+	for _, env := range []string{"prod", "staging", "prod", "staging"} {
+		req, _ := http.NewRequest("GET", "http://api.test:"+port+"/", nil)
+		req.Header.Set("X-Env", env)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != env {
+			t.Errorf("expected the request to reach %s, got %q", env, b)
+		}
+	}
+
+	// resolvers that cannot be told apart are refused
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Resolver = funcResolver(net.DefaultResolver.LookupIPAddr)
+		return r, nil
+	})
+	req, _ := http.NewRequest("GET", "http://api.test:"+port+"/", nil)
+	if resp, err := tr.RoundTrip(req); err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected a resolver that is not comparable to fail the request, got %v", err)
+	}
+}
+
+type funcResolver func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+func (f funcResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return f(ctx, host)
+}
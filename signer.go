@@ -3,13 +3,16 @@ package goproxy
 import (
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"fmt"
+	"io"
 	"math/big"
 	"math/rand"
 	"net"
@@ -37,7 +40,51 @@ func hashSortedBigInt(lst []string) *big.Int {
 
 var goproxySignerVersion = ":goroxy1"
 
+// CertProfile describes the certificates signed for MITM'd hosts. Without a
+// profile, they are valid from 1970 to 2049 and their key is RSA 2048 bits or
+// ECDSA P-256, as the key of the CA, which browsers limiting the validity of
+// certificates to 398 days reject:
+//
+//	proxy.CertProfile = &goproxy.CertProfile{Validity: 90 * 24 * time.Hour, Key: goproxy.KeyECDSAP256}
+type CertProfile struct {
+	// Validity of the certificates, 365 days if zero. It never extends past
+	// the validity of the CA.
+	Validity time.Duration
+	// Backdate is how long before their creation the certificates become
+	// valid, for clients with a clock late, one hour if zero
+	Backdate time.Duration
+	// Key is the kind of key of the certificates, the kind of key of the CA
+	// if KeyDefault
+	Key KeyAlgorithm
+	// Subject is the template of the subject of the certificates. An empty
+	// CommonName is set to the first host name, and an empty Organization to
+	// "GoProxy untrusted MITM proxy Inc".
+	Subject pkix.Name
+	// KeyUsage of the certificates, digital signature if zero, along with
+	// key encipherment for RSA keys
+	KeyUsage x509.KeyUsage
+	// ExtKeyUsage of the certificates, server authentication if nil
+	ExtKeyUsage []x509.ExtKeyUsage
+	// MirrorUpstream makes the proxy get the certificate of the remote host
+	// before accepting the TLS handshake of the client, and copy its names,
+	// subject and validity, bounded by Validity, instead of signing for the
+	// host name of the CONNECT request only, which is added when not covered.
+	// The certificates are stored by the fingerprint of the upstream
+	// certificate. It costs a connection to the
+	// remote host per MITM'd connection.
+	MirrorUpstream bool
+}
+
 func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err error) {
+	return signHostProfile(ca, hosts, nil, nil, nil)
+}
+
+// signHostProfile signs a certificate for hosts with ca, as described by
+// profile if not nil. If upstream is not nil, the certificate gets its names,
+// subject and validity instead, along with the hosts its names don't cover,
+// and profile must not be nil. The key of the
+// certificate is certpriv if not nil, a key generated for it otherwise.
+func signHostProfile(ca tls.Certificate, hosts []string, profile *CertProfile, upstream *x509.Certificate, certpriv crypto.Signer) (cert *tls.Certificate, err error) {
 	var x509ca *x509.Certificate
 
 	// Use the provided ca and not the global GoproxyCa for certificate generation.
@@ -49,20 +96,61 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 	if err != nil {
 		panic(err)
 	}
+	var p CertProfile
+	if profile != nil {
+		p = *profile
+		if p.Backdate == 0 {
+			p.Backdate = time.Hour
+		}
+		if p.Validity == 0 {
+			p.Validity = 365 * 24 * time.Hour
+		}
+		start = time.Now().Add(-p.Backdate)
+		if end = start.Add(p.Validity); end.After(x509ca.NotAfter) {
+			end = x509ca.NotAfter
+		}
+	}
+	if len(p.Subject.Organization) == 0 {
+		p.Subject.Organization = []string{"GoProxy untrusted MITM proxy Inc"}
+	}
+	if p.ExtKeyUsage == nil {
+		p.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if upstream != nil {
+		// the validity of the upstream certificate, no longer than the one
+		// of the profile
+		if upstream.NotAfter.Before(end) {
+			end = upstream.NotAfter
+		}
+		if start = end.Add(-p.Validity); start.Before(upstream.NotBefore) {
+			start = upstream.NotBefore
+		}
+		p.Subject = upstream.Subject
+		names := append([]string(nil), upstream.DNSNames...)
+		for _, ip := range upstream.IPAddresses {
+			names = append(names, ip.String())
+		}
+		// such as the host of the CONNECT request when the upstream
+		// certificate only has a common name, which clients ignore
+		for _, h := range hosts {
+			if upstream.VerifyHostname(h) != nil {
+				names = append(names, h)
+			}
+		}
+		hosts = names
+	}
 
 	serial := big.NewInt(rand.Int63())
 	template := x509.Certificate{
 		// TODO(elazar): instead of this ugly hack, just encode the certificate and hash the binary form.
 		SerialNumber: serial,
 		Issuer:       x509ca.Subject,
-		Subject: pkix.Name{
-			Organization: []string{"GoProxy untrusted MITM proxy Inc"},
-		},
-		NotBefore: start,
-		NotAfter:  end,
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		Subject:      p.Subject,
+		NotBefore:    start,
+		NotAfter:     end,
+
+		KeyUsage:              p.KeyUsage,
+		ExtKeyUsage:           p.ExtKeyUsage,
 		BasicConstraintsValid: true,
 	}
 	for _, h := range hosts {
@@ -70,41 +158,101 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 			template.IPAddresses = append(template.IPAddresses, ip)
 		} else {
 			template.DNSNames = append(template.DNSNames, h)
-			template.Subject.CommonName = h
+			if profile == nil {
+				template.Subject.CommonName = h
+			}
 		}
 	}
+	if profile != nil && upstream == nil && template.Subject.CommonName == "" && len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
 
-	hash := hashSorted(append(hosts, goproxySignerVersion, ":"+runtime.Version()))
+	// the key of the CA may be a crypto.Signer whose private key is out of
+	// reach, such as a RemoteSigner
+	caKey, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", ca.PrivateKey)
+	}
+
+	hash := hashSorted(append(hosts, goproxySignerVersion, ":"+runtime.Version(), string(ca.Certificate[0])))
 	var csprng CounterEncryptorRand
-	if csprng, err = NewCounterEncryptorRandFromKey(ca.PrivateKey, hash); err != nil {
+	if csprng, err = NewCounterEncryptorRand(signerSecret, hash); err != nil {
 		return
 	}
 
-	var certpriv crypto.Signer
-	switch ca.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		if certpriv, err = rsa.GenerateKey(&csprng, 2048); err != nil {
+	if certpriv == nil {
+		alg := p.Key
+		if alg == KeyDefault {
+			switch caKey.Public().(type) {
+			case *rsa.PublicKey:
+				alg = KeyRSA2048
+			case *ecdsa.PublicKey:
+				alg = KeyECDSAP256
+			case ed25519.PublicKey:
+				alg = KeyEd25519
+			default:
+				return nil, fmt.Errorf("unsupported key type %T", caKey.Public())
+			}
+		}
+		if certpriv, err = generateKey(alg, &csprng); err != nil {
 			return
 		}
-	case *ecdsa.PrivateKey:
-		if certpriv, err = ecdsa.GenerateKey(elliptic.P256(), &csprng); err != nil {
+	}
+	if template.KeyUsage == 0 {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		if _, isRSA := certpriv.Public().(*rsa.PublicKey); isRSA || profile == nil {
+			template.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+
+	if template.SubjectKeyId, err = keyID(certpriv.Public()); err != nil {
+		return
+	}
+	// CreateCertificate takes the authority key ID from the subject key ID
+	// of the CA, which old CAs lack
+	if len(x509ca.SubjectKeyId) == 0 {
+		if template.AuthorityKeyId, err = keyID(x509ca.PublicKey); err != nil {
 			return
 		}
-	default:
-		err = fmt.Errorf("unsupported key type %T", ca.PrivateKey)
 	}
 
 	var derBytes []byte
-	if derBytes, err = x509.CreateCertificate(&csprng, &template, x509ca, certpriv.Public(), ca.PrivateKey); err != nil {
+	if derBytes, err = x509.CreateCertificate(&csprng, &template, x509ca, certpriv.Public(), caKey); err != nil {
 		return
 	}
+	// the chain of an intermediate CA is sent along
 	return &tls.Certificate{
-		Certificate: [][]byte{derBytes, ca.Certificate[0]},
+		Certificate: append([][]byte{derBytes}, ca.Certificate...),
 		PrivateKey:  certpriv,
 	}, nil
 }
 
+// keyID returns the key identifier of pub, the SHA-1 hash of its bits as in
+// method 1 of RFC 5280, section 4.2.1.2.
+func keyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return sum[:], nil
+}
+
+// signerSecret keys the generation of the keys of the certificates, which
+// is deterministic for a given CA and hosts during the life of the process
+var signerSecret = make([]byte, 32)
+
 func init() {
 	// Avoid deterministic random numbers
 	rand.Seed(time.Now().UnixNano())
+	if _, err := io.ReadFull(cryptorand.Reader, signerSecret); err != nil {
+		panic(err)
+	}
 }
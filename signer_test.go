@@ -1,14 +1,27 @@
 package goproxy
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -163,3 +176,288 @@ func init() {
 		panic("Error parsing ecdsa CA " + err.Error())
 	}
 }
+
+func TestCertProfile(t *testing.T) {
+	profile := &CertProfile{
+		Validity:    90 * 24 * time.Hour,
+		Key:         KeyECDSAP384,
+		Subject:     pkix.Name{Organization: []string{"test"}, OrganizationalUnit: []string{"mitm"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, ca := range []tls.Certificate{GoproxyCa, EcdsaCa} {
+		cert, err := signHostProfile(ca, []string{"example.com", "1.1.1.1"}, profile, nil, nil)
+		orFatal("signHostProfile", err, t)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		orFatal("ParseCertificate", err, t)
+		if _, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || leaf.PublicKey.(*ecdsa.PublicKey).Curve != elliptic.P384() {
+			t.Errorf("expected a P-384 key, got %T", leaf.PublicKey)
+		}
+		if d := leaf.NotAfter.Sub(leaf.NotBefore); d != 90*24*time.Hour {
+			t.Errorf("expected a validity of 90 days, got %v", d)
+		}
+		if time.Since(leaf.NotBefore) < 59*time.Minute || time.Since(leaf.NotBefore) > time.Hour+time.Minute {
+			t.Errorf("expected the certificate to be backdated an hour, valid from %v", leaf.NotBefore)
+		}
+		if leaf.Subject.CommonName != "example.com" || leaf.Subject.OrganizationalUnit[0] != "mitm" {
+			t.Errorf("unexpected subject %v", leaf.Subject)
+		}
+		if leaf.KeyUsage != x509.KeyUsageDigitalSignature || len(leaf.ExtKeyUsage) != 2 {
+			t.Errorf("unexpected key usage %v %v", leaf.KeyUsage, leaf.ExtKeyUsage)
+		}
+		pubID, _ := keyID(leaf.PublicKey)
+		caID, _ := keyID(ca.Leaf.PublicKey)
+		if !bytes.Equal(leaf.SubjectKeyId, pubID) || !bytes.Equal(leaf.AuthorityKeyId, caID) {
+			t.Errorf("expected the key identifiers of the certificate and of the CA, got %x and %x", leaf.SubjectKeyId, leaf.AuthorityKeyId)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Leaf)
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+		orFatal("Verify", err, t)
+	}
+
+	// the certificates expire with the CA
+	cert, err := signHostProfile(EcdsaCa, []string{"example.com"}, &CertProfile{Validity: 100 * 365 * 24 * time.Hour, Key: KeyEd25519}, nil, nil)
+	orFatal("signHostProfile", err, t)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if !leaf.NotAfter.Equal(EcdsaCa.Leaf.NotAfter) {
+		t.Errorf("expected the certificate to expire with the CA on %v, got %v", EcdsaCa.Leaf.NotAfter, leaf.NotAfter)
+	}
+	if _, ok := cert.PrivateKey.(ed25519.PrivateKey); !ok {
+		t.Errorf("expected an Ed25519 key, got %T", cert.PrivateKey)
+	}
+}
+
+func TestMirrorUpstreamCert(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	proxy := NewProxyHttpServer()
+	proxy.CA = &EcdsaCa
+	proxy.CertProfile = &CertProfile{Validity: 24 * time.Hour, MirrorUpstream: true}
+	store := NewLRUCertStorage(10)
+	proxy.CertStore = store
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(EcdsaCa.Leaf)
+	proxyURL, _ := url.Parse(s.URL)
+	for i := 0; i < 2; i++ {
+		tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		resp, err := tr.RoundTrip(req)
+		orFatal("RoundTrip", err, t)
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+
+		upstream := backend.Certificate()
+		leaf := resp.TLS.PeerCertificates[0]
+		if leaf.Subject.Organization[0] != upstream.Subject.Organization[0] || len(leaf.DNSNames) != len(upstream.DNSNames) ||
+			len(leaf.IPAddresses) != len(upstream.IPAddresses) {
+			t.Errorf("expected the names of the upstream certificate, got %v, %v and %v", leaf.Subject, leaf.DNSNames, leaf.IPAddresses)
+		}
+		if d := leaf.NotAfter.Sub(leaf.NotBefore); d != 24*time.Hour {
+			t.Errorf("expected the validity to be bounded to a day, got %v", d)
+		}
+	}
+	if store.Len() != 1 {
+		t.Errorf("expected a single certificate stored, got %d", store.Len())
+	}
+}
+
+func TestUpstreamCertChecked(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	proxy := NewProxyHttpServer()
+	ctx := &ProxyCtx{Proxy: proxy}
+	host := strings.TrimPrefix(backend.URL, "https://")
+	_, err := ctx.upstreamCert(host)
+	orFatal("upstreamCert", err, t)
+
+	// the test certificate is not trusted by the system roots
+	(&VerifyPolicy{}).Apply(proxy.Tr)
+	if _, err := ctx.upstreamCert(host); err == nil {
+		t.Error("expected the certificate rejected by the policy not to be mirrored")
+	}
+
+	// a host never answering the handshake
+	defer func(timeout time.Duration) { defaultTLSHandshakeTimeout = timeout }(defaultTLSHandshakeTimeout)
+	defaultTLSHandshakeTimeout = 100 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			defer c.Close()
+			ioutil.ReadAll(c)
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ctx.upstreamCert(l.Addr().String())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the handshake to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the handshake to time out")
+	}
+}
+
+func TestMirrorSANLessCert(t *testing.T) {
+	profile := &CertProfile{Validity: 24 * time.Hour, MirrorUpstream: true}
+	now := time.Now()
+	roots := x509.NewCertPool()
+	roots.AddCert(EcdsaCa.Leaf)
+	for _, c := range []struct {
+		upstream *x509.Certificate
+		host     string
+		names    int
+	}{
+		// legacy certificates only naming the host in their common name
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "legacy.example"}, NotBefore: now, NotAfter: now.Add(time.Hour)}, "legacy.example", 1},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "10.0.0.1"}, NotBefore: now, NotAfter: now.Add(time.Hour)}, "10.0.0.1", 1},
+		// the host is covered already
+		{&x509.Certificate{DNSNames: []string{"*.example.com", "example.com"}, NotBefore: now, NotAfter: now.Add(time.Hour)}, "www.example.com", 2},
+	} {
+		cert, err := signHostProfile(EcdsaCa, []string{c.host}, profile, c.upstream, nil)
+		orFatal("signHostProfile", err, t)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		orFatal("ParseCertificate", err, t)
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: c.host, Roots: roots, CurrentTime: now}); err != nil {
+			t.Errorf("%s: %v", c.host, err)
+		}
+		if n := len(leaf.DNSNames) + len(leaf.IPAddresses); n != c.names {
+			t.Errorf("%s: expected %d names, got %v and %v", c.host, c.names, leaf.DNSNames, leaf.IPAddresses)
+		}
+	}
+}
+
+func TestIntermediateRemoteSigner(t *testing.T) {
+	root, err := GenerateCA(CAOptions{Subject: pkix.Name{CommonName: "root"}, Key: KeyECDSAP256})
+	orFatal("GenerateCA", err, t)
+	interKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	orFatal("GenerateKey", err, t)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	interDer, err := x509.CreateCertificate(rand.Reader, &template, root.Leaf, interKey.Public(), root.PrivateKey)
+	orFatal("CreateCertificate", err, t)
+
+	// the key of the intermediate CA is only known to the signer
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	defer l.Close()
+	go ServeSigner(l, interKey)
+	signer, err := DialSigner("tcp", l.Addr().String())
+	orFatal("DialSigner", err, t)
+	defer signer.Close()
+
+	ca := tls.Certificate{Certificate: [][]byte{interDer, root.Certificate[0]}, PrivateKey: signer}
+	proxy, err := New(WithCA(ca), WithEnvProxy(false))
+	orFatal("New", err, t)
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// the clients only know the root
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Leaf)
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	orFatal("RoundTrip", err, t)
+	defer resp.Body.Close()
+	if n := len(resp.TLS.PeerCertificates); n != 3 {
+		t.Errorf("expected the leaf, intermediate and root certificates, got %d", n)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "hello" {
+		t.Errorf("unexpected body %q", b)
+	}
+}
+
+// trackingListener closes the connections it accepted when closed, as a
+// process exiting would
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *trackingListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	return l.Listener.Close()
+}
+
+func TestRemoteSignerRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-signer")
+	orFatal("TempDir", err, t)
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "signer.sock")
+	serve := func(key crypto.Signer) net.Listener {
+		l, err := net.Listen("unix", addr)
+		orFatal("Listen", err, t)
+		tl := &trackingListener{Listener: l}
+		go ServeSigner(tl, key)
+		return tl
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	orFatal("GenerateKey", err, t)
+	l := serve(key)
+	signer, err := DialSigner("unix", addr)
+	orFatal("DialSigner", err, t)
+	defer signer.Close()
+
+	digest := sha256.Sum256([]byte("hello"))
+	sign := func() error {
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err == nil && !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+			t.Error("invalid signature")
+		}
+		return err
+	}
+	orFatal("Sign", sign(), t)
+	l.Close()
+	if err := sign(); err == nil {
+		t.Error("expected signing to fail while the signer is down")
+	}
+	l = serve(key)
+	orFatal("Sign once the signer restarted", sign(), t)
+
+	// a signer with another key is not trusted
+	l.Close()
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	orFatal("GenerateKey", err, t)
+	l = serve(other)
+	defer l.Close()
+	if err := sign(); err == nil || !strings.Contains(err.Error(), "another key") {
+		t.Errorf("expected a signer with another key to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// StreamStage is one step of a streaming body transformation. It is given a
+// reader of the output of the previous stage, and returns a reader of its own
+// output. Unlike HandleBytes, stages never need the whole body in memory, so
+// they can be used on arbitrarily large downloads.
+//
+// A stage that has seen enough can opt out by returning ErrStreamDone from
+// Read. The rest of its input then flows to the next stage untouched.
+type StreamStage func(r io.Reader, ctx *ProxyCtx) io.Reader
+
+// ErrStreamDone is returned by the reader of a StreamStage which does not need
+// to look at the rest of the stream. It may come together with the last bytes
+// the stage produces, but the stage must not hold back any data it already
+// read from its input, as the pipeline reads from the input directly afterwards.
+var ErrStreamDone = errors.New("goproxy: stream stage done")
+
+type streamStageReader struct {
+	stage  io.Reader
+	input  io.Reader
+	bypass bool
+}
+
+func (s *streamStageReader) Read(b []byte) (int, error) {
+	if s.bypass {
+		return s.input.Read(b)
+	}
+	n, err := s.stage.Read(b)
+	if err == ErrStreamDone {
+		s.bypass = true
+		if n == 0 {
+			return s.input.Read(b)
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// NewStreamPipeline chains the stages on top of r, the output of each stage
+// being the input of the next one.
+func NewStreamPipeline(r io.Reader, ctx *ProxyCtx, stages ...StreamStage) io.Reader {
+	for _, stage := range stages {
+		r = &streamStageReader{stage: stage(r, ctx), input: r}
+	}
+	return r
+}
+
+// HandleResponseStream returns a RespHandler passing the response body through
+// the given stages as it is sent to the client. Since the size of the result
+// isn't known in advance, the response is sent to the client chunked.
+func HandleResponseStream(stages ...StreamStage) RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+			return resp
+		}
+		resp.Body = &readCloser{NewStreamPipeline(resp.Body, ctx, stages...), resp.Body}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return resp
+	})
+}
+
+// HandleRequestStream returns a ReqHandler passing the request body through
+// the given stages as it is sent to the remote server, which will receive
+// it chunked.
+func HandleRequestStream(stages ...StreamStage) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body == nil || req.Body == http.NoBody {
+			return req, nil
+		}
+		req.Body = &readCloser{NewStreamPipeline(req.Body, ctx, stages...), req.Body}
+		req.GetBody = nil
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Del("Content-Length")
+		return req, nil
+	})
+}
+
+// StreamReplace returns a stage replacing the first n occurrences of old with
+// new, or all of them if n is negative. Matches are found even when they span
+// reads, and at most len(old)-1 bytes are held back waiting for more data.
+// Once n replacements were made the stage opts out of the pipeline.
+func StreamReplace(old, new []byte, n int) StreamStage {
+	return func(r io.Reader, ctx *ProxyCtx) io.Reader {
+		if len(old) == 0 {
+			n = 0
+		}
+		return &replaceReader{src: r, old: old, new: new, n: n, chunk: make([]byte, 32*1024)}
+	}
+}
+
+type replaceReader struct {
+	src      io.Reader
+	old, new []byte
+	n        int
+	chunk    []byte
+	pending  []byte // read from src, not scanned for matches yet
+	out      []byte // ready to be returned
+	err      error
+}
+
+func (r *replaceReader) scan() {
+	for r.n != 0 {
+		i := bytes.Index(r.pending, r.old)
+		if i < 0 {
+			break
+		}
+		r.out = append(r.out, r.pending[:i]...)
+		r.out = append(r.out, r.new...)
+		r.pending = r.pending[i+len(r.old):]
+		r.n--
+	}
+	keep := 0
+	if r.n != 0 && r.err == nil {
+		// the tail might be the start of a match
+		keep = len(r.old) - 1
+	}
+	if len(r.pending) > keep {
+		cut := len(r.pending) - keep
+		r.out = append(r.out, r.pending[:cut]...)
+		r.pending = append(r.pending[:0:0], r.pending[cut:]...)
+	}
+}
+
+func (r *replaceReader) Read(b []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.n == 0 && len(r.pending) == 0 {
+			return 0, ErrStreamDone
+		}
+		if r.err != nil {
+			r.scan()
+			if len(r.out) == 0 {
+				return 0, r.err
+			}
+			break
+		}
+		nr, err := r.src.Read(r.chunk)
+		r.pending = append(r.pending, r.chunk[:nr]...)
+		r.err = err
+		r.scan()
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	if len(r.out) == 0 {
+		r.out = nil
+	}
+	return n, nil
+}
@@ -0,0 +1,63 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func runPipeline(t *testing.T, in string, stages ...StreamStage) string {
+	r := NewStreamPipeline(iotest.OneByteReader(strings.NewReader(in)), nil, stages...)
+	b, err := ioutil.ReadAll(r)
+	orFatal("ReadAll", err, t)
+	return string(b)
+}
+
+func TestStreamReplaceAcrossReads(t *testing.T) {
+	got := runPipeline(t, "foo bar foo baz fo", StreamReplace([]byte("foo"), []byte("qux"), -1))
+	if got != "qux bar qux baz fo" {
+		t.Error("unexpected replacement result", got)
+	}
+}
+
+func TestStreamReplaceChained(t *testing.T) {
+	got := runPipeline(t, "aaa",
+		StreamReplace([]byte("a"), []byte("bb"), -1),
+		StreamReplace([]byte("bbb"), []byte("c"), -1))
+	// "aaa" -> "bbbbbb" -> "cc"
+	if got != "cc" {
+		t.Error("unexpected chained result", got)
+	}
+}
+
+// countingReader counts how many reads went through it
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+func TestStreamStageOptsOut(t *testing.T) {
+	in := "x" + strings.Repeat("y", 100)
+	var stage *countingReader
+	replaceOnce := func(r io.Reader, ctx *ProxyCtx) io.Reader {
+		stage = &countingReader{r: StreamReplace([]byte("x"), []byte("z"), 1)(r, ctx)}
+		return stage
+	}
+	r := NewStreamPipeline(iotest.OneByteReader(strings.NewReader(in)), nil, replaceOnce)
+	b, err := ioutil.ReadAll(r)
+	orFatal("ReadAll", err, t)
+	if string(b) != "z"+strings.Repeat("y", 100) {
+		t.Error("unexpected result", string(b))
+	}
+	// one read returning "z", one returning ErrStreamDone
+	if stage.reads != 2 {
+		t.Error("replace stage should have stopped reading through the pipeline after one replacement, reads:", stage.reads)
+	}
+}
@@ -0,0 +1,203 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings tells how long the steps of a proxied request took. The proxy fills
+// it in ProxyCtx.Timings as the request goes, so response handlers see every
+// step up to TimeToFirstByte, and the proxy log has all of them once the body
+// was sent, when Verbose is set.
+//
+// For CONNECT tunnels only DNS and Connect are measured, BodyTransfer being
+// the time the tunnel stayed open.
+type Timings struct {
+	// Start is when the proxy received the request
+	Start time.Time
+	// DNS is the time spent resolving the remote host
+	DNS time.Duration
+	// Connect is the time spent establishing the TCP connection, all
+	// attempts included
+	Connect time.Duration
+	// TLSHandshake is the time spent in the TLS handshake with the remote host
+	TLSHandshake time.Duration
+	// RequestWrite is the time spent sending the request, from the moment a
+	// connection was available
+	RequestWrite time.Duration
+	// TimeToFirstByte is the time between the end of the request and the
+	// first byte of the response
+	TimeToFirstByte time.Duration
+	// BodyTransfer is the time spent copying the response body to the client
+	BodyTransfer time.Duration
+	// Total is the time between Start and the end of the response
+	Total time.Duration
+	// ConnReused is set when the request was sent over a connection already
+	// used by a previous request, DNS, Connect and TLSHandshake are zero then
+	ConnReused bool
+}
+
+func (t Timings) String() string {
+	return fmt.Sprintf("dns=%v connect=%v tls=%v write=%v ttfb=%v body=%v total=%v reused=%v",
+		t.DNS, t.Connect, t.TLSHandshake, t.RequestWrite, t.TimeToFirstByte, t.BodyTransfer, t.Total, t.ConnReused)
+}
+
+// requestTrace records the timings of the connections and request to the
+// remote host, and the addresses the host resolved to. Its callbacks run in
+// the goroutines of the transport and of the dialer, several connection
+// attempts at once, and even after the request is done: they fill a copy that
+// save writes to the ProxyCtx, from the goroutine of the request.
+type requestTrace struct {
+	mu                                               sync.Mutex
+	timings                                          Timings
+	dnsStart, connectStart, tlsStart, gotConn, wrote time.Time
+	// dialed are the addresses resolved by the dials made for the request,
+	// by connection
+	dialed      map[connAddrs][]net.IP
+	resolvedIPs []net.IP
+}
+
+// connAddrs identifies a connection
+type connAddrs struct {
+	local, remote string
+}
+
+func connAddrsOf(c net.Conn) connAddrs {
+	return connAddrs{c.LocalAddr().String(), c.RemoteAddr().String()}
+}
+
+type requestTraceKey struct{}
+
+// withRequestTrace returns parent holding ctx, and tracing its connections
+// and request with the returned requestTrace
+func (ctx *ProxyCtx) withRequestTrace(parent context.Context) (context.Context, *requestTrace) {
+	t := &requestTrace{}
+	c := context.WithValue(withProxyCtx(parent, ctx), requestTraceKey{}, t)
+	return httptrace.WithClientTrace(c, t.clientTrace()), t
+}
+
+// requestTraceFrom returns the requestTrace of c, or nil
+func requestTraceFrom(c context.Context) *requestTrace {
+	t, _ := c.Value(requestTraceKey{}).(*requestTrace)
+	return t
+}
+
+// dial records that conn was dialed to one of ips
+func (t *requestTrace) dial(conn net.Conn, ips []net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dialed == nil {
+		t.dialed = make(map[connAddrs][]net.IP)
+	}
+	t.dialed[connAddrsOf(conn)] = ips
+}
+
+// use records that the request goes through conn, a new connection. Its
+// addresses are known if the request dialed it: the transport may give it
+// the connection dialed for another one.
+func (t *requestTrace) use(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resolvedIPs = t.dialed[connAddrsOf(conn)]
+}
+
+// save writes the timings measured and the addresses used so far to ctx
+func (t *requestTrace) save(ctx *ProxyCtx) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range []struct{ from, to *time.Duration }{
+		{&t.timings.DNS, &ctx.Timings.DNS},
+		{&t.timings.Connect, &ctx.Timings.Connect},
+		{&t.timings.TLSHandshake, &ctx.Timings.TLSHandshake},
+		{&t.timings.RequestWrite, &ctx.Timings.RequestWrite},
+		{&t.timings.TimeToFirstByte, &ctx.Timings.TimeToFirstByte},
+	} {
+		if *d.from != 0 {
+			*d.to = *d.from
+		}
+	}
+	if !t.gotConn.IsZero() {
+		ctx.Timings.ConnReused = t.timings.ConnReused
+	}
+	if t.resolvedIPs != nil {
+		ctx.ResolvedIPs = t.resolvedIPs
+	}
+}
+
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// net.Resolver reports again the lookup started by the dialer
+			if t.dnsStart.IsZero() {
+				t.dnsStart = time.Now()
+			}
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.DNS = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.timings.Connect == 0 {
+				t.timings.Connect = time.Since(t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.TLSHandshake = time.Since(t.tlsStart)
+		},
+		// the transport calls the next ones from the goroutine of the
+		// request
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				t.use(info.Conn)
+			}
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.gotConn = time.Now()
+			t.timings.ConnReused = info.Reused
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wrote = time.Now()
+			t.timings.RequestWrite = t.wrote.Sub(t.gotConn)
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timings.TimeToFirstByte = time.Since(t.wrote)
+		},
+	}
+}
+
+// finishTimings records the end of the request, the body having been copied
+// since bodyStart, and logs the timings
+func (ctx *ProxyCtx) finishTimings(bodyStart time.Time) {
+	now := time.Now()
+	ctx.Timings.BodyTransfer = now.Sub(bodyStart)
+	ctx.Timings.Total = now.Sub(ctx.Timings.Start)
+	ctx.Logf("Timings: %v", ctx.Timings)
+}
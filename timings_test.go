@@ -0,0 +1,183 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func timingsClient(t *testing.T, proxy *ProxyHttpServer) (*http.Client, func()) {
+	s := httptest.NewServer(proxy)
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	return &http.Client{Transport: tr}, func() {
+		tr.CloseIdleConnections()
+		s.Close()
+	}
+}
+
+func getTimings(t *testing.T, client *http.Client, url string, timings chan Timings) Timings {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return <-timings
+}
+
+func TestTimingsHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHttpServer()
+	timings := make(chan Timings, 1)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		timings <- ctx.Timings
+		return resp
+	})
+	client, done := timingsClient(t, proxy)
+	defer done()
+
+	first := getTimings(t, client, backend.URL, timings)
+	if first.ConnReused || first.Connect <= 0 {
+		t.Errorf("expected a new connection, got %v", first)
+	}
+	if first.TimeToFirstByte < 50*time.Millisecond {
+		t.Errorf("expected the time to first byte to include the wait of the server, got %v", first)
+	}
+	if first.Start.IsZero() || first.TLSHandshake != 0 {
+		t.Errorf("unexpected timings %v", first)
+	}
+	second := getTimings(t, client, backend.URL, timings)
+	if !second.ConnReused || second.Connect != 0 {
+		t.Errorf("expected the connection to be reused, got %v", second)
+	}
+}
+
+func TestTimingsMitm(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	timings := make(chan Timings, 1)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		timings <- ctx.Timings
+		return resp
+	})
+	client, done := timingsClient(t, proxy)
+	defer done()
+
+	if tm := getTimings(t, client, backend.URL, timings); tm.TLSHandshake <= 0 || tm.Connect <= 0 {
+		t.Errorf("expected the TLS handshake to be measured, got %v", tm)
+	}
+}
+
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) find(prefix string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if i := strings.Index(line, prefix); i >= 0 {
+			return line[i:]
+		}
+	}
+	return ""
+}
+
+func TestTimingsTunnel(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHttpServer()
+	logger := &recordLogger{}
+	proxy.Logger = logger
+	proxy.Verbose = true
+	client, done := timingsClient(t, proxy)
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// the timings are logged once the tunnel is closed
+	done()
+	var line string
+	for i := 0; i < 100 && line == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		line = logger.find("Timings:")
+	}
+	if !strings.Contains(line, "connect=") || strings.Contains(line, "connect=0s") {
+		t.Errorf("expected the timings of the tunnel to be logged, got %q", line)
+	}
+}
+
+// addrConn is a connection with addresses and nothing else
+type addrConn struct {
+	local, remote net.Addr
+}
+
+func (c addrConn) Read([]byte) (int, error)         { return 0, io.EOF }
+func (c addrConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c addrConn) Close() error                     { return nil }
+func (c addrConn) LocalAddr() net.Addr              { return c.local }
+func (c addrConn) RemoteAddr() net.Addr             { return c.remote }
+func (c addrConn) SetDeadline(time.Time) error      { return nil }
+func (c addrConn) SetReadDeadline(time.Time) error  { return nil }
+func (c addrConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestRequestTraceLateCallbacks(t *testing.T) {
+	ctx := &ProxyCtx{}
+	c, trace := ctx.withRequestTrace(context.Background())
+	ct := httptrace.ContextClientTrace(c)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+	dialed := addrConn{&net.TCPAddr{IP: net.IPv4zero, Port: 1234}, remote}
+	trace.dial(dialed, []net.IP{remote.IP})
+
+	// the transport gave the request a connection dialed for another one
+	ct.GotConn(httptrace.GotConnInfo{Conn: addrConn{&net.TCPAddr{IP: net.IPv4zero, Port: 1235}, remote}})
+	trace.save(ctx)
+	if ctx.ResolvedIPs != nil {
+		t.Errorf("expected no addresses for a connection the request did not dial, got %v", ctx.ResolvedIPs)
+	}
+	trace.use(dialed)
+	trace.save(ctx)
+	if len(ctx.ResolvedIPs) != 1 {
+		t.Errorf("expected the addresses of the connection dialed, got %v", ctx.ResolvedIPs)
+	}
+
+	// an attempt of the dialer ending after the request is done
+	ct.ConnectStart("tcp", "10.0.0.2:80")
+	ct.ConnectDone("tcp", "10.0.0.2:80", nil)
+	if ctx.Timings.Connect != 0 {
+		t.Errorf("expected the timings of the request not to change once saved, got %v", ctx.Timings)
+	}
+}
@@ -14,6 +14,7 @@ package transport
 import (
 	"bufio"
 	"compress/gzip"
+	"container/list"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -27,6 +28,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // DefaultTransport is the default implementation of Transport and is
@@ -43,13 +45,19 @@ const DefaultMaxIdleConnsPerHost = 2
 // Transport is an implementation of RoundTripper that supports http,
 // https, and http proxies (for either http or https with CONNECT).
 // Transport can also cache connections for future re-use.
+//
+// When MaxIdleConns is reached, the connection idle for the longest time is
+// closed to make room for the one becoming idle. Idle connections older than
+// IdleConnTimeout are closed in the background.
 type Transport struct {
-	lk       sync.Mutex
-	idleConn map[string][]*persistConn
-	altProto map[string]RoundTripper // nil or map of URI scheme => RoundTripper
+	lk        sync.Mutex
+	idleConn  map[string][]*persistConn
+	idleLRU   *list.List                     // of *persistConn, least recently used first
+	reapTimer *time.Timer                    // closes the connections idle for too long
+	connCount map[string]int                 // connections dialing, active or idle per key
+	connWait  map[string][]chan *persistConn // requests waiting for a connection per key
+	altProto  map[string]RoundTripper        // nil or map of URI scheme => RoundTripper
 
-	// TODO: tunable on global max cached connections
-	// TODO: tunable on timeout on cached connections
 	// TODO: optional pipelining
 
 	// Proxy specifies a function to return a proxy for a given
@@ -74,6 +82,30 @@ type Transport struct {
 	// (keep-alive) to keep to keep per-host.  If zero,
 	// DefaultMaxIdleConnsPerHost is used.
 	MaxIdleConnsPerHost int
+
+	// MaxIdleConns, if non-zero, controls the maximum idle
+	// connections kept across all hosts.
+	MaxIdleConns int
+
+	// MaxConnsPerHost, if non-zero, limits the number of connections
+	// per host, dialing, active and idle ones together. Requests
+	// over the limit wait for a connection to be available, or for
+	// their context to be done.
+	MaxConnsPerHost int
+
+	// IdleConnTimeout, if non-zero, is how long a connection may
+	// stay idle before it is closed.
+	IdleConnTimeout time.Duration
+
+	// ResponseHeaderTimeout, if non-zero, is how long to wait for
+	// the headers of the response once the request was written.
+	ResponseHeaderTimeout time.Duration
+
+	// ExpectContinueTimeout, if non-zero, is how long to wait for
+	// the "100 Continue" of the server before sending the body of a
+	// request with an "Expect: 100-continue" header. If zero, the
+	// body is sent right away.
+	ExpectContinueTimeout time.Duration
 }
 
 // ProxyFromEnvironment returns the URL of the proxy to use for a
@@ -161,7 +193,7 @@ func (t *Transport) DetailedRoundTrip(req *http.Request) (details *RoundTripDeta
 	// host (for http or https), the http proxy, or the http proxy
 	// pre-CONNECTed to https server.  In any case, we'll be ready
 	// to send it requests.
-	pconn, err := t.getConn(cm)
+	pconn, err := t.getConn(req, cm)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -204,15 +236,15 @@ func (t *Transport) RegisterProtocol(scheme string, rt RoundTripper) {
 func (t *Transport) CloseIdleConnections() {
 	t.lk.Lock()
 	defer t.lk.Unlock()
-	if t.idleConn == nil {
+	if t.idleLRU == nil {
 		return
 	}
-	for _, conns := range t.idleConn {
-		for _, pconn := range conns {
-			pconn.close()
-		}
+	for t.idleLRU.Len() > 0 {
+		t.closeConnLocked(t.idleLRU.Front().Value.(*persistConn))
+	}
+	if t.reapTimer != nil {
+		t.reapTimer.Stop()
 	}
-	t.idleConn = make(map[string][]*persistConn)
 }
 
 //
@@ -257,54 +289,217 @@ func (cm *connectMethod) proxyAuth() string {
 // a new request.
 // If pconn is no longer needed or not in a good state, putIdleConn
 // returns false.
+// If a request waits for a connection to the same host, pconn is handed
+// to it instead.
 func (t *Transport) putIdleConn(pconn *persistConn) bool {
 	t.lk.Lock()
 	defer t.lk.Unlock()
+	t.initLocked()
 	if t.DisableKeepAlives || t.MaxIdleConnsPerHost < 0 {
-		pconn.close()
+		t.closeConnLocked(pconn)
 		return false
 	}
 	if pconn.isBroken() {
 		return false
 	}
 	key := pconn.cacheKey
+	if w := t.popWaiterLocked(key); w != nil {
+		w <- pconn
+		return true
+	}
 	max := t.MaxIdleConnsPerHost
 	if max == 0 {
 		max = DefaultMaxIdleConnsPerHost
 	}
 	if len(t.idleConn[key]) >= max {
-		pconn.close()
+		t.closeConnLocked(pconn)
 		return false
 	}
+	if t.MaxIdleConns > 0 && t.idleLRU.Len() >= t.MaxIdleConns {
+		t.closeConnLocked(t.idleLRU.Front().Value.(*persistConn))
+	}
+	pconn.idleAt = time.Now()
+	pconn.idleElem = t.idleLRU.PushBack(pconn)
 	t.idleConn[key] = append(t.idleConn[key], pconn)
+	t.scheduleReapLocked()
 	return true
 }
 
 func (t *Transport) getIdleConn(cm *connectMethod) (pconn *persistConn) {
 	t.lk.Lock()
 	defer t.lk.Unlock()
-	if t.idleConn == nil {
-		t.idleConn = make(map[string][]*persistConn)
-	}
+	t.initLocked()
 	key := cm.String()
 	for {
-		pconns, ok := t.idleConn[key]
-		if !ok {
+		pconns := t.idleConn[key]
+		if len(pconns) == 0 {
 			return nil
 		}
-		if len(pconns) == 1 {
-			pconn = pconns[0]
-			delete(t.idleConn, key)
-		} else {
-			// 2 or more cached connections; pop last
-			// TODO: queue?
-			pconn = pconns[len(pconns)-1]
-			t.idleConn[key] = pconns[0 : len(pconns)-1]
+		// the most recently used connection is the least likely
+		// to have been closed by the server
+		pconn = pconns[len(pconns)-1]
+		t.removeIdleLocked(pconn)
+		if pconn.isBroken() {
+			continue
 		}
-		if !pconn.isBroken() {
-			return
+		if t.IdleConnTimeout > 0 && time.Since(pconn.idleAt) > t.IdleConnTimeout {
+			t.closeConnLocked(pconn)
+			continue
+		}
+		return
+	}
+}
+
+func (t *Transport) initLocked() {
+	if t.idleConn == nil {
+		t.idleConn = make(map[string][]*persistConn)
+		t.idleLRU = list.New()
+		t.connCount = make(map[string]int)
+		t.connWait = make(map[string][]chan *persistConn)
+	}
+}
+
+// removeIdleLocked removes pconn from the idle connections, if it is one.
+func (t *Transport) removeIdleLocked(pconn *persistConn) {
+	if pconn.idleElem == nil {
+		return
+	}
+	t.idleLRU.Remove(pconn.idleElem)
+	pconn.idleElem = nil
+	pconns := t.idleConn[pconn.cacheKey]
+	for i, pc := range pconns {
+		if pc == pconn {
+			pconns = append(pconns[:i], pconns[i+1:]...)
+			break
+		}
+	}
+	if len(pconns) == 0 {
+		delete(t.idleConn, pconn.cacheKey)
+	} else {
+		t.idleConn[pconn.cacheKey] = pconns
+	}
+}
+
+// closeConnLocked closes pconn, which may be idle.
+func (t *Transport) closeConnLocked(pconn *persistConn) {
+	t.removeIdleLocked(pconn)
+	if pconn.markClosed() {
+		t.releaseConnLocked(pconn.cacheKey)
+	}
+}
+
+// connClosed forgets about pconn, which was just closed.
+func (t *Transport) connClosed(pconn *persistConn) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.removeIdleLocked(pconn)
+	t.releaseConnLocked(pconn.cacheKey)
+}
+
+// scheduleReapLocked makes the reaper run when the oldest idle connection
+// expires.
+func (t *Transport) scheduleReapLocked() {
+	if t.IdleConnTimeout <= 0 || t.idleLRU.Len() == 0 {
+		return
+	}
+	oldest := t.idleLRU.Front().Value.(*persistConn)
+	d := time.Until(oldest.idleAt.Add(t.IdleConnTimeout))
+	if t.reapTimer == nil {
+		t.reapTimer = time.AfterFunc(d, t.reapIdle)
+	} else {
+		t.reapTimer.Reset(d)
+	}
+}
+
+// reapIdle closes the connections idle for more than IdleConnTimeout.
+func (t *Transport) reapIdle() {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.IdleConnTimeout <= 0 {
+		return
+	}
+	for t.idleLRU.Len() > 0 {
+		pconn := t.idleLRU.Front().Value.(*persistConn)
+		if time.Since(pconn.idleAt) < t.IdleConnTimeout {
+			break
+		}
+		t.closeConnLocked(pconn)
+	}
+	t.scheduleReapLocked()
+}
+
+// reserveConn counts a new connection to key, waiting until there are less
+// than MaxConnsPerHost of them. A request done with its connection may hand
+// it over while waiting, reserveConn returns it then.
+func (t *Transport) reserveConn(req *http.Request, key string) (*persistConn, error) {
+	t.lk.Lock()
+	t.initLocked()
+	if t.MaxConnsPerHost <= 0 || t.connCount[key] < t.MaxConnsPerHost {
+		t.connCount[key]++
+		t.lk.Unlock()
+		return nil, nil
+	}
+	w := make(chan *persistConn, 1)
+	t.connWait[key] = append(t.connWait[key], w)
+	t.lk.Unlock()
+
+	select {
+	case pconn := <-w:
+		return pconn, nil
+	case <-req.Context().Done():
+	}
+	t.lk.Lock()
+	waiting := false
+	for i, other := range t.connWait[key] {
+		if other == w {
+			t.connWait[key] = append(t.connWait[key][:i], t.connWait[key][i+1:]...)
+			waiting = true
+			break
+		}
+	}
+	t.lk.Unlock()
+	if !waiting {
+		// served meanwhile, pass it on
+		if pconn := <-w; pconn != nil {
+			t.putIdleConn(pconn)
+		} else {
+			t.releaseConn(key)
 		}
 	}
+	return nil, req.Context().Err()
+}
+
+// popWaiterLocked returns the request waiting for a connection to key for
+// the longest time, or nil.
+func (t *Transport) popWaiterLocked(key string) chan *persistConn {
+	waiters := t.connWait[key]
+	if len(waiters) == 0 {
+		return nil
+	}
+	if len(waiters) == 1 {
+		delete(t.connWait, key)
+	} else {
+		t.connWait[key] = waiters[1:]
+	}
+	return waiters[0]
+}
+
+func (t *Transport) releaseConn(key string) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.releaseConnLocked(key)
+}
+
+// releaseConnLocked gives the place of a connection to key that was closed
+// to a waiting request, if any.
+func (t *Transport) releaseConnLocked(key string) {
+	if w := t.popWaiterLocked(key); w != nil {
+		w <- nil
+		return
+	}
+	if t.connCount[key]--; t.connCount[key] <= 0 {
+		delete(t.connCount, key)
+	}
 }
 
 func (t *Transport) dial(network, addr string) (c net.Conn, raddr string, ip *net.TCPAddr, err error) {
@@ -327,15 +522,28 @@ func (t *Transport) dial(network, addr string) (c net.Conn, raddr string, ip *ne
 	return
 }
 
-// getConn dials and creates a new persistConn to the target as
-// specified in the connectMethod.  This includes doing a proxy CONNECT
-// and/or setting up TLS.  If this doesn't return an error, the persistConn
-// is ready to write requests to.
-func (t *Transport) getConn(cm *connectMethod) (*persistConn, error) {
+// getConn returns an idle connection to the target as specified in the
+// connectMethod, or dials a new one.  If this doesn't return an error,
+// the persistConn is ready to write requests to.
+func (t *Transport) getConn(req *http.Request, cm *connectMethod) (*persistConn, error) {
 	if pc := t.getIdleConn(cm); pc != nil {
 		return pc, nil
 	}
+	key := cm.String()
+	pc, err := t.reserveConn(req, key)
+	if pc != nil || err != nil {
+		return pc, err
+	}
+	if pc, err = t.dialConn(cm); err != nil {
+		t.releaseConn(key)
+	}
+	return pc, err
+}
 
+// dialConn dials and creates a new persistConn to the target as
+// specified in the connectMethod.  This includes doing a proxy CONNECT
+// and/or setting up TLS.
+func (t *Transport) dialConn(cm *connectMethod) (*persistConn, error) {
 	conn, raddr, ip, err := t.dial("tcp", cm.addr())
 	if err != nil {
 		if cm.proxyURL != nil {
@@ -395,12 +603,25 @@ func (t *Transport) getConn(cm *connectMethod) (*persistConn, error) {
 
 	if cm.targetScheme == "https" {
 		// Initiate TLS and check remote host name against certificate.
-		conn = tls.Client(conn, t.TLSClientConfig)
+		config := t.TLSClientConfig
+		if config == nil || config.ServerName == "" {
+			// the server may serve several hosts, and verification
+			// policies need the name
+			if config == nil {
+				config = &tls.Config{}
+			} else {
+				config = config.Clone()
+			}
+			config.ServerName = cm.tlsHost()
+		}
+		conn = tls.Client(conn, config)
 		if err = conn.(*tls.Conn).Handshake(); err != nil {
+			conn.Close()
 			return nil, err
 		}
 		if t.TLSClientConfig == nil || !t.TLSClientConfig.InsecureSkipVerify {
 			if err = conn.(*tls.Conn).VerifyHostname(cm.tlsHost()); err != nil {
+				conn.Close()
 				return nil, err
 			}
 		}
@@ -471,7 +692,6 @@ func useProxy(addr string) bool {
 // http://proxy.com|http           http to proxy, http to anywhere after that
 //
 // Note: no support to https to the proxy yet.
-//
 type connectMethod struct {
 	proxyURL     *url.URL // nil for no proxy, else full proxy URL
 	targetScheme string   // "http" or "https"
@@ -526,6 +746,10 @@ type persistConn struct {
 
 	host string
 	ip   *net.TCPAddr
+
+	// guarded by t.lk
+	idleAt   time.Time
+	idleElem *list.Element // in t.idleLRU while idle
 }
 
 func (pc *persistConn) isBroken() bool {
@@ -555,8 +779,11 @@ func (pc *persistConn) readLoop() {
 
 		pc.lk.Lock()
 		if pc.numExpectedResponses == 0 {
-			pc.closeLocked()
+			closed := pc.closeLocked()
 			pc.lk.Unlock()
+			if closed {
+				pc.t.connClosed(pc)
+			}
 			if len(pb) > 0 {
 				log.Printf("Unsolicited response received on idle HTTP channel starting with %q; err=%v",
 					string(pb), err)
@@ -574,6 +801,17 @@ func (pc *persistConn) readLoop() {
 			lastbody = nil
 		}
 		resp, err := http.ReadResponse(pc.br, rc.req)
+		if rc.continueCh != nil {
+			if err == nil && resp.StatusCode == http.StatusContinue {
+				rc.continueCh <- true
+				resp, err = http.ReadResponse(pc.br, rc.req)
+			} else {
+				// the server answered without asking for the
+				// body, which may be left unsent
+				rc.continueCh <- false
+				alive = false
+			}
+		}
 
 		if err != nil {
 			pc.close()
@@ -597,6 +835,13 @@ func (pc *persistConn) readLoop() {
 		if err != nil || resp.Close || rc.req.Close {
 			alive = false
 		}
+		if !alive && resp != nil {
+			if resp.ContentLength != 0 {
+				resp.Body = &closeConnOnClose{resp.Body, pc}
+			} else {
+				pc.close()
+			}
+		}
 
 		hasBody := resp != nil && resp.ContentLength != 0
 		var waitForBodyRead chan bool
@@ -649,6 +894,51 @@ type requestAndChan struct {
 	// Accept-Encoding gzip header? only if it we set it do
 	// we transparently decode the gzip.
 	addedGzip bool
+
+	// continueCh, if non-nil, is told whether the server asked for
+	// the body of a request expecting a "100 Continue"
+	continueCh chan<- bool
+}
+
+// continueBody holds the body of a request expecting a "100 Continue" until
+// the server asks for it, or ExpectContinueTimeout passed.
+type continueBody struct {
+	io.ReadCloser
+	bw         *bufio.Writer
+	continueCh <-chan bool
+	timeout    time.Duration
+	waited     bool
+	notSent    bool // the server answered before asking for the body
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	if !b.waited {
+		b.waited = true
+		// the headers may still be buffered
+		if err := b.bw.Flush(); err != nil {
+			return 0, err
+		}
+		timer := time.NewTimer(b.timeout)
+		defer timer.Stop()
+		select {
+		case ok := <-b.continueCh:
+			if !ok {
+				b.notSent = true
+				return 0, errors.New("http: server answered before the body was sent")
+			}
+		case <-timer.C:
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func expectsContinue(req *http.Request) bool {
+	for _, v := range req.Header["Expect"] {
+		if strings.EqualFold(strings.TrimSpace(v), "100-continue") {
+			return true
+		}
+	}
+	return false
 }
 
 func (pc *persistConn) roundTrip(req *transportRequest) (resp *http.Response, err error) {
@@ -673,21 +963,49 @@ func (pc *persistConn) roundTrip(req *transportRequest) (resp *http.Response, er
 	pc.numExpectedResponses++
 	pc.lk.Unlock()
 
+	ch := make(chan responseAndError, 1)
+	rc := requestAndChan{req: req.Request, ch: ch, addedGzip: requestedGzip}
+	wreq := req.Request
+	var body *continueBody
+	if pc.t.ExpectContinueTimeout > 0 && wreq.Body != nil && wreq.ContentLength > 0 && expectsContinue(wreq) {
+		continueCh := make(chan bool, 1)
+		rc.continueCh = continueCh
+		body = &continueBody{ReadCloser: wreq.Body, bw: pc.bw, continueCh: continueCh, timeout: pc.t.ExpectContinueTimeout}
+		r := *wreq
+		r.Body = body
+		wreq = &r
+	}
+	// the response is read while the request is being written, the
+	// server may answer before getting the body
+	pc.reqch <- rc
+
 	// orig: err = req.Request.write(pc.bw, pc.isProxy, req.extra)
 	if pc.isProxy {
-		err = req.Request.WriteProxy(pc.bw)
+		err = wreq.WriteProxy(pc.bw)
 	} else {
-		err = req.Request.Write(pc.bw)
+		err = wreq.Write(pc.bw)
 	}
-	if err != nil {
+	if err == nil {
+		err = pc.bw.Flush()
+	}
+	if err != nil && (body == nil || !body.notSent) {
 		pc.close()
 		return
 	}
-	pc.bw.Flush()
 
-	ch := make(chan responseAndError, 1)
-	pc.reqch <- requestAndChan{req.Request, ch, requestedGzip}
-	re := <-ch
+	var timeout <-chan time.Time
+	if pc.t.ResponseHeaderTimeout > 0 {
+		timer := time.NewTimer(pc.t.ResponseHeaderTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var re responseAndError
+	select {
+	case re = <-ch:
+	case <-timeout:
+		pc.close()
+		return nil, errTimeout
+	}
 	pc.lk.Lock()
 	pc.numExpectedResponses--
 	pc.lk.Unlock()
@@ -695,16 +1013,43 @@ func (pc *persistConn) roundTrip(req *transportRequest) (resp *http.Response, er
 	return re.res, re.err
 }
 
+// errTimeout is returned when the response headers took more than
+// ResponseHeaderTimeout.
+var errTimeout error = &timeoutError{"http: timeout awaiting response headers"}
+
+type timeoutError struct {
+	err string
+}
+
+func (e *timeoutError) Error() string   { return e.err }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
 func (pc *persistConn) close() {
+	pc.lk.Lock()
+	closed := pc.closeLocked()
+	pc.lk.Unlock()
+	if closed {
+		pc.t.connClosed(pc)
+	}
+}
+
+// markClosed closes pc, reporting whether it was open. Unlike close, the
+// Transport is left to forget about pc.
+func (pc *persistConn) markClosed() bool {
 	pc.lk.Lock()
 	defer pc.lk.Unlock()
-	pc.closeLocked()
+	return pc.closeLocked()
 }
 
-func (pc *persistConn) closeLocked() {
+func (pc *persistConn) closeLocked() bool {
+	if pc.broken {
+		return false
+	}
 	pc.broken = true
 	pc.conn.Close()
 	pc.mutateHeaderFunc = nil
+	return true
 }
 
 var portMap = map[string]string{
@@ -730,36 +1075,65 @@ func responseIsKeepAlive(res *http.Response) bool {
 // once, right before the final Read() or Close() call returns, but after
 // EOF has been seen.
 type bodyEOFSignal struct {
-	body     io.ReadCloser
+	body io.ReadCloser
+
+	mu       sync.Mutex // guards fn and isClosed, readLoop closes the last body too
 	fn       func()
 	isClosed bool
 }
 
 func (es *bodyEOFSignal) Read(p []byte) (n int, err error) {
 	n, err = es.body.Read(p)
-	if es.isClosed && n > 0 {
+	es.mu.Lock()
+	isClosed := es.isClosed
+	var fn func()
+	if err == io.EOF {
+		fn, es.fn = es.fn, nil
+	}
+	es.mu.Unlock()
+	if isClosed && n > 0 {
 		panic("http: unexpected bodyEOFSignal Read after Close; see issue 1725")
 	}
-	if err == io.EOF && es.fn != nil {
-		es.fn()
-		es.fn = nil
+	if fn != nil {
+		fn()
 	}
 	return
 }
 
 func (es *bodyEOFSignal) Close() (err error) {
+	es.mu.Lock()
 	if es.isClosed {
+		es.mu.Unlock()
 		return nil
 	}
 	es.isClosed = true
+	es.mu.Unlock()
 	err = es.body.Close()
-	if err == nil && es.fn != nil {
-		es.fn()
+	if err == nil {
+		es.mu.Lock()
+		fn := es.fn
 		es.fn = nil
+		es.mu.Unlock()
+		if fn != nil {
+			fn()
+		}
 	}
 	return
 }
 
+// closeConnOnClose closes the connection of a response body once it is
+// closed, when the connection cannot be reused.
+type closeConnOnClose struct {
+	io.ReadCloser
+	pc *persistConn
+}
+
+func (c *closeConnOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.pc.close()
+	return err
+}
+
 type readFirstCloseBoth struct {
 	io.ReadCloser
 	io.Closer
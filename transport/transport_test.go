@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connCounter counts the connections of a test server
+type connCounter struct {
+	mu        sync.Mutex
+	open, max int
+	closed    int
+}
+
+func (c *connCounter) connState(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		c.open++
+		if c.open > c.max {
+			c.max = c.open
+		}
+	case http.StateClosed, http.StateHijacked:
+		c.open--
+		c.closed++
+	}
+}
+
+func (c *connCounter) get() (open, max, closed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open, c.max, c.closed
+}
+
+func newCountingServer(h http.HandlerFunc) (*httptest.Server, *connCounter) {
+	s := httptest.NewUnstartedServer(h)
+	c := &connCounter{}
+	s.Config.ConnState = c.connState
+	s.Start()
+	return s, c
+}
+
+func get(t *testing.T, tr *Transport, url string) string {
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func (t *Transport) idleCount() int {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.idleLRU == nil {
+		return 0
+	}
+	return t.idleLRU.Len()
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	s, counter := newCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+	defer s.Close()
+	tr := &Transport{MaxConnsPerHost: 2, MaxIdleConnsPerHost: 2}
+	defer tr.CloseIdleConnections()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body := get(t, tr, s.URL); body != "ok" {
+				t.Errorf("unexpected body %q", body)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, max, _ := counter.get(); max > 2 {
+		t.Errorf("expected at most 2 connections, got %d", max)
+	}
+}
+
+func TestMaxConnsPerHostCancel(t *testing.T) {
+	release := make(chan bool)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	tr := &Transport{MaxConnsPerHost: 1}
+	defer tr.CloseIdleConnections()
+
+	done := make(chan bool)
+	go func() {
+		get(t, tr, s.URL)
+		done <- true
+	}()
+	time.Sleep(20 * time.Millisecond)
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := tr.RoundTrip(req.WithContext(ctx)); err == nil {
+		t.Error("expected the request waiting for a connection to be cancelled")
+	}
+	close(release)
+	<-done
+	// the connection is available again
+	if body := get(t, tr, s.URL); body != "" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	s, counter := newCountingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	defer s.Close()
+	tr := &Transport{IdleConnTimeout: 50 * time.Millisecond}
+	defer tr.CloseIdleConnections()
+
+	get(t, tr, s.URL)
+	get(t, tr, s.URL)
+	if n := tr.idleCount(); n != 1 {
+		t.Fatalf("expected the connection to be reused and idle, got %d idle", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := tr.idleCount(); n != 0 {
+		t.Errorf("expected the reaper to close the idle connection, got %d idle", n)
+	}
+	if open, max, _ := counter.get(); open != 0 || max != 1 {
+		t.Errorf("expected a single connection, now closed, got %d open of %d", open, max)
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	var servers []*httptest.Server
+	for i := 0; i < 3; i++ {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	tr := &Transport{MaxIdleConns: 2}
+	defer tr.CloseIdleConnections()
+	for _, s := range servers {
+		get(t, tr, s.URL)
+	}
+	if n := tr.idleCount(); n != 2 {
+		t.Fatalf("expected 2 idle connections, got %d", n)
+	}
+	tr.lk.Lock()
+	oldest := tr.idleLRU.Front().Value.(*persistConn).cacheKey
+	tr.lk.Unlock()
+	if oldest != "|http|"+servers[1].Listener.Addr().String() {
+		t.Errorf("expected the connection to the first server to be closed, oldest is %s", oldest)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer s.Close()
+	tr := &Transport{ResponseHeaderTimeout: 20 * time.Millisecond}
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	_, err := tr.RoundTrip(req)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer s.Close()
+	tr := &Transport{ExpectContinueTimeout: 5 * time.Second}
+	defer tr.CloseIdleConnections()
+
+	post := func(path string) (*http.Response, time.Duration) {
+		req, _ := http.NewRequest("POST", s.URL+path, bytes.NewReader([]byte("payload")))
+		req.Header.Set("Expect", "100-continue")
+		start := time.Now()
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, time.Since(start)
+	}
+	resp, elapsed := post("/")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "payload" || elapsed > time.Second {
+		t.Errorf("expected the body to be sent on 100 Continue, got %q after %v", b, elapsed)
+	}
+	resp, elapsed = post("/reject")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || elapsed > time.Second {
+		t.Errorf("expected the server to answer without the body, got %v after %v", resp.Status, elapsed)
+	}
+}
@@ -0,0 +1,211 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VerifyPolicy is how the proxy checks the certificates of the remote hosts.
+// Without one, the proxy accepts any certificate, and MITM'd clients cannot
+// tell an impostor from the real host. The zero value checks the
+// certificates against the system roots:
+//
+//	policy := &goproxy.VerifyPolicy{
+//		Pins:       map[string][]string{"api.example.com": {"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}},
+//		Exceptions: goproxy.NewDomainSet(".internal.example"),
+//	}
+//	if err := policy.AddCABundle(corporateCAs); err != nil {
+//		...
+//	}
+//	policy.Apply(proxy.Tr)
+//
+// A MITM'd client whose request fails the policy gets an error page, and
+// response handlers find the *UpstreamCertError in ProxyCtx.Error.
+type VerifyPolicy struct {
+	// Roots, if not nil, are the CAs trusted instead of the system roots
+	Roots *x509.CertPool
+	// Pins maps host names to the base64 SHA-256 hashes of the public keys
+	// (SPKI) one of which must be in the verified chain of the host, as in
+	// HPKP: openssl x509 -pubkey -noout | openssl pkey -pubin -outform der |
+	// openssl dgst -sha256 -binary | base64
+	Pins map[string][]string
+	// Exceptions, if not nil, are the hosts whose certificates are not
+	// checked at all
+	Exceptions *DomainSet
+}
+
+// UpstreamCertError is the error of a remote host whose certificate failed
+// the VerifyPolicy of the proxy.
+type UpstreamCertError struct {
+	Host string
+	// Err is the reason, such as an x509.UnknownAuthorityError
+	Err error
+}
+
+func (e *UpstreamCertError) Error() string {
+	return "goproxy: certificate of " + e.Host + " rejected: " + e.Err.Error()
+}
+
+func (e *UpstreamCertError) Unwrap() error {
+	return e.Err
+}
+
+// AddCABundle adds the PEM certificates of bundle to the trusted CAs,
+// besides the system roots if Roots is nil.
+func (p *VerifyPolicy) AddCABundle(bundle []byte) error {
+	if p.Roots == nil {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return err
+		}
+		p.Roots = roots
+	}
+	if !p.Roots.AppendCertsFromPEM(bundle) {
+		return errors.New("goproxy: no certificate in CA bundle")
+	}
+	return nil
+}
+
+// Apply makes tr check the certificates of the remote hosts with the policy.
+// It replaces the DialTLSContext of tr, and its TLS configuration with a copy
+// checking the certificates with the policy, the rest of it being kept.
+func (p *VerifyPolicy) Apply(tr *http.Transport) {
+	config := &tls.Config{}
+	if tr.TLSClientConfig != nil {
+		config = tr.TLSClientConfig.Clone()
+	}
+	// the policy checks the certificates itself
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = p.VerifyConnection
+	tr.TLSClientConfig = config
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if tr.DialContext != nil {
+			conn, err = tr.DialContext(ctx, network, addr)
+		} else {
+			conn, err = (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// unlike its ConnectionState, the configuration of the connection
+		// has the name of hosts given by their IP address
+		host := stripPort(addr)
+		config := tr.TLSClientConfig.Clone()
+		config.ServerName = host
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return p.verify(host, cs)
+		}
+		// the clones of tr made per client certificate or key log share
+		// this function
+		if pctx := proxyCtxFrom(ctx); pctx != nil {
+			if pctx.clientCert != nil {
+				config.GetClientCertificate = clientCertFunc(pctx.clientCert)
+			}
+			if pctx.keyLogged {
+				config.KeyLogWriter = pctx.Proxy.KeyLog
+			}
+		}
+		if tr.TLSHandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(tr.TLSHandshakeTimeout))
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
+
+// TLSConfig returns a TLS configuration applying the policy, for the
+// transports other than *http.Transport. Since TLS does not tell the name of
+// the hosts given by their IP address, their certificates are rejected,
+// unless they are Exceptions.
+func (p *VerifyPolicy) TLSConfig() *tls.Config {
+	return &tls.Config{
+		// the policy checks the certificates itself
+		InsecureSkipVerify: true,
+		VerifyConnection:   p.VerifyConnection,
+	}
+}
+
+// VerifyConnection checks the certificates of the TLS connection cs, as
+// tls.Config.VerifyConnection.
+func (p *VerifyPolicy) VerifyConnection(cs tls.ConnectionState) error {
+	return p.verify(cs.ServerName, cs)
+}
+
+func (p *VerifyPolicy) verify(host string, cs tls.ConnectionState) error {
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if p.Exceptions != nil {
+		if _, ok := p.Exceptions.Match(host); ok {
+			return nil
+		}
+	}
+	if host == "" {
+		return &UpstreamCertError{host, errors.New("no host name to check the certificate against")}
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return &UpstreamCertError{host, errors.New("no certificate")}
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         p.Roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return &UpstreamCertError{host, err}
+	}
+
+	pins, ok := p.Pins[strings.ToLower(host)]
+	if !ok {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			spki := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pin := range pins {
+				if pin == spki {
+					return nil
+				}
+			}
+		}
+	}
+	return &UpstreamCertError{host, errors.New("no pinned public key in the certificate chain")}
+}
+
+var certErrorTemplate = template.Must(template.New("certError").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Untrusted certificate</title></head>
+<body>
+<h1>The certificate of {{.Host}} is not trusted</h1>
+<p>The proxy did not send your request, since it could not make sure it was talking to {{.Host}}: someone may be impersonating it.</p>
+<p>Reason: <code>{{.Err}}</code></p>
+</body>
+</html>
+`))
+
+// certErrorResponse returns the page telling the client of a MITM'd
+// connection why its request was not sent.
+func certErrorResponse(r *http.Request, err *UpstreamCertError) *http.Response {
+	var b strings.Builder
+	certErrorTemplate.Execute(&b, err)
+	return NewResponse(r, ContentTypeHtml+"; charset=utf-8", http.StatusBadGateway, b.String())
+}
@@ -0,0 +1,165 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyPolicy(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	cert := backend.Certificate()
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	trusted := x509.NewCertPool()
+	trusted.AddCert(cert)
+
+	for name, test := range map[string]struct {
+		policy *VerifyPolicy
+		ok     bool
+	}{
+		"unknown CA":   {&VerifyPolicy{Roots: x509.NewCertPool()}, false},
+		"trusted CA":   {&VerifyPolicy{Roots: trusted}, true},
+		"pinned":       {&VerifyPolicy{Roots: trusted, Pins: map[string][]string{"example.com": {"bad", pin}}}, true},
+		"wrong pin":    {&VerifyPolicy{Roots: trusted, Pins: map[string][]string{"example.com": {"bad"}}}, false},
+		"other pinned": {&VerifyPolicy{Roots: trusted, Pins: map[string][]string{"other.com": {"bad"}}}, true},
+		"exception":    {&VerifyPolicy{Roots: x509.NewCertPool(), Exceptions: NewDomainSet(".example.com")}, true},
+	} {
+		err := test.policy.VerifyConnection(tls.ConnectionState{ServerName: "example.com", PeerCertificates: []*x509.Certificate{cert}})
+		var certErr *UpstreamCertError
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		} else if !test.ok && !errors.As(err, &certErr) {
+			t.Errorf("%s: expected an UpstreamCertError, got %v", name, err)
+		}
+	}
+}
+
+func TestVerifyPolicyMitm(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	proxy, err := New(WithEnvProxy(false), WithVerifyPolicy(&VerifyPolicy{Roots: x509.NewCertPool()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	var ctxErr error
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		ctxErr = ctx.Error
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(b), "is not trusted") {
+		t.Errorf("expected the error page, got %s %q", resp.Status, b)
+	}
+	var certErr *UpstreamCertError
+	if !errors.As(ctxErr, &certErr) || certErr.Host != "127.0.0.1" {
+		t.Errorf("expected the UpstreamCertError in ctx.Error, got %v", ctxErr)
+	}
+}
+
+func TestVerifyPolicyApply(t *testing.T) {
+	backend := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(backend.Certificate())
+	tr := &http.Transport{}
+	(&VerifyPolicy{Roots: trusted}).Apply(tr)
+	defer tr.CloseIdleConnections()
+
+	// the certificate is checked against the IP address of the backend
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		resp, err := tr.RoundTrip(newCondRequest("GET", strings.Replace(backend.URL, "127.0.0.1", host, 1), ""))
+		if host == "127.0.0.1" {
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			continue
+		}
+		var certErr *UpstreamCertError
+		if !errors.As(err, &certErr) || certErr.Host != "localhost" {
+			t.Errorf("expected the certificate not to be valid for localhost, got %v", err)
+		}
+	}
+}
+
+func TestVerifyPolicyWebsocket(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	}))
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "https://")
+	trusted := x509.NewCertPool()
+	trusted.AddCert(backend.Certificate())
+
+	upgrade := func(policy *VerifyPolicy) (*http.Response, error) {
+		proxy, err := New(WithEnvProxy(false), WithVerifyPolicy(policy))
+		orFatal("New", err, t)
+		proxy.OnRequest().HandleConnect(AlwaysMitm)
+		s := httptest.NewServer(proxy)
+		defer s.Close()
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		orFatal("Dial", err, t)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+			t.Fatal(err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		orFatal("Write", req.Write(tlsConn), t)
+		return http.ReadResponse(bufio.NewReader(tlsConn), req)
+	}
+	if resp, err := upgrade(&VerifyPolicy{Roots: trusted}); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("expected the upgrade to succeed, got %v", err)
+	}
+	if resp, err := upgrade(&VerifyPolicy{Roots: x509.NewCertPool()}); err == nil {
+		t.Errorf("expected the upgrade to fail the policy, got %s", resp.Status)
+	}
+}
+
+func TestVerifyPolicyApplyKeepsConfig(t *testing.T) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"http/1.1"}}
+	tr := &http.Transport{TLSClientConfig: config}
+	(&VerifyPolicy{}).Apply(tr)
+	if tr.TLSClientConfig == config || config.VerifyConnection != nil || config.InsecureSkipVerify {
+		t.Error("expected the configuration of the transport to be copied")
+	}
+	if c := tr.TLSClientConfig; c.MinVersion != tls.VersionTLS12 || len(c.NextProtos) != 1 || c.VerifyConnection == nil {
+		t.Errorf("expected the settings of the transport to be kept, got %+v", c)
+	}
+}
@@ -3,10 +3,13 @@ package goproxy
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 func headerContains(header http.Header, name string, value string) bool {
@@ -25,33 +28,50 @@ func isWebSocketRequest(r *http.Request) bool {
 		headerContains(r.Header, "Upgrade", "websocket")
 }
 
-func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request, tlsConfig *tls.Config, clientConn *tls.Conn) {
+func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request, clientConn *tls.Conn) {
 	targetURL := url.URL{Scheme: "wss", Host: req.URL.Host, Path: req.URL.Path}
 
 	// Connect to upstream
-	targetConn, err := tls.Dial("tcp", targetURL.Host, tlsConfig)
+	tlsConfig, err := ctx.upstreamTLSConfig(stripPort(targetURL.Host))
+	if err != nil {
+		ctx.Warnf("Error configuring TLS with target site: %v", err)
+		proxy.websocketFailed(ctx, err)
+		return
+	}
+	rawConn, err := proxy.connectDial(ctx, "tcp", targetURL.Host)
 	if err != nil {
 		ctx.Warnf("Error dialing target site: %v", err)
+		proxy.websocketFailed(ctx, err)
 		return
 	}
+	targetConn := tls.Client(rawConn, tlsConfig)
 	defer targetConn.Close()
+	rawConn.SetDeadline(time.Now().Add(proxy.tlsHandshakeTimeout()))
+	if err := targetConn.Handshake(); err != nil {
+		ctx.Warnf("Error handshaking with target site: %v", err)
+		proxy.websocketFailed(ctx, err)
+		return
+	}
+	rawConn.SetDeadline(time.Time{})
 
 	// Perform handshake
-	if err := proxy.websocketHandshake(ctx, req, targetConn, clientConn); err != nil {
+	upstream, err := proxy.websocketHandshake(ctx, req, targetConn, clientConn)
+	if err != nil {
 		ctx.Warnf("Websocket handshake error: %v", err)
 		return
 	}
 
 	// Proxy wss connection
-	proxy.proxyWebsocket(ctx, targetConn, clientConn)
+	proxy.proxyWebsocket(ctx, upstream, clientConn)
 }
 
 func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request) {
 	targetURL := url.URL{Scheme: "ws", Host: req.URL.Host, Path: req.URL.Path}
 
-	targetConn, err := proxy.connectDial("tcp", targetURL.Host)
+	targetConn, err := proxy.connectDial(ctx, "tcp", targetURL.Host)
 	if err != nil {
 		ctx.Warnf("Error dialing target site: %v", err)
+		proxy.websocketFailed(ctx, err)
 		return
 	}
 	defer targetConn.Close()
@@ -64,25 +84,47 @@ func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWrite
 	clientConn, _, err := hj.Hijack()
 	if err != nil {
 		ctx.Warnf("Hijack error: %v", err)
+		proxy.websocketFailed(ctx, err)
 		return
 	}
+	defer clientConn.Close()
 
 	// Perform handshake
-	if err := proxy.websocketHandshake(ctx, req, targetConn, clientConn); err != nil {
+	upstream, err := proxy.websocketHandshake(ctx, req, targetConn, clientConn)
+	if err != nil {
 		ctx.Warnf("Websocket handshake error: %v", err)
 		return
 	}
 
 	// Proxy ws connection
-	proxy.proxyWebsocket(ctx, targetConn, clientConn)
+	proxy.proxyWebsocket(ctx, upstream, clientConn)
 }
 
-func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Request, targetSiteConn io.ReadWriter, clientConn io.ReadWriter) error {
+// websocketFailed runs the response handlers for an upgrade request that
+// failed with err before getting a response, as for the other requests
+func (proxy *ProxyHttpServer) websocketFailed(ctx *ProxyCtx, err error) {
+	ctx.Error = err
+	proxy.filterResponse(nil, ctx)
+}
+
+// upgradedConn is the connection to the remote server once upgraded: reading
+// it reads what the server sends, writing it writes to the server.
+type upgradedConn struct {
+	io.Reader
+	io.Writer
+}
+
+// websocketHandshake forwards the upgrade request to the remote server and its
+// answer to the client, through the response handlers. It returns the upgraded
+// connection to the remote server, whose stream is wrapped by
+// ProxyCtx.WrapUpgraded if set.
+func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Request, targetSiteConn io.ReadWriter, clientConn io.Writer) (io.ReadWriter, error) {
 	// write handshake request to target
 	err := req.Write(targetSiteConn)
 	if err != nil {
 		ctx.Warnf("Error writing upgrade request: %v", err)
-		return err
+		proxy.websocketFailed(ctx, err)
+		return nil, err
 	}
 
 	targetTLSReader := bufio.NewReader(targetSiteConn)
@@ -91,19 +133,31 @@ func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Reques
 	resp, err := http.ReadResponse(targetTLSReader, req)
 	if err != nil {
 		ctx.Warnf("Error reading handhsake response  %v", err)
-		return err
+		proxy.websocketFailed(ctx, err)
+		return nil, err
 	}
 
 	// Run response through handlers
 	resp = proxy.filterResponse(resp, ctx)
+	if resp == nil {
+		return nil, errors.New("websocket handshake response dropped by the response handlers")
+	}
 
 	// Proxy handshake back to client
 	err = resp.Write(clientConn)
 	if err != nil {
 		ctx.Warnf("Error writing handshake response: %v", err)
-		return err
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade answered with %v", resp.Status)
+	}
+	// the reader may already hold the first frames
+	var upstream io.Reader = targetTLSReader
+	if ctx.WrapUpgraded != nil {
+		upstream = ctx.WrapUpgraded(upstream)
 	}
-	return nil
+	return upgradedConn{upstream, targetSiteConn}, nil
 }
 
 func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, dest io.ReadWriter, source io.ReadWriter) {